@@ -1,5 +1,15 @@
 module proj0
 
-go 1.21.1
+go 1.21.3
 
-require github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5
+require audio v0.0.0
+
+require (
+	github.com/ebitengine/oto/v3 v3.1.0 // indirect
+	github.com/ebitengine/purego v0.5.0 // indirect
+	github.com/gen2brain/malgo v0.11.10 // indirect
+	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
+
+replace audio => ../../proj1/audio
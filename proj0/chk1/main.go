@@ -6,12 +6,13 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"math"
 	"os"
-	"time"
+	"sync"
 
-	"github.com/gordonklaus/portaudio"
+	"audio"
 )
 
 func chk(err error) {
@@ -21,37 +22,68 @@ func chk(err error) {
 }
 
 func main() {
-  portaudio.Initialize()
-  defer portaudio.Terminate()
+	backends := audio.BackendsUsage()
+	input := flag.String("input", "malgo", "audio backend to record from, one of "+backends)
+	output := flag.String("output", "malgo", "audio backend to play back on, one of "+backends)
+	rate := flag.Int("sample-rate", 44100, "rate to record and play at, usually 44100 or 48000")
+	devices := audio.AddDeviceFlags(flag.CommandLine, true, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
 
-  sample_rate := 44100.0 // this is the frame one sec for a 44100 hz sampled input
-  record_duration := 10.0 // we record for 10s
-  frame_per_buf := int(math.Round(sample_rate * record_duration))+1
-  recorded := make([]int32, frame_per_buf)
+	sample_rate := float64(*rate) // this is the frame one sec of input
+	record_duration := 10.0       // we record for 10s
+	frame_per_buf := int(math.Round(sample_rate*record_duration)) + 1
+	cfg := audio.Config{SampleRate: int(sample_rate)}
+	input_cfg, output_cfg := cfg, cfg
+	var err error
+	input_cfg.Device, err = devices.Input(*input)
+	chk(err)
+	output_cfg.Device, err = devices.Output(*output)
+	chk(err)
 
-  input_stream, err := portaudio.OpenDefaultStream(1, 0, sample_rate, frame_per_buf, recorded)
-  chk(err)
-  defer input_stream.Close()
+	input_stream, err := audio.OpenSource(*input, input_cfg)
+	chk(err)
+	defer input_stream.Close()
 
-  fmt.Printf("Press any key to start recording for %f secs", record_duration)
-  bufio.NewReader(os.Stdin).ReadBytes('\n') 
+	fmt.Printf("Press any key to start recording for %f secs", record_duration)
+	bufio.NewReader(os.Stdin).ReadBytes('\n')
 
-  chk(input_stream.Start())
-  chk(input_stream.Read())
-  chk(input_stream.Stop())
+	recorded := record(input_stream, frame_per_buf)
 
-  fmt.Printf("Finish recording, press any key to play back")
-  bufio.NewReader(os.Stdin).ReadBytes('\n') 
+	fmt.Printf("Finish recording, press any key to play back")
+	bufio.NewReader(os.Stdin).ReadBytes('\n')
 
-  output_stream, err := portaudio.OpenDefaultStream(0, 1, sample_rate, frame_per_buf, &recorded)
-  chk(err)
-  defer output_stream.Close()
+	output_stream, err := audio.OpenSink(*output, output_cfg)
+	chk(err)
+	defer output_stream.Close()
 
-  chk(output_stream.Start())
-  defer output_stream.Stop()
+	chk(output_stream.Write(recorded))
+	chk(output_stream.Drain())
 
-  output_stream.Write()
-  time.Sleep(time.Duration(record_duration) * time.Second)
+	fmt.Printf("Done playing audio, quiting")
+}
 
-  fmt.Printf("Done playing audio, quiting")
+// collects frames samples, or whatever the source has if it runs dry first
+func record(source audio.AudioSource, frames int) []float32 {
+	recorded := make([]float32, 0, frames)
+	full := make(chan struct{})
+	var once sync.Once
+	done := func() { once.Do(func() { close(full) }) }
+	chk(source.Start(func(samples []float32) {
+		if len(recorded) == frames {
+			return
+		}
+		recorded = append(recorded, samples[:min(len(samples), frames-len(recorded))]...)
+		if len(recorded) == frames {
+			done()
+		}
+	}))
+	go func() {
+		source.Wait()
+		done()
+	}()
+	<-full
+	return recorded
 }
@@ -2,106 +2,129 @@
 package main
 
 import (
-    "bytes"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
 
-    "github.com/ebitengine/oto/v3"
-    "github.com/hajimehoshi/go-mp3"
+	"github.com/hajimehoshi/go-mp3"
 
-        "bufio"
-        "fmt"
-        "math"
-        "os"
-        "time"
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
 
-        "github.com/gordonklaus/portaudio"
+	"audio"
 )
 
 func main() {
+	backends := audio.BackendsUsage()
+	music_output := flag.String("music-output", "malgo", "audio backend the mp3 is played on, one of "+backends)
+	input := flag.String("input", "malgo", "audio backend to record from")
+	output := flag.String("output", "malgo", "audio backend to play the recording back on")
+	rate := flag.Int("sample-rate", 44100, "rate to record and play at, usually 44100 or 48000")
+	devices := audio.AddDeviceFlags(flag.CommandLine, true, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
 
-  portaudio.Initialize()
-  defer portaudio.Terminate()
-
-  record_duration := 10.0 // we record for 10s
-
-    // Read the mp3 file into memory
-    fileBytes, err := os.ReadFile("./mu.mp3")
-    if err != nil {
-        panic("reading my-file.mp3 failed: " + err.Error())
-    }
-
-    // Convert the pure bytes into a reader object that can be used with the mp3 decoder
-    fileBytesReader := bytes.NewReader(fileBytes)
-
-    // Decode file
-    decodedMp3, err := mp3.NewDecoder(fileBytesReader)
-    if err != nil {
-        panic("mp3.NewDecoder failed: " + err.Error())
-    }
-
-    // Prepare an Oto context (this will use your default audio device) that will
-    // play all our sounds. Its configuration can't be changed later.
-
-    op := &oto.NewContextOptions{}
-
-    // Usually 44100 or 48000. Other values might cause distortions in Oto
-    op.SampleRate = 44100
-
-    // Number of channels (aka locations) to play sounds from. Either 1 or 2.
-    // 1 is mono sound, and 2 is stereo (most speakers are stereo). 
-    op.ChannelCount = 2
+	record_duration := 10.0 // we record for 10s
 
-    // Format of the source. go-mp3's format is signed 16bit integers.
-    op.Format = oto.FormatSignedInt16LE
+	// Read the mp3 file into memory
+	fileBytes, err := os.ReadFile("./mu.mp3")
+	if err != nil {
+		panic("reading my-file.mp3 failed: " + err.Error())
+	}
 
-    // Remember that you should **not** create more than one context
-    otoCtx, readyChan, err := oto.NewContext(op)
-    if err != nil {
-        panic("oto.NewContext failed: " + err.Error())
-    }
-    // It might take a bit for the hardware audio devices to be ready, so we wait on the channel.
-    <-readyChan
+	// Convert the pure bytes into a reader object that can be used with the mp3 decoder
+	fileBytesReader := bytes.NewReader(fileBytes)
 
-    // Create a new 'player' that will handle our sound. Paused by default.
-    player := otoCtx.NewPlayer(decodedMp3)
-    
+	// Decode file
+	decodedMp3, err := mp3.NewDecoder(fileBytesReader)
+	if err != nil {
+		panic("mp3.NewDecoder failed: " + err.Error())
+	}
 
-  fmt.Printf("Press any key to start recording for %f secs", record_duration)
-  bufio.NewReader(os.Stdin).ReadBytes('\n') 
+	// go-mp3's format is signed 16bit stereo, our sinks take float32 mono
+	pcm, err := io.ReadAll(decodedMp3)
+	chk(err)
+	music := make([]float32, len(pcm)/4)
+	for i := range music {
+		left := int16(binary.LittleEndian.Uint16(pcm[4*i:]))
+		right := int16(binary.LittleEndian.Uint16(pcm[4*i+2:]))
+		music[i] = (float32(left) + float32(right)) / 2 / (1 << 15)
+	}
 
-    // Play starts playing the sound and returns without waiting for it (Play() is async).
-    player.Play()
+	sample_rate := float64(*rate) // this is the frame one sec of input
+	cfg := audio.Config{SampleRate: int(sample_rate)}
+	// the music and the playback go out of the same speakers
+	input_cfg, output_cfg, music_cfg := cfg, cfg, cfg
+	input_cfg.Device, err = devices.Input(*input)
+	chk(err)
+	output_cfg.Device, err = devices.Output(*output)
+	chk(err)
+	music_cfg.Device, err = devices.Output(*music_output)
+	chk(err)
+
+	// Usually 44100 or 48000. Other values might cause distortions
+	player, err := audio.OpenSink(*music_output, music_cfg)
+	if err != nil {
+		panic("opening music output failed: " + err.Error())
+	}
 
+	input_stream, err := audio.OpenSource(*input, input_cfg)
+	chk(err)
+	defer input_stream.Close()
 
-  sample_rate := 44100.0 // this is the frame one sec for a 44100 hz sampled input
-  frame_per_buf := int(math.Round(sample_rate * record_duration))+1
-  recorded := make([]int32, frame_per_buf)
+	fmt.Printf("Press any key to start recording for %f secs", record_duration)
+	bufio.NewReader(os.Stdin).ReadBytes('\n')
 
-  input_stream, err := portaudio.OpenDefaultStream(1, 0, sample_rate, frame_per_buf, recorded)
-  chk(err)
-  defer input_stream.Close()
+	// Write blocks while the sink's queue is full, so play from a goroutine
+	go player.Write(music)
 
-  chk(input_stream.Start())
-  chk(input_stream.Read())
-  chk(input_stream.Stop())
+	frame_per_buf := int(math.Round(sample_rate*record_duration)) + 1
+	recorded := record(input_stream, frame_per_buf)
 
-  err = player.Close()
-  if err != nil {
-      panic("player.Close failed: " + err.Error())
-  }
-  fmt.Printf("Finish recording, press any key to play back")
-  bufio.NewReader(os.Stdin).ReadBytes('\n') 
+	err = player.Close()
+	if err != nil {
+		panic("player.Close failed: " + err.Error())
+	}
+	fmt.Printf("Finish recording, press any key to play back")
+	bufio.NewReader(os.Stdin).ReadBytes('\n')
 
-  output_stream, err := portaudio.OpenDefaultStream(0, 1, sample_rate, frame_per_buf, &recorded)
-  chk(err)
-  defer output_stream.Close()
+	output_stream, err := audio.OpenSink(*output, output_cfg)
+	chk(err)
+	defer output_stream.Close()
 
-  chk(output_stream.Start())
-  defer output_stream.Stop()
+	chk(output_stream.Write(recorded))
+	chk(output_stream.Drain())
 
-  output_stream.Write()
-  time.Sleep(time.Duration(record_duration) * time.Second)
+	fmt.Printf("Done playing audio, quiting")
+}
 
-  fmt.Printf("Done playing audio, quiting")
+// collects frames samples, or whatever the source has if it runs dry first
+func record(source audio.AudioSource, frames int) []float32 {
+	recorded := make([]float32, 0, frames)
+	full := make(chan struct{})
+	var once sync.Once
+	done := func() { once.Do(func() { close(full) }) }
+	chk(source.Start(func(samples []float32) {
+		if len(recorded) == frames {
+			return
+		}
+		recorded = append(recorded, samples[:min(len(samples), frames-len(recorded))]...)
+		if len(recorded) == frames {
+			done()
+		}
+	}))
+	go func() {
+		source.Wait()
+		done()
+	}()
+	<-full
+	return recorded
 }
 
 func chk(err error) {
@@ -109,4 +132,3 @@ func chk(err error) {
 		panic(err)
 	}
 }
-
@@ -0,0 +1,258 @@
+// Package audio hides which sound library a tool talks to. Everything is mono
+// float32 samples at the configured rate; a backend is picked at run time with
+// a spec of the form "name" or "name:arg", e.g. "malgo", "wav:capture.wav" or
+// "loopback".
+//
+// A device running at another rate than the tool (many USB interfaces only do
+// 48 kHz) is bridged with a Resampler, see Config.DeviceRate.
+//
+// Backends that talk to sound cards can list them (Devices) and open a chosen
+// one through Config.Device. Tools get the matching flags from AddDeviceFlags.
+//
+// The sound card backends are cgo. malgo brings its own miniaudio and is built
+// in by default, the tools play and capture with it unless told otherwise. oto
+// and portaudio need their system libraries (alsa, portaudio) at build time, so
+// they're only built in with -tags devices. no_oto, no_portaudio or no_malgo
+// leave one of them out again; wav, loopback and null are always there.
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AudioSink plays samples.
+type AudioSink interface {
+	// Write blocks until the samples have been queued for playback.
+	Write(samples []float32) error
+	// Drain blocks until everything written so far has been played.
+	Drain() error
+	Close() error
+}
+
+// LatencySink is a sink that knows how long its device holds on to samples
+// after Drain is back, until they come out of the speaker.
+type LatencySink interface {
+	AudioSink
+	OutputLatency() time.Duration
+}
+
+// OutputLatency is what the sink reports as its output latency, 0 for sinks
+// that don't.
+func OutputLatency(s AudioSink) time.Duration {
+	if l, ok := s.(LatencySink); ok {
+		return l.OutputLatency()
+	}
+	return 0
+}
+
+// AudioSource captures samples and hands them to a callback in whatever
+// chunks the device produces. The callback runs on the backend's goroutine.
+type AudioSource interface {
+	Start(on_samples func(samples []float32)) error
+	// Wait blocks until the source runs dry (end of a file) or is closed.
+	Wait() error
+	Close() error
+}
+
+type Config struct {
+	// rate of the samples the tool reads and writes
+	SampleRate int
+	// rate the sound card or file runs at when it differs, the stream is
+	// resampled in between. 0 means SampleRate.
+	DeviceRate int
+	// frames per callback for backends that let us choose
+	ChunkFrames int
+	// the part of the spec after the colon, e.g. the path of a wav file
+	Arg string
+	// sound card to use, a name or a unique part of it as in Devices, "" for
+	// the system default
+	Device string
+}
+
+var ErrUnsupported = errors.New("not supported by this backend")
+
+type Backend struct {
+	Name       string
+	OpenSink   func(cfg Config) (AudioSink, error)
+	OpenSource func(cfg Config) (AudioSource, error)
+	// nil for backends without devices to choose from
+	ListDevices func() ([]Device, error)
+}
+
+var backends = map[string]Backend{}
+
+func Register(b Backend) {
+	backends[b.Name] = b
+}
+
+func Backends() []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backends only built in with -tags devices, see the package doc
+var device_backends = []string{"oto", "portaudio"}
+
+// BackendsUsage lists the backends for a flag's help, and which others a
+// build with -tags devices would have.
+func BackendsUsage() string {
+	out := strings.Join(Backends(), ", ")
+	missing := []string{}
+	for _, name := range device_backends {
+		if _, ok := backends[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		out += " (" + strings.Join(missing, " and ") + " with -tags devices)"
+	}
+	return out
+}
+
+func lookup(spec string, cfg Config) (Backend, Config, error) {
+	name, arg, _ := strings.Cut(spec, ":")
+	b, ok := backends[name]
+	if !ok && slices.Contains(device_backends, name) {
+		return Backend{}, cfg, fmt.Errorf("audio backend %q isn't built in, build with -tags devices", name)
+	}
+	if !ok {
+		return Backend{}, cfg, fmt.Errorf("unknown audio backend %q, have %s", name, strings.Join(Backends(), ", "))
+	}
+	if cfg.ChunkFrames <= 0 {
+		cfg.ChunkFrames = 512
+	}
+	cfg.Arg = arg
+	return b, cfg, nil
+}
+
+func OpenSink(spec string, cfg Config) (AudioSink, error) {
+	b, cfg, err := lookup(spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if b.OpenSink == nil {
+		return nil, fmt.Errorf("%s: playback %w", b.Name, ErrUnsupported)
+	}
+	if cfg.Device != "" && b.ListDevices == nil {
+		return nil, fmt.Errorf("%s: device selection %w", b.Name, ErrUnsupported)
+	}
+	if cfg.DeviceRate <= 0 || cfg.DeviceRate == cfg.SampleRate {
+		return b.OpenSink(cfg)
+	}
+	device_cfg := cfg
+	device_cfg.SampleRate = cfg.DeviceRate
+	sink, err := b.OpenSink(device_cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &resampling_sink{AudioSink: sink, r: NewResampler(cfg.SampleRate, cfg.DeviceRate)}, nil
+}
+
+func OpenSource(spec string, cfg Config) (AudioSource, error) {
+	b, cfg, err := lookup(spec, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if b.OpenSource == nil {
+		return nil, fmt.Errorf("%s: capture %w", b.Name, ErrUnsupported)
+	}
+	if cfg.Device != "" && b.ListDevices == nil {
+		return nil, fmt.Errorf("%s: device selection %w", b.Name, ErrUnsupported)
+	}
+	if cfg.DeviceRate <= 0 || cfg.DeviceRate == cfg.SampleRate {
+		return b.OpenSource(cfg)
+	}
+	device_cfg := cfg
+	device_cfg.SampleRate = cfg.DeviceRate
+	source, err := b.OpenSource(device_cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &resampling_source{AudioSource: source, r: NewResampler(cfg.DeviceRate, cfg.SampleRate)}, nil
+}
+
+// sample_queue sits between Write and a device callback that pulls samples.
+// When nothing is queued the device gets silence, so playback never stalls.
+type sample_queue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	samples []float32
+	limit   int
+	closed  bool
+}
+
+func new_sample_queue(limit int) *sample_queue {
+	q := &sample_queue{limit: limit}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *sample_queue) push(samples []float32) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(samples) > 0 {
+		for len(q.samples) >= q.limit && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return errors.New("audio sink closed")
+		}
+		n := min(len(samples), q.limit-len(q.samples))
+		q.samples = append(q.samples, samples[:n]...)
+		samples = samples[n:]
+	}
+	return nil
+}
+
+// pull fills out with queued samples, padding with silence
+func (q *sample_queue) pull(out []float32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := copy(out, q.samples)
+	clear(out[n:])
+	q.samples = q.samples[n:]
+	q.cond.Broadcast()
+}
+
+func (q *sample_queue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.samples) > 0 && !q.closed {
+		q.cond.Wait()
+	}
+}
+
+func (q *sample_queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// closer makes Wait of live sources block until Close.
+type closer struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func new_closer() *closer {
+	return &closer{done: make(chan struct{})}
+}
+
+func (c *closer) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+func (c *closer) wait() {
+	<-c.done
+}
@@ -0,0 +1,46 @@
+package audio
+
+import "sync"
+
+// BufferSource replays samples already in memory as fast as the callback takes
+// them, then Wait returns. The wav backend uses it for capture.
+type BufferSource struct {
+	samples []float32
+	chunk   int
+	stop    *closer
+	done    *closer
+	once    sync.Once
+}
+
+func NewBufferSource(samples []float32, chunk int) *BufferSource {
+	return &BufferSource{samples: samples, chunk: max(chunk, 1), stop: new_closer(), done: new_closer()}
+}
+
+func (s *BufferSource) Start(on_samples func(samples []float32)) error {
+	s.once.Do(func() {
+		go func() {
+			defer s.done.close()
+			for i := 0; i < len(s.samples); i += s.chunk {
+				select {
+				case <-s.stop.done:
+					return
+				default:
+				}
+				on_samples(s.samples[i:min(i+s.chunk, len(s.samples))])
+			}
+		}()
+	})
+	return nil
+}
+
+func (s *BufferSource) Wait() error {
+	s.done.wait()
+	return nil
+}
+
+func (s *BufferSource) Close() error {
+	s.stop.close()
+	// never started, nothing will close done for us
+	s.once.Do(s.done.close)
+	return nil
+}
@@ -0,0 +1,270 @@
+package audio
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Device is one endpoint of a sound card as a backend sees it.
+type Device struct {
+	Backend string
+	Name    string
+	Input   bool
+	Output  bool
+	Default bool
+}
+
+// Devices asks every backend that can enumerate for its devices. A backend that
+// fails (no sound server running, say) doesn't hide the others, its error is
+// joined into the returned one.
+func Devices() ([]Device, error) {
+	devices := []Device{}
+	errs := []error{}
+	for _, name := range Backends() {
+		b := backends[name]
+		if b.ListDevices == nil {
+			continue
+		}
+		list, err := b.ListDevices()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		devices = append(devices, list...)
+	}
+	return devices, errors.Join(errs...)
+}
+
+func PrintDevices(w io.Writer) error {
+	devices, err := Devices()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "backend\tdirection\tdefault\tname")
+	for _, d := range devices {
+		direction := []string{}
+		if d.Input {
+			direction = append(direction, "in")
+		}
+		if d.Output {
+			direction = append(direction, "out")
+		}
+		is_default := ""
+		if d.Default {
+			is_default = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Backend, strings.Join(direction, "/"), is_default, d.Name)
+	}
+	tw.Flush()
+	return err
+}
+
+// pick_device finds which of names the user meant by want: the exact name, or
+// failing that the only one containing want, ignoring case. -1 means the
+// system default.
+func pick_device(want string, names []string) (int, error) {
+	if want == "" {
+		return -1, nil
+	}
+	for i, name := range names {
+		if name == want {
+			return i, nil
+		}
+	}
+	found := []int{}
+	for i, name := range names {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(want)) {
+			found = append(found, i)
+		}
+	}
+	switch len(found) {
+	case 1:
+		return found[0], nil
+	case 0:
+		return -1, fmt.Errorf("no audio device matches %q, see -list-devices", want)
+	}
+	candidates := []string{}
+	for _, i := range found {
+		candidates = append(candidates, names[i])
+	}
+	return -1, fmt.Errorf("audio device %q is ambiguous: %s", want, strings.Join(candidates, ", "))
+}
+
+// device choices are remembered per host and backend, so moving the config
+// directory between machines doesn't point a tool at somebody else's cable
+type device_choice struct {
+	Input  string `json:"input,omitempty"`
+	Output string `json:"output,omitempty"`
+}
+
+func device_memory_path() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cs120", "devices.json"), nil
+}
+
+func load_device_memory() (map[string]map[string]device_choice, error) {
+	memory := map[string]map[string]device_choice{}
+	path, err := device_memory_path()
+	if err != nil {
+		return memory, err
+	}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return memory, nil
+	}
+	if err != nil {
+		return memory, err
+	}
+	return memory, json.Unmarshal(content, &memory)
+}
+
+// RememberedDevice is what RememberDevice last stored on this host, or "".
+func RememberedDevice(backend string, input bool) string {
+	memory, _ := load_device_memory()
+	host, _ := os.Hostname()
+	choice := memory[host][backend]
+	if input {
+		return choice.Input
+	}
+	return choice.Output
+}
+
+// RememberDevice stores the device for backend on this host, "" forgets it.
+func RememberDevice(backend string, input bool, device string) error {
+	memory, err := load_device_memory()
+	if err != nil {
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	if memory[host] == nil {
+		memory[host] = map[string]device_choice{}
+	}
+	choice := memory[host][backend]
+	if input {
+		choice.Input = device
+	} else {
+		choice.Output = device
+	}
+	memory[host][backend] = choice
+
+	path, err := device_memory_path()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(memory, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0o644)
+}
+
+// DeviceFlags adds -list-devices, -input-device and -output-device to a tool.
+// A device given on the command line is remembered for its backend on this
+// host and used from then on when the flag is left out; "default" goes back to
+// the system default.
+type DeviceFlags struct {
+	list   *bool
+	input  *device_flag
+	output *device_flag
+}
+
+type device_flag struct {
+	value string
+	set   bool
+}
+
+func (f *device_flag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *device_flag) Set(value string) error {
+	f.value, f.set = value, true
+	return nil
+}
+
+// AddDeviceFlags registers the flags on fs, only the directions the tool uses.
+func AddDeviceFlags(fs *flag.FlagSet, input bool, output bool) *DeviceFlags {
+	d := &DeviceFlags{list: fs.Bool("list-devices", false, "list the audio devices of every backend and exit")}
+	if input {
+		d.input = &device_flag{}
+		fs.Var(d.input, "input-device", "capture device, a name or a unique part of it, remembered per host (\"default\" resets)")
+	}
+	if output {
+		d.output = &device_flag{}
+		fs.Var(d.output, "output-device", "playback device, a name or a unique part of it, remembered per host (\"default\" resets)")
+	}
+	return d
+}
+
+// Listed prints the devices to w if -list-devices was given, the tool should
+// exit when it returns true.
+func (d *DeviceFlags) Listed(w io.Writer) bool {
+	if !*d.list {
+		return false
+	}
+	if err := PrintDevices(w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return true
+}
+
+// Input is the capture device to put in the Config for spec.
+func (d *DeviceFlags) Input(spec string) (string, error) {
+	return resolve_device(d.input, spec, true)
+}
+
+// Output is the playback device to put in the Config for spec.
+func (d *DeviceFlags) Output(spec string) (string, error) {
+	return resolve_device(d.output, spec, false)
+}
+
+func resolve_device(f *device_flag, spec string, input bool) (string, error) {
+	name, _, _ := strings.Cut(spec, ":")
+	if b, ok := backends[name]; !ok || b.ListDevices == nil {
+		// files and loopbacks have no devices to pick
+		if f != nil && f.set && f.value != "default" {
+			return "", fmt.Errorf("%s: device selection %w", name, ErrUnsupported)
+		}
+		return "", nil
+	}
+	if f == nil || !f.set {
+		return RememberedDevice(name, input), nil
+	}
+	device := ""
+	if f.value != "default" {
+		// check it exists and store the full name, not the part that was typed
+		devices, err := backends[name].ListDevices()
+		if err != nil {
+			return "", err
+		}
+		names := []string{}
+		for _, d := range devices {
+			if (input && d.Input) || (!input && d.Output) {
+				names = append(names, d.Name)
+			}
+		}
+		i, err := pick_device(f.value, names)
+		if err != nil {
+			return "", err
+		}
+		device = names[i]
+	}
+	return device, RememberDevice(name, input, device)
+}
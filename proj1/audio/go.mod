@@ -0,0 +1,14 @@
+module audio
+
+go 1.21.3
+
+require (
+	github.com/ebitengine/oto/v3 v3.1.0
+	github.com/gen2brain/malgo v0.11.10
+	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5
+)
+
+require (
+	github.com/ebitengine/purego v0.5.0 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
@@ -0,0 +1,114 @@
+package audio
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Loopback is an in-memory cable: whatever is written to it as a sink comes out
+// of it as a source, chopped into ChunkFrames sized callbacks like a device
+// would hand them out. "loopback" and "loopback:name" give the same instance to
+// every OpenSink/OpenSource in the process, so a sender and a receiver in one
+// binary can talk to each other. Every source started on it hears everything
+// written to it, like every microphone in a room, the writer's own included,
+// so several nodes can share one as the air.
+//
+// By default samples are delivered as fast as the receiver takes them,
+// "loopback:name,realtime" paces every chunk to the sample rate instead.
+type Loopback struct {
+	mu         sync.Mutex
+	chunk      int
+	rate       int
+	realtime   bool
+	next       time.Time
+	on_samples []func(samples []float32)
+	closed     *closer
+}
+
+var loopbacks = map[string]*Loopback{}
+var loopbacks_mu sync.Mutex
+
+func init() {
+	open := func(cfg Config) *Loopback {
+		name, options, _ := strings.Cut(cfg.Arg, ",")
+		loopbacks_mu.Lock()
+		defer loopbacks_mu.Unlock()
+		l, ok := loopbacks[name]
+		if !ok {
+			l = NewLoopback(cfg.ChunkFrames, cfg.SampleRate)
+			loopbacks[name] = l
+		}
+		for _, option := range strings.Split(options, ",") {
+			if option == "realtime" {
+				l.SetRealtime(true)
+			}
+		}
+		return l
+	}
+	Register(Backend{
+		Name:       "loopback",
+		OpenSink:   func(cfg Config) (AudioSink, error) { return open(cfg), nil },
+		OpenSource: func(cfg Config) (AudioSource, error) { return open(cfg), nil },
+	})
+}
+
+func NewLoopback(chunk int, sample_rate int) *Loopback {
+	return &Loopback{chunk: max(chunk, 1), rate: sample_rate, closed: new_closer()}
+}
+
+// SetRealtime makes Write take as long as playing the samples would.
+func (l *Loopback) SetRealtime(realtime bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.realtime = realtime && l.rate > 0
+}
+
+func (l *Loopback) Start(on_samples func(samples []float32)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.on_samples = append(l.on_samples, on_samples)
+	return nil
+}
+
+// Write delivers the samples before returning. Nobody listening means they're lost,
+// just like sound in an empty room.
+func (l *Loopback) Write(samples []float32) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	chunk_duration := time.Duration(0)
+	if l.realtime {
+		chunk_duration = time.Duration(float64(l.chunk) / float64(l.rate) * float64(time.Second))
+		// after a pause we start from now rather than catching up
+		if now := time.Now(); l.next.Before(now) {
+			l.next = now
+		}
+	}
+	for i := 0; i < len(samples); i += l.chunk {
+		if l.realtime {
+			l.next = l.next.Add(chunk_duration)
+			time.Sleep(time.Until(l.next))
+		}
+		for _, on_samples := range l.on_samples {
+			// every listener gets its own copy to filter in place
+			chunk := make([]float32, min(l.chunk, len(samples)-i))
+			copy(chunk, samples[i:])
+			on_samples(chunk)
+		}
+	}
+	return nil
+}
+
+func (l *Loopback) Drain() error {
+	return nil
+}
+
+func (l *Loopback) Wait() error {
+	l.closed.wait()
+	return nil
+}
+
+func (l *Loopback) Close() error {
+	l.closed.close()
+	return nil
+}
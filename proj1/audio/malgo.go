@@ -0,0 +1,223 @@
+//go:build cgo && !no_malgo
+
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gen2brain/malgo"
+)
+
+func init() {
+	Register(Backend{
+		Name:        "malgo",
+		OpenSink:    open_malgo_sink,
+		OpenSource:  open_malgo_source,
+		ListDevices: list_malgo_devices,
+	})
+}
+
+var malgo_ctx *malgo.AllocatedContext
+var malgo_ctx_once sync.Once
+var malgo_ctx_err error
+
+// one miniaudio context per process, shared by every device
+func malgo_context() (*malgo.AllocatedContext, error) {
+	malgo_ctx_once.Do(func() {
+		malgo_ctx, malgo_ctx_err = malgo.InitContext(nil, malgo.ContextConfig{}, func(message string) {
+			// fmt.Printf("LOG <%v>\n", message)
+		})
+	})
+	return malgo_ctx, malgo_ctx_err
+}
+
+func list_malgo_devices() ([]Device, error) {
+	ctx, err := malgo_context()
+	if err != nil {
+		return nil, err
+	}
+	devices := []Device{}
+	for _, kind := range []malgo.DeviceType{malgo.Capture, malgo.Playback} {
+		infos, err := ctx.Devices(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			devices = append(devices, Device{
+				Backend: "malgo",
+				Name:    info.Name(),
+				Input:   kind == malgo.Capture,
+				Output:  kind == malgo.Playback,
+				Default: info.IsDefault != 0,
+			})
+		}
+	}
+	return devices, nil
+}
+
+// malgo_device_id looks the device up by name, nil picks the default. The
+// config only holds a pointer to the id so it has to outlive the device.
+func malgo_device_id(kind malgo.DeviceType, want string) (*malgo.DeviceID, error) {
+	ctx, err := malgo_context()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ctx.Devices(kind)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	i, err := pick_device(want, names)
+	if err != nil || i < 0 {
+		return nil, err
+	}
+	id := infos[i].ID
+	return &id, nil
+}
+
+// periods of the playback buffer, miniaudio's default made explicit so the
+// latency can be worked out from the period the callbacks ask for
+const malgo_periods = 3
+
+type malgo_sink struct {
+	device *malgo.Device
+	queue  *sample_queue
+	id     *malgo.DeviceID
+	rate   int
+	// frames the last callback asked for, a period
+	period atomic.Int64
+}
+
+func open_malgo_sink(cfg Config) (AudioSink, error) {
+	ctx, err := malgo_context()
+	if err != nil {
+		return nil, err
+	}
+	deviceConfig := malgo.DefaultDeviceConfig(malgo.Playback)
+	deviceConfig.Playback.Format = malgo.FormatF32
+	deviceConfig.Playback.Channels = 1
+	deviceConfig.SampleRate = uint32(cfg.SampleRate)
+	deviceConfig.Periods = malgo_periods
+	deviceConfig.Alsa.NoMMap = 1
+	id, err := malgo_device_id(malgo.Playback, cfg.Device)
+	if err != nil {
+		return nil, err
+	}
+	if id != nil {
+		deviceConfig.Playback.DeviceID = id.Pointer()
+	}
+
+	s := &malgo_sink{queue: new_sample_queue(cfg.SampleRate), id: id, rate: cfg.SampleRate}
+	buf := []float32{}
+	onSendFrames := func(pOutputSample, pInputSamples []byte, framecount uint32) {
+		if cap(buf) < int(framecount) {
+			buf = make([]float32, framecount)
+		}
+		buf = buf[:framecount]
+		s.period.Store(int64(framecount))
+		s.queue.pull(buf)
+		for i, f := range buf {
+			binary.LittleEndian.PutUint32(pOutputSample[4*i:], math.Float32bits(f))
+		}
+	}
+	s.device, err = malgo.InitDevice(ctx.Context, deviceConfig, malgo.DeviceCallbacks{Data: onSendFrames})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.device.Start(); err != nil {
+		s.device.Uninit()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *malgo_sink) Write(samples []float32) error {
+	return s.queue.push(samples)
+}
+
+func (s *malgo_sink) Drain() error {
+	s.queue.drain()
+	return nil
+}
+
+// OutputLatency is the playback buffer, the last samples pulled can be as far
+// back as that from the speaker
+func (s *malgo_sink) OutputLatency() time.Duration {
+	return time.Duration(s.period.Load()*malgo_periods) * time.Second / time.Duration(s.rate)
+}
+
+func (s *malgo_sink) Close() error {
+	s.queue.close()
+	s.device.Uninit()
+	return nil
+}
+
+type malgo_source struct {
+	device_config malgo.DeviceConfig
+	device        *malgo.Device
+	id            *malgo.DeviceID
+	closed        *closer
+}
+
+func open_malgo_source(cfg Config) (AudioSource, error) {
+	if _, err := malgo_context(); err != nil {
+		return nil, err
+	}
+	// duplex so the same device can talk back later
+	deviceConfig := malgo.DefaultDeviceConfig(malgo.Duplex)
+	deviceConfig.Capture.Format = malgo.FormatF32
+	deviceConfig.Capture.Channels = 1
+	deviceConfig.SampleRate = uint32(cfg.SampleRate)
+	deviceConfig.Alsa.NoMMap = 1
+	id, err := malgo_device_id(malgo.Capture, cfg.Device)
+	if err != nil {
+		return nil, err
+	}
+	if id != nil {
+		deviceConfig.Capture.DeviceID = id.Pointer()
+	}
+	return &malgo_source{device_config: deviceConfig, id: id, closed: new_closer()}, nil
+}
+
+func (s *malgo_source) Start(on_samples func(samples []float32)) error {
+	ctx, err := malgo_context()
+	if err != nil {
+		return err
+	}
+	data_width := int(malgo.SampleSizeInBytes(s.device_config.Capture.Format))
+	onRecvFrames := func(pSample2, pSample []byte, framecount uint32) {
+		if len(pSample)%data_width != 0 {
+			panic("weird input: sample bytes length not multiple of data width")
+		}
+		samples := make([]float32, len(pSample)/data_width)
+		for i := range samples {
+			samples[i] = math.Float32frombits(binary.LittleEndian.Uint32(pSample[i*data_width:]))
+		}
+		on_samples(samples)
+	}
+	s.device, err = malgo.InitDevice(ctx.Context, s.device_config, malgo.DeviceCallbacks{Data: onRecvFrames})
+	if err != nil {
+		return err
+	}
+	return s.device.Start()
+}
+
+func (s *malgo_source) Wait() error {
+	s.closed.wait()
+	return nil
+}
+
+func (s *malgo_source) Close() error {
+	if s.device != nil {
+		s.device.Uninit()
+	}
+	s.closed.close()
+	return nil
+}
@@ -0,0 +1,98 @@
+//go:build devices && !no_oto
+
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ebitengine/oto/v3"
+)
+
+// oto can only play, and only one context may exist per process.
+func init() {
+	Register(Backend{
+		Name:     "oto",
+		OpenSink: open_oto_sink,
+	})
+}
+
+var oto_ctx *oto.Context
+var oto_ctx_rate int
+var oto_ctx_mu sync.Mutex
+
+func oto_context(sample_rate int) (*oto.Context, error) {
+	oto_ctx_mu.Lock()
+	defer oto_ctx_mu.Unlock()
+	if oto_ctx != nil {
+		if oto_ctx_rate != sample_rate {
+			return nil, fmt.Errorf("oto context already runs at %d Hz", oto_ctx_rate)
+		}
+		return oto_ctx, nil
+	}
+	opts := &oto.NewContextOptions{}
+
+	opts.SampleRate = sample_rate
+	opts.ChannelCount = 1
+
+	opts.Format = oto.FormatFloat32LE
+
+	c, ready, err := oto.NewContext(opts)
+	if err != nil {
+		return nil, err
+	}
+	<-ready
+	oto_ctx, oto_ctx_rate = c, sample_rate
+	return c, nil
+}
+
+type oto_sink struct {
+	player *oto.Player
+	queue  *sample_queue
+	rate   int
+}
+
+func open_oto_sink(cfg Config) (AudioSink, error) {
+	c, err := oto_context(cfg.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	s := &oto_sink{queue: new_sample_queue(cfg.SampleRate), rate: cfg.SampleRate}
+	s.player = c.NewPlayer(oto_stream{s.queue})
+	s.player.Play()
+	return s, nil
+}
+
+func (s *oto_sink) Write(samples []float32) error {
+	return s.queue.push(samples)
+}
+
+// the player keeps its own buffer after pulling from the queue
+func (s *oto_sink) Drain() error {
+	s.queue.drain()
+	buffered := s.player.BufferedSize() / 4
+	time.Sleep(time.Duration(float64(buffered) / float64(s.rate) * float64(time.Second)))
+	return nil
+}
+
+func (s *oto_sink) Close() error {
+	s.queue.close()
+	return s.player.Close()
+}
+
+// oto pulls float32 little endian bytes from an io.Reader
+type oto_stream struct {
+	queue *sample_queue
+}
+
+func (o oto_stream) Read(buf []byte) (int, error) {
+	samples := make([]float32, len(buf)/4)
+	o.queue.pull(samples)
+	for i, f := range samples {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return len(samples) * 4, nil
+}
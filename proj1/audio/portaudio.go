@@ -0,0 +1,208 @@
+//go:build devices && !no_portaudio
+
+package audio
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+func init() {
+	Register(Backend{
+		Name:        "portaudio",
+		OpenSink:    open_portaudio_sink,
+		OpenSource:  open_portaudio_source,
+		ListDevices: list_portaudio_devices,
+	})
+}
+
+// portaudio wants Initialize/Terminate around every use, count the open streams
+var portaudio_users int
+var portaudio_mu sync.Mutex
+
+func portaudio_acquire() error {
+	portaudio_mu.Lock()
+	defer portaudio_mu.Unlock()
+	if portaudio_users == 0 {
+		if err := portaudio.Initialize(); err != nil {
+			return err
+		}
+	}
+	portaudio_users++
+	return nil
+}
+
+func portaudio_release() error {
+	portaudio_mu.Lock()
+	defer portaudio_mu.Unlock()
+	portaudio_users--
+	if portaudio_users == 0 {
+		return portaudio.Terminate()
+	}
+	return nil
+}
+
+func list_portaudio_devices() ([]Device, error) {
+	if err := portaudio_acquire(); err != nil {
+		return nil, err
+	}
+	defer portaudio_release()
+	infos, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	default_in, _ := portaudio.DefaultInputDevice()
+	default_out, _ := portaudio.DefaultOutputDevice()
+	devices := []Device{}
+	for _, info := range infos {
+		devices = append(devices, Device{
+			Backend: "portaudio",
+			Name:    info.Name,
+			Input:   info.MaxInputChannels > 0,
+			Output:  info.MaxOutputChannels > 0,
+			Default: info == default_in || info == default_out,
+		})
+	}
+	return devices, nil
+}
+
+// portaudio_params is what OpenDefaultStream would use, on the device asked for.
+func portaudio_params(cfg Config, input bool) (portaudio.StreamParameters, error) {
+	infos, err := portaudio.Devices()
+	if err != nil {
+		return portaudio.StreamParameters{}, err
+	}
+	names := []string{}
+	candidates := []*portaudio.DeviceInfo{}
+	for _, info := range infos {
+		if (input && info.MaxInputChannels > 0) || (!input && info.MaxOutputChannels > 0) {
+			names = append(names, info.Name)
+			candidates = append(candidates, info)
+		}
+	}
+	i, err := pick_device(cfg.Device, names)
+	if err != nil {
+		return portaudio.StreamParameters{}, err
+	}
+	var device *portaudio.DeviceInfo
+	switch {
+	case i >= 0:
+		device = candidates[i]
+	case input:
+		device, err = portaudio.DefaultInputDevice()
+	default:
+		device, err = portaudio.DefaultOutputDevice()
+	}
+	if err != nil {
+		return portaudio.StreamParameters{}, err
+	}
+	var params portaudio.StreamParameters
+	if input {
+		params = portaudio.HighLatencyParameters(device, nil)
+		params.Input.Channels = 1
+	} else {
+		params = portaudio.HighLatencyParameters(nil, device)
+		params.Output.Channels = 1
+	}
+	params.SampleRate = float64(cfg.SampleRate)
+	params.FramesPerBuffer = cfg.ChunkFrames
+	return params, nil
+}
+
+type portaudio_sink struct {
+	stream *portaudio.Stream
+	queue  *sample_queue
+}
+
+func open_portaudio_sink(cfg Config) (AudioSink, error) {
+	if err := portaudio_acquire(); err != nil {
+		return nil, err
+	}
+	params, err := portaudio_params(cfg, false)
+	if err != nil {
+		portaudio_release()
+		return nil, err
+	}
+	s := &portaudio_sink{queue: new_sample_queue(cfg.SampleRate)}
+	stream, err := portaudio.OpenStream(params, func(out []float32) {
+		s.queue.pull(out)
+	})
+	if err != nil {
+		portaudio_release()
+		return nil, err
+	}
+	s.stream = stream
+	if err := stream.Start(); err != nil {
+		stream.Close()
+		portaudio_release()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *portaudio_sink) Write(samples []float32) error {
+	return s.queue.push(samples)
+}
+
+func (s *portaudio_sink) Drain() error {
+	s.queue.drain()
+	return nil
+}
+
+func (s *portaudio_sink) OutputLatency() time.Duration {
+	return s.stream.Info().OutputLatency
+}
+
+func (s *portaudio_sink) Close() error {
+	s.queue.close()
+	s.stream.Stop()
+	s.stream.Close()
+	return portaudio_release()
+}
+
+type portaudio_source struct {
+	params portaudio.StreamParameters
+	stream *portaudio.Stream
+	closed *closer
+}
+
+func open_portaudio_source(cfg Config) (AudioSource, error) {
+	if err := portaudio_acquire(); err != nil {
+		return nil, err
+	}
+	params, err := portaudio_params(cfg, true)
+	if err != nil {
+		portaudio_release()
+		return nil, err
+	}
+	return &portaudio_source{params: params, closed: new_closer()}, nil
+}
+
+func (s *portaudio_source) Start(on_samples func(samples []float32)) error {
+	stream, err := portaudio.OpenStream(s.params, func(in []float32) {
+		samples := make([]float32, len(in))
+		copy(samples, in)
+		on_samples(samples)
+	})
+	if err != nil {
+		return err
+	}
+	s.stream = stream
+	return stream.Start()
+}
+
+func (s *portaudio_source) Wait() error {
+	s.closed.wait()
+	return nil
+}
+
+func (s *portaudio_source) Close() error {
+	if s.stream != nil {
+		s.stream.Stop()
+		s.stream.Close()
+	}
+	s.closed.close()
+	return portaudio_release()
+}
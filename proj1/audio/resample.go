@@ -0,0 +1,180 @@
+package audio
+
+import (
+	"math"
+	"time"
+)
+
+// Resampler converts a stream between two sample rates with a polyphase
+// windowed-sinc filter. The rates are reduced to up/down, every output sample
+// sits at input position n*down/up and is interpolated from resample_taps input
+// samples around it. The pass band ends at resample_passband of the lower
+// Nyquist frequency, which keeps everything the modem uses (below 20 kHz at
+// 44.1k or 48k) and leaves the stop band around 80 dB down.
+type Resampler struct {
+	from, to int
+	up, down int
+	// filter[phase][j] weighs the input sample j before the current one
+	filter [][]float32
+	// the last resample_taps-1 inputs followed by the new ones
+	history []float32
+	// position of the next output past the oldest sample in history, in 1/up
+	// input samples
+	pos int
+}
+
+const resample_taps = 96
+const resample_passband = 0.9
+const resample_kaiser_beta = 8.6
+
+func NewResampler(from int, to int) *Resampler {
+	g := gcd(from, to)
+	r := &Resampler{from: from, to: to, up: to / g, down: from / g}
+	r.filter = resample_filter(r.up, r.down)
+	r.history = make([]float32, resample_taps-1)
+	// the filter is centered on coefficient center, so waiting for that many
+	// more upsampled inputs puts output n exactly at input n*down/up
+	r.pos = (resample_taps-1)*r.up + resample_center(r.up)
+	return r
+}
+
+func resample_center(up int) int {
+	return resample_taps*up/2 - 1
+}
+
+// Process takes the next chunk of input and returns every output sample that
+// can be computed from what has come in so far, which lags the input by about
+// resample_taps/2 samples.
+func (r *Resampler) Process(samples []float32) []float32 {
+	if r.up == r.down {
+		return append([]float32{}, samples...)
+	}
+	r.history = append(r.history, samples...)
+	out := make([]float32, 0, len(samples)*r.up/r.down+1)
+	for {
+		i, phase := r.pos/r.up, r.pos%r.up
+		if i >= len(r.history) {
+			break
+		}
+		coefs := r.filter[phase]
+		acc := float32(0)
+		for j, c := range coefs {
+			acc += c * r.history[i-j]
+		}
+		out = append(out, acc)
+		r.pos += r.down
+	}
+	// keep what the next output still reaches back to
+	drop := r.pos/r.up - (resample_taps - 1)
+	if drop > 0 {
+		r.history = append(r.history[:0], r.history[drop:]...)
+		r.pos -= drop * r.up
+	}
+	return out
+}
+
+// Resample converts a whole signal at once, lined up with the input and
+// exactly len(samples)*to/from long.
+func Resample(samples []float32, from int, to int) []float32 {
+	if from == to {
+		return samples
+	}
+	r := NewResampler(from, to)
+	out := r.Process(samples)
+	out = append(out, r.Process(make([]float32, resample_taps))...)
+	length := int(int64(len(samples)) * int64(to) / int64(from))
+	return out[:length]
+}
+
+// resample_filter designs the low pass filter at the rate of the upsampled
+// signal and splits it into up phases
+func resample_filter(up int, down int) [][]float32 {
+	// odd length so the center falls on a coefficient, the last one stays 0
+	n := resample_taps*up - 1
+	// cycles per upsampled sample
+	cutoff := resample_passband * 0.5 / float64(max(up, down))
+	center := float64(resample_center(up))
+	prototype := make([]float64, resample_taps*up)
+	sum := 0.0
+	for k := range prototype[:n] {
+		t := float64(k) - center
+		sinc := 2 * cutoff
+		if t != 0 {
+			sinc = math.Sin(2*math.Pi*cutoff*t) / (math.Pi * t)
+		}
+		prototype[k] = sinc * kaiser(t/center, resample_kaiser_beta)
+		sum += prototype[k]
+	}
+	filter := make([][]float32, up)
+	for phase := range filter {
+		filter[phase] = make([]float32, resample_taps)
+		for j := range filter[phase] {
+			// every phase picks every up-th coefficient, scaled so a constant
+			// input comes out at the same level
+			filter[phase][j] = float32(prototype[phase+j*up] * float64(up) / sum)
+		}
+	}
+	return filter
+}
+
+// Kaiser window at x in [-1, 1]
+func kaiser(x float64, beta float64) float64 {
+	if x < -1 || x > 1 {
+		return 0
+	}
+	return bessel_i0(beta*math.Sqrt(1-x*x)) / bessel_i0(beta)
+}
+
+// modified Bessel function of the first kind, order 0, by its power series
+func bessel_i0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / 2) * (x / 2) / float64(k*k)
+		sum += term
+	}
+	return sum
+}
+
+func gcd(a int, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// resampling_sink plays at the device rate what's written at the stream rate
+type resampling_sink struct {
+	AudioSink
+	r *Resampler
+}
+
+func (s *resampling_sink) Write(samples []float32) error {
+	return s.AudioSink.Write(s.r.Process(samples))
+}
+
+// Drain pushes the filter's tail out first so the last samples get played too
+func (s *resampling_sink) Drain() error {
+	tail := s.r.Process(make([]float32, resample_taps))
+	if err := s.AudioSink.Write(tail); err != nil {
+		return err
+	}
+	return s.AudioSink.Drain()
+}
+
+func (s *resampling_sink) OutputLatency() time.Duration {
+	return OutputLatency(s.AudioSink)
+}
+
+// resampling_source hands out at the stream rate what the device captures
+type resampling_source struct {
+	AudioSource
+	r *Resampler
+}
+
+func (s *resampling_source) Start(on_samples func(samples []float32)) error {
+	return s.AudioSource.Start(func(samples []float32) {
+		if out := s.r.Process(samples); len(out) > 0 {
+			on_samples(out)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// The wav backend plays into and captures from files, so every tool can run
+// without a sound card: "wav:out.wav" as a sink writes 32 bit float mono, as a
+// source it reads 8/16/24/32 bit PCM or 32/64 bit float, mixes to mono and
+// resamples to the configured rate.
+
+func init() {
+	Register(Backend{
+		Name: "wav",
+		OpenSink: func(cfg Config) (AudioSink, error) {
+			return NewWavSink(cfg.Arg, cfg.SampleRate)
+		},
+		OpenSource: func(cfg Config) (AudioSource, error) {
+			samples, rate, err := ReadWav(cfg.Arg)
+			if err != nil {
+				return nil, err
+			}
+			// a recording at another rate is converted up front
+			samples = Resample(samples, rate, cfg.SampleRate)
+			return NewBufferSource(samples, cfg.ChunkFrames), nil
+		},
+	})
+}
+
+const wav_format_pcm = 1
+const wav_format_float = 3
+const wav_format_extensible = 0xFFFE
+
+type WavSink struct {
+	file   *os.File
+	w      *bufio.Writer
+	frames int
+	rate   int
+}
+
+func NewWavSink(path string, sample_rate int) (*WavSink, error) {
+	if path == "" {
+		return nil, errors.New("wav backend needs a file, e.g. wav:out.wav")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &WavSink{file: file, w: bufio.NewWriter(file), rate: sample_rate}
+	// sizes are patched in Close
+	if err := write_wav_header(s.w, sample_rate, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *WavSink) Write(samples []float32) error {
+	if err := binary.Write(s.w, binary.LittleEndian, samples); err != nil {
+		return err
+	}
+	s.frames += len(samples)
+	return nil
+}
+
+func (s *WavSink) Drain() error {
+	return s.w.Flush()
+}
+
+func (s *WavSink) Close() error {
+	if err := s.w.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		s.file.Close()
+		return err
+	}
+	if err := write_wav_header(s.file, s.rate, s.frames); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func write_wav_header(w io.Writer, sample_rate int, frames int) error {
+	data_size := uint32(frames * 4)
+	header := []any{
+		[]byte("RIFF"), uint32(36 + data_size), []byte("WAVE"),
+		[]byte("fmt "), uint32(16),
+		uint16(wav_format_float), uint16(1), uint32(sample_rate),
+		uint32(sample_rate * 4), uint16(4), uint16(32),
+		[]byte("data"), data_size,
+	}
+	for _, v := range header {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteWav(path string, samples []float32, sample_rate int) error {
+	s, err := NewWavSink(path, sample_rate)
+	if err != nil {
+		return err
+	}
+	if err := s.Write(samples); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+// ReadWav returns the samples of a wav file mixed down to mono, and its sample rate.
+func ReadWav(path string) ([]float32, int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(raw) < 12 || string(raw[0:4]) != "RIFF" || string(raw[8:12]) != "WAVE" {
+		return nil, 0, fmt.Errorf("%s: not a wav file", path)
+	}
+	var format, channels, bits int
+	var rate int
+	var data []byte
+	for pos := 12; pos+8 <= len(raw); {
+		id := string(raw[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(raw[pos+4:]))
+		body := raw[pos+8 : min(pos+8+size, len(raw))]
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, 0, fmt.Errorf("%s: short fmt chunk", path)
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:]))
+			channels = int(binary.LittleEndian.Uint16(body[2:]))
+			rate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if format == wav_format_extensible && len(body) >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:]))
+			}
+		case "data":
+			data = body
+		}
+		// chunks are padded to an even size
+		pos += 8 + size + size%2
+	}
+	if channels == 0 || data == nil {
+		return nil, 0, fmt.Errorf("%s: missing fmt or data chunk", path)
+	}
+
+	width := bits / 8
+	decode := func(b []byte) float64 { return 0 }
+	switch {
+	case format == wav_format_pcm && bits == 8:
+		decode = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == wav_format_pcm && bits == 16:
+		decode = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == wav_format_pcm && bits == 24:
+		decode = func(b []byte) float64 {
+			return float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == wav_format_pcm && bits == 32:
+		decode = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == wav_format_float && bits == 32:
+		decode = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case format == wav_format_float && bits == 64:
+		decode = func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	default:
+		return nil, 0, fmt.Errorf("%s: unsupported wav format %d with %d bits", path, format, bits)
+	}
+
+	frame_size := width * channels
+	out := make([]float32, len(data)/frame_size)
+	for i := range out {
+		sum := 0.0
+		for c := 0; c < channels; c++ {
+			sum += decode(data[i*frame_size+c*width:])
+		}
+		out[i] = float32(sum / float64(channels))
+	}
+	return out, rate, nil
+}
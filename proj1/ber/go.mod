@@ -0,0 +1,3 @@
+module ber
+
+go 1.21.1
@@ -0,0 +1,287 @@
+// Compares what the sender sent (INPUT_DUMMY.txt, INPUT.bin, ...) against what
+// the receiver wrote (received.txt, ...). The two bit streams are aligned with
+// a banded edit distance so a slipped or extra symbol shows up as a handful of
+// insertions/deletions instead of every following bit being wrong.
+//
+//	ber -sent ../sender/INPUT_DUMMY.txt -received ../receiver/received.txt -json
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	op_match = iota
+	op_sub
+	op_ins // bit present in received but not in sent
+	op_del // bit present in sent but missing from received
+)
+
+var op_names = []string{"match", "substitution", "insertion", "deletion"}
+
+// a slipped bit costs more than a flipped one, so a short burst of flips isn't
+// explained away as an insertion plus a deletion
+const indel_cost = 2
+
+type ErrorEvent struct {
+	// position in the sent stream, insertions report the sent bit they precede
+	SentPos     int    `json:"sent_pos"`
+	ReceivedPos int    `json:"received_pos"`
+	Kind        string `json:"kind"`
+}
+
+type Report struct {
+	SentBits      int          `json:"sent_bits"`
+	ReceivedBits  int          `json:"received_bits"`
+	Substitutions int          `json:"substitutions"`
+	Insertions    int          `json:"insertions"`
+	Deletions     int          `json:"deletions"`
+	BER           float64      `json:"ber"`
+	PacketBits    int          `json:"packet_bits"`
+	Packets       int          `json:"packets"`
+	PacketErrors  int          `json:"packet_errors"`
+	PER           float64      `json:"per"`
+	Bursts        map[int]int  `json:"burst_histogram"`
+	LongestBurst  int          `json:"longest_burst"`
+	Errors        []ErrorEvent `json:"errors"`
+	ErrorsDropped int          `json:"errors_dropped,omitempty"`
+}
+
+func main() {
+	sent_path := flag.String("sent", "INPUT_DUMMY.txt", "file the sender transmitted")
+	received_path := flag.String("received", "received.txt", "file the receiver wrote")
+	format := flag.String("format", "auto", "how to read the files: text (0/1 characters), binary (8 bits per byte) or auto")
+	packet_bits := flag.Int("packet-bits", 0, "split the sent stream into packets of this many bits for PER, 0 means one packet")
+	band := flag.Int("band", 64, "maximum drift between the two streams the aligner searches, in bits, at most 1024")
+	max_positions := flag.Int("max-positions", 1000, "maximum number of error positions to list")
+	as_json := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	sent, err := read_bits(*sent_path, *format)
+	chk(err)
+	received, err := read_bits(*received_path, *format)
+	chk(err)
+
+	ops := align(sent, received, *band)
+	report := analyze(ops, len(sent), len(received), *packet_bits, *max_positions)
+
+	if *as_json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		chk(enc.Encode(report))
+		return
+	}
+	print_report(report)
+}
+
+// text files keep only their '0' and '1' characters, binary files are expanded
+// MSB first; auto treats files that contain nothing but 0, 1 and whitespace as text
+func read_bits(path string, format string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == "auto" {
+		format = "text"
+		if strings.ToLower(filepath.Ext(path)) == ".bin" {
+			format = "binary"
+		}
+		for _, c := range content {
+			if c != '0' && c != '1' && c != '\n' && c != '\r' && c != ' ' && c != '\t' {
+				format = "binary"
+				break
+			}
+		}
+	}
+	out := []byte{}
+	switch format {
+	case "text":
+		for _, c := range content {
+			if c == '0' || c == '1' {
+				out = append(out, c-'0')
+			}
+		}
+	case "binary":
+		for _, c := range content {
+			for i := 7; i >= 0; i-- {
+				out = append(out, (c>>i)&1)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return out, nil
+}
+
+// max_band caps the drift align searches, its traceback takes 2*band+1 bytes
+// for every bit sent
+const max_band = 1024
+
+// Edit distance restricted to |i - j| <= band, then traced back into a list of
+// operations. Whatever the longer stream has beyond band of the shorter one's
+// end can't be matched to anything and goes on the end as deletions, or
+// insertions when the received one is longer.
+func align(a []byte, b []byte, band int) []int {
+	band = min(max(band, 1), max_band)
+	n, m := len(a), len(b)
+	tail, tail_op := 0, op_del
+	if n > m+band {
+		tail, n = n-(m+band), m+band
+	} else if m > n+band {
+		tail, tail_op, m = m-(n+band), op_ins, n+band
+	}
+
+	width := 2*band + 1
+	const inf = int32(1 << 30)
+	// two rows of cost[i][j - i + band] for the band around the diagonal,
+	// and the operation that got to every cell for the traceback
+	prev, cur := make([]int32, width), make([]int32, width)
+	from := make([]byte, (n+1)*width)
+	for i := 0; i <= n; i++ {
+		for k := range cur {
+			cur[k] = inf
+		}
+		for j := max(0, i-band); j <= min(m, i+band); j++ {
+			k := j - i + band
+			if i == 0 && j == 0 {
+				cur[k] = 0
+				continue
+			}
+			best, op := inf, op_match
+			if i > 0 && j > 0 {
+				best = prev[k]
+				if a[i-1] != b[j-1] {
+					best, op = best+1, op_sub
+				}
+			}
+			// (i, j-1) is k-1 in this row, (i-1, j) is k+1 in the last
+			if j > 0 && k > 0 && cur[k-1]+indel_cost < best {
+				best, op = cur[k-1]+indel_cost, op_ins
+			}
+			if i > 0 && k+1 < width && prev[k+1]+indel_cost < best {
+				best, op = prev[k+1]+indel_cost, op_del
+			}
+			cur[k] = best
+			from[i*width+k] = byte(op)
+		}
+		prev, cur = cur, prev
+	}
+
+	ops := []int{}
+	i, j := n, m
+	for i > 0 || j > 0 {
+		op := int(from[i*width+j-i+band])
+		ops = append(ops, op)
+		if op != op_ins {
+			i--
+		}
+		if op != op_del {
+			j--
+		}
+	}
+	for l, r := 0, len(ops)-1; l < r; l, r = l+1, r-1 {
+		ops[l], ops[r] = ops[r], ops[l]
+	}
+	for ; tail > 0; tail-- {
+		ops = append(ops, tail_op)
+	}
+	return ops
+}
+
+func analyze(ops []int, sent_bits int, received_bits int, packet_bits int, max_positions int) Report {
+	if packet_bits <= 0 {
+		packet_bits = max(sent_bits, 1)
+	}
+	r := Report{
+		SentBits:     sent_bits,
+		ReceivedBits: received_bits,
+		PacketBits:   packet_bits,
+		Packets:      (sent_bits + packet_bits - 1) / packet_bits,
+		Bursts:       map[int]int{},
+		Errors:       []ErrorEvent{},
+	}
+	bad_packets := map[int]bool{}
+	burst := 0
+	end_burst := func() {
+		if burst > 0 {
+			r.Bursts[burst]++
+			r.LongestBurst = max(r.LongestBurst, burst)
+		}
+		burst = 0
+	}
+	i, j := 0, 0
+	for _, op := range ops {
+		if op == op_match {
+			end_burst()
+			i, j = i+1, j+1
+			continue
+		}
+		burst++
+		switch op {
+		case op_sub:
+			r.Substitutions++
+		case op_ins:
+			r.Insertions++
+		case op_del:
+			r.Deletions++
+		}
+		bad_packets[min(i, max(sent_bits-1, 0))/packet_bits] = true
+		if len(r.Errors) < max_positions {
+			r.Errors = append(r.Errors, ErrorEvent{SentPos: i, ReceivedPos: j, Kind: op_names[op]})
+		} else {
+			r.ErrorsDropped++
+		}
+		if op != op_ins {
+			i++
+		}
+		if op != op_del {
+			j++
+		}
+	}
+	end_burst()
+	r.PacketErrors = len(bad_packets)
+	if sent_bits > 0 {
+		r.BER = float64(r.Substitutions+r.Insertions+r.Deletions) / float64(sent_bits)
+	}
+	if r.Packets > 0 {
+		r.PER = float64(r.PacketErrors) / float64(r.Packets)
+	}
+	return r
+}
+
+func print_report(r Report) {
+	fmt.Printf("Sent %d bits, received %d bits\n", r.SentBits, r.ReceivedBits)
+	fmt.Printf("Substitutions %d, insertions %d, deletions %d\n", r.Substitutions, r.Insertions, r.Deletions)
+	fmt.Printf("BER %.6f\n", r.BER)
+	fmt.Printf("PER %.4f (%d of %d packets of %d bits)\n", r.PER, r.PacketErrors, r.Packets, r.PacketBits)
+	if len(r.Bursts) > 0 {
+		lengths := []int{}
+		for l := range r.Bursts {
+			lengths = append(lengths, l)
+		}
+		sort.Ints(lengths)
+		fmt.Println("Burst length histogram:")
+		for _, l := range lengths {
+			fmt.Printf("  %4d: %d\n", l, r.Bursts[l])
+		}
+	}
+	for _, e := range r.Errors {
+		fmt.Printf("  sent %d received %d: %s\n", e.SentPos, e.ReceivedPos, e.Kind)
+	}
+	if r.ErrorsDropped > 0 {
+		fmt.Printf("  ... %d more\n", r.ErrorsDropped)
+	}
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
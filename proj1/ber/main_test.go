@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func random_bits(n int) []byte {
+	random := rand.New(rand.NewSource(1))
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(random.Intn(2))
+	}
+	return out
+}
+
+func count(ops []int) (subs, ins, dels int) {
+	for _, op := range ops {
+		switch op {
+		case op_sub:
+			subs++
+		case op_ins:
+			ins++
+		case op_del:
+			dels++
+		}
+	}
+	return
+}
+
+func TestAlignSlip(t *testing.T) {
+	sent := random_bits(1000)
+	received := append(append(append([]byte{}, sent[:300]...), 1-sent[300]), sent[300:]...)
+	received[700] ^= 1
+	subs, ins, dels := count(align(sent, received, 64))
+	if subs != 1 || ins != 1 || dels != 0 {
+		t.Errorf("%d substitutions, %d insertions, %d deletions, want 1, 1, 0", subs, ins, dels)
+	}
+}
+
+// a receiver that stopped early leaves the rest of what was sent as
+// deletions, without a table of every sent bit against every received one
+func TestAlignShort(t *testing.T) {
+	sent := random_bits(50000)
+	received := sent[:20000]
+	ops := align(sent, received, 64)
+	if len(ops) != len(sent) {
+		t.Fatalf("%d operations for %d bits sent", len(ops), len(sent))
+	}
+	subs, ins, dels := count(ops)
+	if subs != 0 || ins != 0 || dels != 30000 {
+		t.Errorf("%d substitutions, %d insertions, %d deletions, want 0, 0, 30000", subs, ins, dels)
+	}
+	r := analyze(ops, len(sent), len(received), 15000, 10)
+	if r.PacketErrors != 3 || r.ErrorsDropped != 29990 {
+		t.Errorf("%d bad packets and %d errors dropped, want 3 of 4 and 29990", r.PacketErrors, r.ErrorsDropped)
+	}
+}
+
+func TestAlignEmpty(t *testing.T) {
+	sent := random_bits(1000)
+	subs, ins, dels := count(align(sent, nil, 64))
+	if subs != 0 || ins != 0 || dels != 1000 {
+		t.Errorf("%d substitutions, %d insertions, %d deletions, want 0, 0, 1000", subs, ins, dels)
+	}
+	subs, ins, dels = count(align(nil, sent, 64))
+	if subs != 0 || ins != 1000 || dels != 0 {
+		t.Errorf("nothing sent: %d substitutions, %d insertions, %d deletions, want 0, 1000, 0", subs, ins, dels)
+	}
+	if ops := align(nil, nil, 64); len(ops) != 0 {
+		t.Errorf("%d operations for nothing either way", len(ops))
+	}
+}
@@ -0,0 +1,192 @@
+package ip
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"link"
+)
+
+// A gateway passes UDP between nodes of the link and the host's network, as a
+// NAT (RFC 4787) does: a datagram from a node's port goes out from a UDP
+// socket of the host's own, one for every node and port, and whatever comes
+// back to that socket from where the node sent to goes back to the node,
+// from where it came. Nothing else gets in. A node sends through us by
+// having us as its Stack.Gateway.
+//
+// Mappings nobody used for nat_timeout are closed, the least RFC 4787 allows.
+const nat_timeout = 2 * time.Minute
+
+// Events of the gateway.
+const (
+	EvNATMapped  = "nat_mapped"
+	EvNATExpired = "nat_expired"
+)
+
+// Mapping is a node's port, Inside, and the host's socket standing in for it
+// on the network, Outside.
+type Mapping struct {
+	Inside  netip.AddrPort
+	Outside netip.AddrPort
+	// since the last datagram either way
+	Idle time.Duration
+}
+
+type mapping struct {
+	inside netip.AddrPort
+	conn   *net.UDPConn
+	last   time.Time
+	// where the node has sent to, the only ones let back in
+	peers map[netip.AddrPort]bool
+}
+
+type Gateway struct {
+	Stack *Stack
+
+	mu       sync.Mutex
+	mappings map[netip.AddrPort]*mapping
+	closed   bool
+}
+
+// NewGateway makes s the gateway, it takes over s.Forward; like the node's
+// fields it's set before the node's Start.
+func NewGateway(s *Stack) *Gateway {
+	g := &Gateway{Stack: s, mappings: map[netip.AddrPort]*mapping{}}
+	s.Forward = g.forward
+	return g
+}
+
+// Mappings is the port mapping table, by node.
+func (g *Gateway) Mappings() []Mapping {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := []Mapping{}
+	for _, m := range g.mappings {
+		out = append(out, Mapping{Inside: m.inside, Outside: outside(m.conn), Idle: time.Since(m.last)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].Inside, out[j].Inside
+		return a.Addr().Less(b.Addr()) || a.Addr() == b.Addr() && a.Port() < b.Port()
+	})
+	return out
+}
+
+// Close closes every mapping and stops forwarding.
+func (g *Gateway) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	for inside, m := range g.mappings {
+		m.conn.Close()
+		delete(g.mappings, inside)
+	}
+	return nil
+}
+
+func outside(conn *net.UDPConn) netip.AddrPort {
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// forward sends a packet from a node out of the host's socket for it. The
+// packet has to come from the node it says it's from, or anyone in earshot
+// could have us open mappings for, and pass replies on to, somebody else
+func (g *Gateway) forward(p Packet, from link.Addr) {
+	logger := g.Stack.Node.Logger
+	if !Subnet.Contains(p.Src) || p.Src != NodeAddr(from) {
+		logger.Info(link.EvLinkDropped, "reason", "source isn't the sending node", "packet", p.String(), "from", from.String())
+		return
+	}
+	if p.Protocol != ProtoUDP {
+		logger.Debug(link.EvLinkDropped, "reason", "only udp goes through the gateway", "packet", p.String())
+		return
+	}
+	if p.TTL <= 1 {
+		logger.Info(link.EvLinkDropped, "reason", "ttl exceeded", "packet", p.String())
+		return
+	}
+	u, err := ParseUDP(p)
+	if err != nil {
+		logger.Info(link.EvLinkDropped, "reason", err.Error(), "packet", p.String())
+		return
+	}
+	inside := netip.AddrPortFrom(p.Src, u.SrcPort)
+	dst := netip.AddrPortFrom(p.Dst, u.DstPort)
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return
+	}
+	m := g.mappings[inside]
+	if m == nil {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+		if err != nil {
+			g.mu.Unlock()
+			logger.Warn(link.EvLinkDropped, "reason", err.Error(), "packet", p.String())
+			return
+		}
+		m = &mapping{inside: inside, conn: conn, peers: map[netip.AddrPort]bool{}}
+		g.mappings[inside] = m
+		logger.Info(EvNATMapped, "inside", inside.String(), "outside", outside(conn).String())
+		go g.back(m)
+	}
+	m.last = time.Now()
+	m.peers[dst] = true
+	g.mu.Unlock()
+
+	if _, err := m.conn.WriteToUDPAddrPort(u.Payload, dst); err != nil {
+		logger.Info(link.EvLinkDropped, "reason", err.Error(), "packet", p.String())
+	}
+}
+
+// back passes what comes to a mapping's socket back to its node, until the
+// mapping's been idle for nat_timeout
+func (g *Gateway) back(m *mapping) {
+	buf := make([]byte, 1<<16)
+	for {
+		g.mu.Lock()
+		idle_until := m.last.Add(nat_timeout)
+		g.mu.Unlock()
+		m.conn.SetReadDeadline(idle_until)
+		n, from, err := m.conn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			g.mu.Lock()
+			expired := time.Since(m.last) >= nat_timeout
+			if expired && g.mappings[m.inside] == m {
+				delete(g.mappings, m.inside)
+				m.conn.Close()
+			}
+			g.mu.Unlock()
+			if expired {
+				g.Stack.Node.Logger.Info(EvNATExpired, "inside", m.inside.String(), "outside", outside(m.conn).String())
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		// the socket is udp4, but its addresses can still come mapped
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		g.mu.Lock()
+		allowed := m.peers[from]
+		if allowed {
+			m.last = time.Now()
+		}
+		g.mu.Unlock()
+		if !allowed {
+			g.Stack.Node.Logger.Debug(link.EvLinkDropped, "reason", "not a peer of the mapping", "from", from.String(), "inside", m.inside.String())
+			continue
+		}
+		u := UDP{SrcPort: from.Port(), DstPort: m.inside.Port(), Payload: append([]byte{}, buf[:n]...)}
+		p := Packet{Src: from.Addr(), Dst: m.inside.Addr(), Protocol: ProtoUDP, TTL: DefaultTTL, ID: g.Stack.next_id(), Payload: u.Marshal(from.Addr(), m.inside.Addr())}
+		if err := g.Stack.SendPacket(p); err != nil {
+			g.Stack.Node.Logger.Info(link.EvLinkDropped, "reason", err.Error(), "packet", p.String())
+		}
+	}
+}
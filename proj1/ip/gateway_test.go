@@ -0,0 +1,111 @@
+package ip
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"audio"
+	"link"
+	"modem"
+)
+
+// a node sends to an echo server on the host's loopback through a gateway
+// node, over an in-memory link, and hears the echo come back the same way
+func TestGatewayEcho(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := server.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			server.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+
+	p, err := modem.LookupProfile("burst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	air := audio.NewLoopback(512, p.SampleRate)
+	defer air.Close()
+	node := link.NewNode(1, p, air, air)
+	defer node.Close()
+	stack := NewStack(node)
+	stack.Gateway = 2
+	gw_node := link.NewNode(2, p, air, air)
+	defer gw_node.Close()
+	gw := NewGateway(NewStack(gw_node))
+	defer gw.Close()
+	for _, n := range []*link.Node{node, gw_node} {
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replies := make(chan UDP, 4)
+	stack.HandleUDP(4000, func(p Packet, u UDP) { replies <- u })
+	dst := server.LocalAddr().(*net.UDPAddr).AddrPort()
+	sent := []byte("through the gateway")
+	if err := stack.SendUDP(4000, dst, sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-replies:
+		if !bytes.Equal(u.Payload, sent) || u.SrcPort != dst.Port() {
+			t.Errorf("got %q from port %d, want %q from %d", u.Payload, u.SrcPort, sent, dst.Port())
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("no echo through the gateway")
+	}
+
+	mappings := gw.Mappings()
+	if len(mappings) != 1 || mappings[0].Inside != netip.AddrPortFrom(stack.Addr, 4000) {
+		t.Fatalf("mappings %v, want one for %v:4000", mappings, stack.Addr)
+	}
+
+	// someone the node never sent to doesn't get in
+	stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	outside := netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), mappings[0].Outside.Port())
+	if _, err := stranger.WriteToUDPAddrPort([]byte("let me in"), outside); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case u := <-replies:
+		t.Errorf("a stranger got %q through", u.Payload)
+	case <-time.After(time.Second):
+	}
+}
+
+// a packet that isn't from the node that sent it gets no mapping
+func TestGatewaySpoofed(t *testing.T) {
+	p, err := modem.LookupProfile("burst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	air := audio.NewLoopback(512, p.SampleRate)
+	defer air.Close()
+	gw := NewGateway(NewStack(link.NewNode(2, p, air, air)))
+	defer gw.Close()
+
+	dst := netip.MustParseAddrPort("127.0.0.1:9")
+	for _, src := range []netip.Addr{NodeAddr(1), netip.MustParseAddr("192.168.1.1")} {
+		u := UDP{SrcPort: 4000, DstPort: dst.Port(), Payload: []byte("not me")}
+		gw.forward(Packet{Src: src, Dst: dst.Addr(), Protocol: ProtoUDP, TTL: DefaultTTL, Payload: u.Marshal(src, dst.Addr())}, 3)
+	}
+	if mappings := gw.Mappings(); len(mappings) != 0 {
+		t.Errorf("mappings %v for packets node 3 sent as someone else", mappings)
+	}
+}
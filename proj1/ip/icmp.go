@@ -0,0 +1,104 @@
+package ip
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// ICMP, only as far as ping goes: echo requests are answered, and Ping sends
+// them and waits for the reply.
+const (
+	ICMPEchoReply   = 0
+	ICMPEchoRequest = 8
+)
+
+var ErrTimeout = errors.New("ip: timed out")
+
+type Echo struct {
+	Type    uint8
+	ID      uint16
+	Seq     uint16
+	Payload []byte
+}
+
+func (e Echo) Marshal() []byte {
+	out := make([]byte, 8, 8+len(e.Payload))
+	out[0] = e.Type
+	binary.BigEndian.PutUint16(out[4:], e.ID)
+	binary.BigEndian.PutUint16(out[6:], e.Seq)
+	out = append(out, e.Payload...)
+	binary.BigEndian.PutUint16(out[2:], Checksum(out))
+	return out
+}
+
+func ParseEcho(b []byte) (Echo, error) {
+	if len(b) < 8 {
+		return Echo{}, ErrShortPacket
+	}
+	if Checksum(b) != 0 {
+		return Echo{}, ErrChecksum
+	}
+	return Echo{
+		Type:    b[0],
+		ID:      binary.BigEndian.Uint16(b[4:]),
+		Seq:     binary.BigEndian.Uint16(b[6:]),
+		Payload: append([]byte{}, b[8:]...),
+	}, nil
+}
+
+func (s *Stack) on_icmp(p Packet) {
+	e, err := ParseEcho(p.Payload)
+	if err != nil {
+		return
+	}
+	switch e.Type {
+	case ICMPEchoRequest:
+		e.Type = ICMPEchoReply
+		// the handler runs on the node's dispatch goroutine, answering from
+		// it would hold up everything behind the request for a whole frame
+		go s.Send(p.Src, ProtoICMP, e.Marshal())
+	case ICMPEchoReply:
+		s.mu.Lock()
+		waiter := s.echoes[uint32(e.ID)<<16|uint32(e.Seq)]
+		s.mu.Unlock()
+		if waiter != nil {
+			select {
+			case waiter <- p:
+			default:
+			}
+		}
+	}
+}
+
+// Ping sends one echo request of size bytes and waits up to timeout for the
+// reply. The round trip time counts from when the request is done playing,
+// it's the other end's turn from there on.
+func (s *Stack) Ping(dst netip.Addr, id uint16, seq uint16, size int, timeout time.Duration) (time.Duration, Packet, error) {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	key := uint32(id)<<16 | uint32(seq)
+	waiter := make(chan Packet, 1)
+	s.mu.Lock()
+	s.echoes[key] = waiter
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.echoes, key)
+		s.mu.Unlock()
+	}()
+
+	if err := s.Send(dst, ProtoICMP, Echo{Type: ICMPEchoRequest, ID: id, Seq: seq, Payload: payload}.Marshal()); err != nil {
+		return 0, Packet{}, err
+	}
+	sent := time.Now()
+	select {
+	case p := <-waiter:
+		return time.Since(sent), p, nil
+	case <-time.After(timeout):
+		return 0, Packet{}, ErrTimeout
+	}
+}
@@ -0,0 +1,236 @@
+// Package ip is a small userspace IPv4 on top of the acoustic link, enough to
+// carry ICMP and UDP between nodes and, through a gateway, beyond them.
+package ip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"link"
+)
+
+// Every node's IP address follows from its link address, 10.120.0.<addr>, so
+// there's no need for ARP: the link address is the last byte. Everything
+// outside the subnet goes to Stack.Gateway.
+var Subnet = netip.MustParsePrefix("10.120.0.0/24")
+
+func NodeAddr(a link.Addr) netip.Addr {
+	b := Subnet.Addr().As4()
+	b[3] = byte(a)
+	return netip.AddrFrom4(b)
+}
+
+// LinkAddr is the node an address in the subnet belongs to.
+func LinkAddr(a netip.Addr) (link.Addr, bool) {
+	if !Subnet.Contains(a) {
+		return 0, false
+	}
+	return link.Addr(a.As4()[3]), true
+}
+
+const (
+	ProtoICMP = 1
+	ProtoTCP  = 6
+	ProtoUDP  = 17
+)
+
+const HeaderLen = 20
+
+var limited_broadcast = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+const DefaultTTL = 64
+
+var (
+	ErrShortPacket = errors.New("ip: packet too short")
+	ErrNotIPv4     = errors.New("ip: not an IPv4 packet")
+	ErrChecksum    = errors.New("ip: header checksum mismatch")
+	ErrNoRoute     = errors.New("ip: no route to host")
+	ErrTooBig      = errors.New("ip: packet bigger than a link frame")
+)
+
+// Packet is an IPv4 packet without options; we never send any and skip the
+// ones we get.
+type Packet struct {
+	Src      netip.Addr
+	Dst      netip.Addr
+	Protocol uint8
+	TTL      uint8
+	ID       uint16
+	Payload  []byte
+}
+
+func (p Packet) Marshal() []byte {
+	out := make([]byte, HeaderLen, HeaderLen+len(p.Payload))
+	out[0] = 4<<4 | HeaderLen/4
+	binary.BigEndian.PutUint16(out[2:], uint16(HeaderLen+len(p.Payload)))
+	binary.BigEndian.PutUint16(out[4:], p.ID)
+	// don't fragment, nothing on the way would know how to
+	out[6] = 0x40
+	out[8] = p.TTL
+	out[9] = p.Protocol
+	src, dst := p.Src.As4(), p.Dst.As4()
+	copy(out[12:], src[:])
+	copy(out[16:], dst[:])
+	binary.BigEndian.PutUint16(out[10:], Checksum(out))
+	return append(out, p.Payload...)
+}
+
+func ParsePacket(b []byte) (Packet, error) {
+	if len(b) < HeaderLen {
+		return Packet{}, ErrShortPacket
+	}
+	if b[0]>>4 != 4 {
+		return Packet{}, ErrNotIPv4
+	}
+	header_len := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if header_len < HeaderLen || total < header_len || total > len(b) {
+		return Packet{}, ErrShortPacket
+	}
+	if Checksum(b[:header_len]) != 0 {
+		return Packet{}, ErrChecksum
+	}
+	return Packet{
+		Src:      netip.AddrFrom4([4]byte(b[12:16])),
+		Dst:      netip.AddrFrom4([4]byte(b[16:20])),
+		Protocol: b[9],
+		TTL:      b[8],
+		ID:       binary.BigEndian.Uint16(b[4:]),
+		Payload:  append([]byte{}, b[header_len:total]...),
+	}, nil
+}
+
+func (p Packet) String() string {
+	return fmt.Sprintf("%v > %v proto %d ttl %d %d bytes", p.Src, p.Dst, p.Protocol, p.TTL, len(p.Payload))
+}
+
+// Checksum is the internet checksum, over a header that has its own
+// checksum filled in it comes out 0.
+func Checksum(b []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// Stack is a node's IP layer: it sends packets as link frames of TypeIPv4 and
+// hands the ones it gets to whoever handles their protocol, UDP to whoever
+// handles their port. ICMP echo is answered out of the box.
+type Stack struct {
+	Node *link.Node
+	Addr netip.Addr
+	// the node everything outside Subnet goes to, 0 for none
+	Gateway link.Addr
+	// packets for outside Subnet that come to us anyway go here, with the
+	// node they came from, when we are the gateway, see NewGateway; set
+	// before the node's Start
+	Forward func(p Packet, from link.Addr)
+
+	mu        sync.Mutex
+	protocols map[uint8]func(Packet)
+	id        uint16
+	echoes    map[uint32]chan Packet
+	udp_ports map[uint16]func(Packet, UDP)
+}
+
+func NewStack(node *link.Node) *Stack {
+	s := &Stack{
+		Node:      node,
+		Addr:      NodeAddr(node.Addr),
+		protocols: map[uint8]func(Packet){},
+		echoes:    map[uint32]chan Packet{},
+		udp_ports: map[uint16]func(Packet, UDP){},
+	}
+	s.Handle(ProtoICMP, s.on_icmp)
+	s.Handle(ProtoUDP, s.on_udp)
+	node.Mux.Handle(link.TypeIPv4, s.on_frame)
+	return s
+}
+
+// Handle routes packets of protocol proto to h, nil stops routing them.
+func (s *Stack) Handle(proto uint8, h func(Packet)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h == nil {
+		delete(s.protocols, proto)
+		return
+	}
+	s.protocols[proto] = h
+}
+
+// MaxPayload is the most a packet sent with Send carries.
+func (s *Stack) MaxPayload() int {
+	return s.Node.MaxPayload() - HeaderLen
+}
+
+// Send wraps payload in a packet from us to dst.
+func (s *Stack) Send(dst netip.Addr, proto uint8, payload []byte) error {
+	return s.SendPacket(Packet{Src: s.Addr, Dst: dst, Protocol: proto, TTL: DefaultTTL, ID: s.next_id(), Payload: payload})
+}
+
+func (s *Stack) next_id() uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id++
+	return s.id
+}
+
+// SendPacket sends p as it is, for packets we pass on rather than make.
+func (s *Stack) SendPacket(p Packet) error {
+	next, err := s.next_hop(p.Dst)
+	if err != nil {
+		return err
+	}
+	b := p.Marshal()
+	if len(b) > s.Node.MaxPayload() {
+		return ErrTooBig
+	}
+	return s.Node.Send(link.Frame{Dst: next, Type: link.TypeIPv4, Payload: b})
+}
+
+func (s *Stack) next_hop(dst netip.Addr) (link.Addr, error) {
+	if a, ok := LinkAddr(dst); ok {
+		return a, nil
+	}
+	if dst == limited_broadcast {
+		return link.Broadcast, nil
+	}
+	if s.Gateway != 0 {
+		return s.Gateway, nil
+	}
+	return 0, ErrNoRoute
+}
+
+func (s *Stack) on_frame(f link.Frame) {
+	p, err := ParsePacket(f.Payload)
+	if err != nil {
+		s.Node.Logger.Info(link.EvLinkDropped, "reason", err.Error(), "frame", f.String())
+		return
+	}
+	if s.Forward != nil && !Subnet.Contains(p.Dst) && p.Dst != limited_broadcast {
+		s.Forward(p, f.Src)
+		return
+	}
+	if p.Dst != s.Addr && p.Dst != limited_broadcast {
+		s.Node.Logger.Debug(link.EvLinkDropped, "reason", "not ours", "packet", p.String())
+		return
+	}
+	s.mu.Lock()
+	h := s.protocols[p.Protocol]
+	s.mu.Unlock()
+	if h == nil {
+		s.Node.Logger.Debug(link.EvLinkDropped, "reason", "no handler", "packet", p.String())
+		return
+	}
+	h(p)
+}
@@ -0,0 +1,96 @@
+package ip
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"link"
+)
+
+// UDP (RFC 768), datagrams between ports of two addresses. Handlers get
+// them by the port they're for.
+const UDPHeaderLen = 8
+
+type UDP struct {
+	SrcPort uint16
+	DstPort uint16
+	Payload []byte
+}
+
+// Marshal is the datagram with its checksum, which covers the addresses of
+// the packet carrying it too.
+func (u UDP) Marshal(src, dst netip.Addr) []byte {
+	out := make([]byte, UDPHeaderLen, UDPHeaderLen+len(u.Payload))
+	binary.BigEndian.PutUint16(out, u.SrcPort)
+	binary.BigEndian.PutUint16(out[2:], u.DstPort)
+	binary.BigEndian.PutUint16(out[4:], uint16(UDPHeaderLen+len(u.Payload)))
+	out = append(out, u.Payload...)
+	sum := Checksum(append(pseudo_header(src, dst, len(out)), out...))
+	if sum == 0 {
+		// 0 is for no checksum at all
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(out[6:], sum)
+	return out
+}
+
+// ParseUDP is the datagram p carries.
+func ParseUDP(p Packet) (UDP, error) {
+	b := p.Payload
+	if len(b) < UDPHeaderLen {
+		return UDP{}, ErrShortPacket
+	}
+	length := int(binary.BigEndian.Uint16(b[4:]))
+	if length < UDPHeaderLen || length > len(b) {
+		return UDP{}, ErrShortPacket
+	}
+	b = b[:length]
+	if binary.BigEndian.Uint16(b[6:]) != 0 && Checksum(append(pseudo_header(p.Src, p.Dst, length), b...)) != 0 {
+		return UDP{}, ErrChecksum
+	}
+	return UDP{
+		SrcPort: binary.BigEndian.Uint16(b),
+		DstPort: binary.BigEndian.Uint16(b[2:]),
+		Payload: append([]byte{}, b[UDPHeaderLen:]...),
+	}, nil
+}
+
+func pseudo_header(src, dst netip.Addr, length int) []byte {
+	s, d := src.As4(), dst.As4()
+	out := append(s[:], d[:]...)
+	out = append(out, 0, ProtoUDP)
+	return binary.BigEndian.AppendUint16(out, uint16(length))
+}
+
+// HandleUDP hands datagrams for port to h, nil stops it.
+func (s *Stack) HandleUDP(port uint16, h func(p Packet, u UDP)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h == nil {
+		delete(s.udp_ports, port)
+		return
+	}
+	s.udp_ports[port] = h
+}
+
+// SendUDP sends payload from our port src_port to dst.
+func (s *Stack) SendUDP(src_port uint16, dst netip.AddrPort, payload []byte) error {
+	u := UDP{SrcPort: src_port, DstPort: dst.Port(), Payload: payload}
+	return s.Send(dst.Addr(), ProtoUDP, u.Marshal(s.Addr, dst.Addr()))
+}
+
+func (s *Stack) on_udp(p Packet) {
+	u, err := ParseUDP(p)
+	if err != nil {
+		s.Node.Logger.Info(link.EvLinkDropped, "reason", err.Error(), "packet", p.String())
+		return
+	}
+	s.mu.Lock()
+	h := s.udp_ports[u.DstPort]
+	s.mu.Unlock()
+	if h == nil {
+		s.Node.Logger.Debug(link.EvLinkDropped, "reason", "port closed", "port", u.DstPort, "packet", p.String())
+		return
+	}
+	h(p, u)
+}
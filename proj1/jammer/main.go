@@ -0,0 +1,90 @@
+// Go take on proj2's JammingWav.m: gated full scale noise, quiet for 100-200ms,
+// noisy for 50-100ms, written to a wav file like the script does or played
+// live on a sound card to jam a real transfer.
+//
+//	jammer -output wav:Jamming.wav -duration 5m
+//	jammer -output malgo -duration 0 -level 0.3
+//	jammer -quiet 50ms,80ms -burst 20ms,40ms -seed 7
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"audio"
+	"modem"
+)
+
+// generated and written this much at a time
+const chunk_duration = 100 * time.Millisecond
+
+func main() {
+	output := flag.String("output", "wav:Jamming.wav", "audio backend to play on, one of "+audio.BackendsUsage()+", e.g. wav:out.wav")
+	duration := flag.Duration("duration", 5*time.Minute, "how much jamming to make, 0 goes on until killed")
+	rate := flag.Int("sample-rate", 48000, "rate to generate at")
+	device_rate := flag.Int("device-rate", 0, "rate the audio device runs at, resampled from -sample-rate, 0 means the same")
+	seed := flag.Int64("seed", 1, "random seed for the pattern and the noise")
+	quiet := flag.String("quiet", "100ms,200ms", "shortest and longest quiet gap")
+	burst := flag.String("burst", "50ms,100ms", "shortest and longest burst of noise")
+	level := flag.Float64("level", 1, "peak amplitude of the noise, 1 is full scale")
+	devices := audio.AddDeviceFlags(flag.CommandLine, false, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
+
+	jammer := modem.NewJammer(*rate, *seed)
+	jammer.Level = *level
+	var err error
+	jammer.QuietMin, jammer.QuietMax, err = parse_range(*quiet)
+	chk(err)
+	jammer.BurstMin, jammer.BurstMax, err = parse_range(*burst)
+	chk(err)
+
+	device, err := devices.Output(*output)
+	chk(err)
+	sink, err := audio.OpenSink(*output, audio.Config{SampleRate: *rate, DeviceRate: *device_rate, Device: device})
+	chk(err)
+	defer sink.Close()
+
+	total := int(duration.Seconds() * float64(*rate))
+	chunk := int(chunk_duration.Seconds() * float64(*rate))
+	for written := 0; *duration == 0 || written < total; written += chunk {
+		frames := chunk
+		if *duration != 0 {
+			frames = min(chunk, total-written)
+		}
+		chk(sink.Write(jammer.Generate(frames)))
+	}
+	chk(sink.Drain())
+}
+
+// parse_range reads "low,high"
+func parse_range(s string) (time.Duration, time.Duration, error) {
+	low_s, high_s, ok := strings.Cut(s, ",")
+	if !ok {
+		return 0, 0, errors.New("expected two durations, e.g. 100ms,200ms, got " + s)
+	}
+	low, err := time.ParseDuration(low_s)
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := time.ParseDuration(high_s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if low <= 0 || high < low {
+		return 0, 0, errors.New("need 0 < low <= high, got " + s)
+	}
+	return low, high, nil
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
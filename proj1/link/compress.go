@@ -0,0 +1,86 @@
+package link
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A frame with FlagCompressed set carries its payload DEFLATEd (RFC 1951, no
+// zlib or gzip wrapper, every byte is airtime). Compression comes before
+// fragmenting, so the fragments of a compressed payload all have the flag and
+// the whole is inflated once it's back together.
+const FlagCompressed = 1 << 2
+
+var ErrDecompress = errors.New("link: payload doesn't inflate")
+
+// Compress deflates f's payload, and hands f back as it was when that
+// doesn't make it any shorter, as random or already compressed data won't.
+func Compress(f Frame) Frame {
+	if f.Flags&FlagCompressed != 0 || len(f.Payload) == 0 {
+		return f
+	}
+	var out bytes.Buffer
+	w, _ := flate.NewWriter(&out, flate.BestCompression)
+	w.Write(f.Payload)
+	w.Close()
+	if out.Len() >= len(f.Payload) {
+		return f
+	}
+	f.Flags |= FlagCompressed
+	f.Payload = out.Bytes()
+	return f
+}
+
+// Decompress inflates the payload of a frame with FlagCompressed and clears
+// the flag, other frames come back as they are. Payloads inflating past
+// MaxFragmented are refused, nobody sends those.
+func Decompress(f Frame) (Frame, error) {
+	if f.Flags&FlagCompressed == 0 {
+		return f, nil
+	}
+	r := flate.NewReader(bytes.NewReader(f.Payload))
+	defer r.Close()
+	payload, err := io.ReadAll(io.LimitReader(r, MaxFragmented+1))
+	if err != nil {
+		return Frame{}, fmt.Errorf("%w: %v", ErrDecompress, err)
+	}
+	if len(payload) > MaxFragmented {
+		return Frame{}, fmt.Errorf("%w: more than %d bytes", ErrDecompress, MaxFragmented)
+	}
+	f.Flags &^= FlagCompressed
+	f.Payload = payload
+	return f, nil
+}
+
+// CompressionStats counts what compression saved: Raw bytes of payload went
+// out as Sent bytes, Compressed of the Frames were smaller for it.
+type CompressionStats struct {
+	Frames     int
+	Compressed int
+	Raw        int
+	Sent       int
+}
+
+func (s *CompressionStats) Add(raw, sent Frame) {
+	s.Frames++
+	if sent.Flags&FlagCompressed != 0 {
+		s.Compressed++
+	}
+	s.Raw += len(raw.Payload)
+	s.Sent += len(sent.Payload)
+}
+
+// Ratio is raw bytes per byte sent, 1 when nothing was saved.
+func (s CompressionStats) Ratio() float64 {
+	if s.Sent == 0 {
+		return 1
+	}
+	return float64(s.Raw) / float64(s.Sent)
+}
+
+func (s CompressionStats) String() string {
+	return fmt.Sprintf("%d of %d frames compressed, %d bytes sent for %d, ratio %.2f", s.Compressed, s.Frames, s.Sent, s.Raw, s.Ratio())
+}
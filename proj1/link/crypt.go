@@ -0,0 +1,200 @@
+package link
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// A frame with FlagEncrypted set carries its payload sealed with AES-256-GCM
+// under a key everyone on the link shares:
+//
+//	seq         8 bytes, the sender's, never used twice with one key
+//	ciphertext  as long as the payload
+//	tag         16 bytes
+//
+// The nonce is the sender's address and seq, and the addresses, type and all
+// flags but the fragment ones go in as additional data, so a frame can't be
+// read, changed, passed off as someone else's or played again. Sealing comes
+// after compressing and before fragmenting.
+const FlagEncrypted = 1 << 3
+
+const (
+	KeyLen       = 32
+	seq_len      = 8
+	SealOverhead = seq_len + 16
+)
+
+// a passphrase is stretched into a key with PBKDF2-HMAC-SHA256, the salt is
+// fixed as both ends only share the passphrase
+const (
+	key_salt       = "acoustic link key"
+	key_iterations = 100000
+)
+
+// sequence numbers a receiver remembers having seen below the highest one,
+// frames older than that are taken for replays
+const replay_window = 64
+
+var (
+	ErrAuth      = errors.New("link: frame failed authentication")
+	ErrReplay    = errors.New("link: frame replayed")
+	ErrPlaintext = errors.New("link: frame not encrypted")
+	ErrKeyLen    = errors.New("link: key must be 32 bytes")
+)
+
+// Crypt seals frames we send and opens frames we receive with one key.
+type Crypt struct {
+	aead cipher.AEAD
+
+	mu  sync.Mutex
+	seq uint64
+	// per sender, the highest seq opened and which of the replay_window
+	// below it were
+	highest map[Addr]uint64
+	seen    map[Addr]uint64
+}
+
+func NewCrypt(key []byte) (*Crypt, error) {
+	if len(key) != KeyLen {
+		return nil, ErrKeyLen
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Crypt{
+		aead: aead,
+		// a node that restarts carries on from the clock rather than from
+		// 0, its old nonces stay behind it and so do its old frames
+		seq:     uint64(time.Now().UnixNano()),
+		highest: map[Addr]uint64{},
+		seen:    map[Addr]uint64{},
+	}, nil
+}
+
+// OpenCrypt keys a Crypt from a passphrase or a key file, the two flags
+// commands take; neither is nil, nil. A key file of exactly KeyLen bytes is
+// the key, anything else in it counts as a passphrase.
+func OpenCrypt(passphrase string, key_path string) (*Crypt, error) {
+	if key_path != "" {
+		content, err := os.ReadFile(key_path)
+		if err != nil {
+			return nil, err
+		}
+		if len(content) == KeyLen {
+			return NewCrypt(content)
+		}
+		passphrase = string(bytes.TrimSpace(content))
+	}
+	if passphrase == "" {
+		return nil, nil
+	}
+	return NewCrypt(KeyFromPassphrase(passphrase))
+}
+
+// KeyFromPassphrase is PBKDF2 (RFC 8018) with HMAC-SHA256, one block of it.
+func KeyFromPassphrase(passphrase string) []byte {
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte(key_salt))
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte{}, u...)
+	for i := 1; i < key_iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// nonce is the sender and their seq, GCM's 12 bytes
+func nonce(src Addr, seq uint64) []byte {
+	out := make([]byte, 4, 12)
+	out[0] = byte(src)
+	return binary.BigEndian.AppendUint64(out, seq)
+}
+
+// additional_data is what of the header the tag covers: every flag but the
+// fragment ones, which aren't known yet when sealing, as any of them changes
+// how the payload is read
+func additional_data(f Frame) []byte {
+	out := []byte{f.Flags &^ (FlagFragment | FlagMoreFragments), byte(f.Dst), byte(f.Src)}
+	return binary.BigEndian.AppendUint16(out, uint16(f.Type))
+}
+
+// Seal encrypts f's payload, f.Src has to be set by then.
+func (c *Crypt) Seal(f Frame) Frame {
+	c.mu.Lock()
+	c.seq++
+	seq := c.seq
+	c.mu.Unlock()
+	f.Flags |= FlagEncrypted
+	payload := binary.BigEndian.AppendUint64(make([]byte, 0, seq_len+len(f.Payload)+c.aead.Overhead()), seq)
+	f.Payload = c.aead.Seal(payload, nonce(f.Src, seq), f.Payload, additional_data(f))
+	return f
+}
+
+// Open checks and decrypts a frame from Seal, one that fails or was opened
+// before is an error and nothing of it should be used.
+func (c *Crypt) Open(f Frame) (Frame, error) {
+	if f.Flags&FlagEncrypted == 0 {
+		return Frame{}, ErrPlaintext
+	}
+	if len(f.Payload) < SealOverhead {
+		return Frame{}, ErrAuth
+	}
+	seq := binary.BigEndian.Uint64(f.Payload)
+	plain, err := c.aead.Open(nil, nonce(f.Src, seq), f.Payload[seq_len:], additional_data(f))
+	if err != nil {
+		return Frame{}, ErrAuth
+	}
+	if !c.check_replay(f.Src, seq) {
+		return Frame{}, ErrReplay
+	}
+	f.Flags &^= FlagEncrypted
+	f.Payload = plain
+	return f, nil
+}
+
+// check_replay says whether seq from src is new, and remembers it, the
+// sliding window of IPsec's (RFC 4303)
+func (c *Crypt) check_replay(src Addr, seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	highest, ok := c.highest[src]
+	switch {
+	case !ok || seq > highest:
+		shift := seq - highest
+		if !ok || shift >= replay_window {
+			c.seen[src] = 1
+		} else {
+			c.seen[src] = c.seen[src]<<shift | 1
+		}
+		c.highest[src] = seq
+		return true
+	case highest-seq >= replay_window:
+		return false
+	default:
+		bit := uint64(1) << (highest - seq)
+		if c.seen[src]&bit != 0 {
+			return false
+		}
+		c.seen[src] |= bit
+		return true
+	}
+}
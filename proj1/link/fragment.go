@@ -0,0 +1,185 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"modem"
+)
+
+// A payload too long for one frame goes as several, each with FlagFragment
+// set and its piece of the payload behind a fragment header
+//
+//	id      2 bytes, the same in every fragment of one payload
+//	offset  2 bytes, where the piece starts in the payload
+//	data
+//
+// and FlagMoreFragments in all but the last, as IPv4 does it. Every fragment
+// carries the addresses and type of the whole. A frame is long on the air and
+// a single bad bit loses all of it, so a node fragments at its MTU well
+// before the modem's limit.
+const (
+	FlagFragment      = 1 << 0
+	FlagMoreFragments = 1 << 1
+)
+
+const FragmentHeaderLen = 4
+
+// MaxFragmented is the longest payload that can be split, offsets are 2 bytes.
+const MaxFragmented = 0xffff
+
+var (
+	ErrMTU      = errors.New("link: mtu too small for a fragment")
+	ErrFragment = errors.New("link: bad fragment")
+)
+
+// Fragment splits f into frames with at most mtu bytes of payload each, or
+// hands f back when it fits.
+func Fragment(f Frame, mtu int, id uint16) ([]Frame, error) {
+	if len(f.Payload) <= mtu {
+		return []Frame{f}, nil
+	}
+	if len(f.Payload) > MaxFragmented {
+		return nil, ErrTooLong
+	}
+	step := mtu - FragmentHeaderLen
+	if step <= 0 {
+		return nil, ErrMTU
+	}
+	out := []Frame{}
+	for offset := 0; offset < len(f.Payload); offset += step {
+		end := min(offset+step, len(f.Payload))
+		piece := f
+		piece.Flags |= FlagFragment
+		if end < len(f.Payload) {
+			piece.Flags |= FlagMoreFragments
+		}
+		payload := make([]byte, FragmentHeaderLen, FragmentHeaderLen+end-offset)
+		binary.BigEndian.PutUint16(payload, id)
+		binary.BigEndian.PutUint16(payload[2:], uint16(offset))
+		piece.Payload = append(payload, f.Payload[offset:end]...)
+		out = append(out, piece)
+	}
+	return out, nil
+}
+
+// FragmentTimeout is how long to wait for the next fragment after one with
+// payload bytes: the sender's next one is about as long, and someone else may
+// get to talk in between.
+func FragmentTimeout(p modem.Profile, payload int) time.Duration {
+	return 2*frame_airtime(p, payload) + carrier_sense_timeout
+}
+
+type fragment_key struct {
+	src Addr
+	id  uint16
+}
+
+type partial struct {
+	frame  Frame
+	pieces map[int][]byte
+	// length of the whole payload, -1 until the last fragment is in
+	total int
+	timer *time.Timer
+}
+
+// Reassembler puts fragments back together. They may come in any order and
+// more than once; a payload still missing a piece Timeout after its latest
+// fragment is dropped and OnExpire told.
+type Reassembler struct {
+	OnExpire func(src Addr, id uint16, pieces int)
+
+	mu       sync.Mutex
+	partials map[fragment_key]*partial
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{partials: map[fragment_key]*partial{}}
+}
+
+// Add takes in a fragment and returns the whole frame once its last piece is
+// in; frames that aren't fragments come straight back. timeout is how long to
+// wait for the next piece, see FragmentTimeout.
+func (r *Reassembler) Add(f Frame, timeout time.Duration) (Frame, bool, error) {
+	if f.Flags&FlagFragment == 0 {
+		return f, true, nil
+	}
+	if len(f.Payload) < FragmentHeaderLen {
+		return Frame{}, false, ErrFragment
+	}
+	key := fragment_key{src: f.Src, id: binary.BigEndian.Uint16(f.Payload)}
+	offset := int(binary.BigEndian.Uint16(f.Payload[2:]))
+	data := f.Payload[FragmentHeaderLen:]
+	if offset+len(data) > MaxFragmented {
+		return Frame{}, false, ErrFragment
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pa := r.partials[key]
+	if pa == nil {
+		pa = &partial{frame: f, pieces: map[int][]byte{}, total: -1}
+		pa.frame.Flags &^= FlagFragment | FlagMoreFragments
+		r.partials[key] = pa
+		pa.timer = time.AfterFunc(timeout, func() { r.expire(key, pa) })
+	} else {
+		pa.timer.Reset(timeout)
+	}
+	pa.pieces[offset] = data
+	if f.Flags&FlagMoreFragments == 0 {
+		pa.total = offset + len(data)
+	}
+
+	whole, ok := pa.join()
+	if !ok {
+		return Frame{}, false, nil
+	}
+	pa.timer.Stop()
+	delete(r.partials, key)
+	pa.frame.Payload = whole
+	return pa.frame, true, nil
+}
+
+// join is the payload if the pieces cover all of it
+func (pa *partial) join() ([]byte, bool) {
+	if pa.total < 0 {
+		return nil, false
+	}
+	offsets := make([]int, 0, len(pa.pieces))
+	for offset := range pa.pieces {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+	out := make([]byte, pa.total)
+	covered := 0
+	for _, offset := range offsets {
+		if offset > covered {
+			return nil, false
+		}
+		end := offset + len(pa.pieces[offset])
+		if end > pa.total {
+			// doesn't agree with the last fragment, one of them is stale
+			return nil, false
+		}
+		copy(out[offset:], pa.pieces[offset])
+		covered = max(covered, end)
+	}
+	return out, covered == pa.total
+}
+
+func (r *Reassembler) expire(key fragment_key, pa *partial) {
+	r.mu.Lock()
+	if r.partials[key] != pa {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.partials, key)
+	pieces := len(pa.pieces)
+	r.mu.Unlock()
+	if r.OnExpire != nil {
+		r.OnExpire(key.src, key.id, pieces)
+	}
+}
@@ -0,0 +1,145 @@
+// Package link is what goes on top of the modem: frames that say who they're
+// from, who they're for and what they carry, so IP, control messages and plain
+// data can share one acoustic link and be told apart on receipt.
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"modem"
+)
+
+// A link frame is the data bits of one modem packet:
+//
+//	version  1 byte, Version
+//	flags    1 byte, FlagFragment, FlagMoreFragments, FlagCompressed,
+//	         FlagEncrypted and FlagRouted
+//	dst      1 byte
+//	src      1 byte
+//	type     2 bytes, an EtherType
+//	length   2 bytes, of the payload
+//	payload  length bytes
+//	crc      4 bytes, CRC-32 of everything before it, as Ethernet's
+//
+// big endian. Addresses are a single byte, there's never more than a handful
+// of nodes in a room and every byte costs airtime.
+const (
+	Version    = 1
+	HeaderLen  = 8
+	TrailerLen = 4
+	Overhead   = HeaderLen + TrailerLen
+)
+
+type Addr uint8
+
+const Broadcast Addr = 0xff
+
+func (a Addr) String() string {
+	if a == Broadcast {
+		return "broadcast"
+	}
+	return fmt.Sprintf("%d", uint8(a))
+}
+
+type EtherType uint16
+
+const (
+	TypeIPv4 EtherType = 0x0800
+	// the two EtherTypes set aside for local experiments, for what only we
+	// speak; TypeData carries datagrams between ports, see PacketConn
+	TypeControl EtherType = 0x88b5
+	TypeData    EtherType = 0x88b6
+)
+
+func (t EtherType) String() string {
+	switch t {
+	case TypeIPv4:
+		return "ipv4"
+	case TypeControl:
+		return "control"
+	case TypeData:
+		return "data"
+	}
+	return fmt.Sprintf("0x%04x", uint16(t))
+}
+
+var (
+	ErrShortFrame = errors.New("link: frame too short")
+	ErrVersion    = errors.New("link: unknown frame version")
+	ErrLength     = errors.New("link: payload length doesn't match the frame")
+	ErrCRC        = errors.New("link: crc mismatch")
+	ErrTooLong    = errors.New("link: payload too long")
+)
+
+type Frame struct {
+	Flags   uint8
+	Dst     Addr
+	Src     Addr
+	Type    EtherType
+	Payload []byte
+}
+
+func (f Frame) String() string {
+	return fmt.Sprintf("%v > %v %v %d bytes", f.Src, f.Dst, f.Type, len(f.Payload))
+}
+
+func (f Frame) Marshal() ([]byte, error) {
+	if len(f.Payload) > 0xffff {
+		return nil, ErrTooLong
+	}
+	out := make([]byte, 0, Overhead+len(f.Payload))
+	out = append(out, Version, f.Flags, byte(f.Dst), byte(f.Src))
+	out = binary.BigEndian.AppendUint16(out, uint16(f.Type))
+	out = binary.BigEndian.AppendUint16(out, uint16(len(f.Payload)))
+	out = append(out, f.Payload...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out)), nil
+}
+
+func Unmarshal(b []byte) (Frame, error) {
+	if len(b) < Overhead {
+		return Frame{}, ErrShortFrame
+	}
+	if b[0] != Version {
+		return Frame{}, ErrVersion
+	}
+	length := int(binary.BigEndian.Uint16(b[6:]))
+	if HeaderLen+length+TrailerLen != len(b) {
+		return Frame{}, ErrLength
+	}
+	body := b[:HeaderLen+length]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[HeaderLen+length:]) {
+		return Frame{}, ErrCRC
+	}
+	return Frame{
+		Flags:   b[1],
+		Dst:     Addr(b[2]),
+		Src:     Addr(b[3]),
+		Type:    EtherType(binary.BigEndian.Uint16(b[4:])),
+		Payload: append([]byte{}, b[HeaderLen:HeaderLen+length]...),
+	}, nil
+}
+
+// Bits is the frame as the message of a modem packet.
+func (f Frame) Bits() (modem.BitString, error) {
+	b, err := f.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return modem.BytesToBitString(b), nil
+}
+
+// FromBits takes the frame out of what the receiver handed over.
+func FromBits(bits []byte) (Frame, error) {
+	if len(bits)%8 != 0 {
+		return Frame{}, ErrLength
+	}
+	return Unmarshal(modem.PackBits(bits))
+}
+
+// MaxPayload is the most a single frame of the profile carries.
+func MaxPayload(p modem.Profile) int {
+	return min(p.MaxPacketBits()/8-Overhead, 0xffff)
+}
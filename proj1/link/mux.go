@@ -0,0 +1,41 @@
+package link
+
+import "sync"
+
+// Mux hands received frames to whoever handles their EtherType.
+type Mux struct {
+	mu       sync.Mutex
+	handlers map[EtherType]func(Frame)
+	// frames nobody handles, nil drops them
+	Default func(Frame)
+}
+
+func NewMux() *Mux {
+	return &Mux{handlers: map[EtherType]func(Frame){}}
+}
+
+// Handle routes frames of type t to h, a nil h stops routing them.
+func (m *Mux) Handle(t EtherType, h func(Frame)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h == nil {
+		delete(m.handlers, t)
+		return
+	}
+	m.handlers[t] = h
+}
+
+// Dispatch passes f on, false when nobody took it.
+func (m *Mux) Dispatch(f Frame) bool {
+	m.mu.Lock()
+	h := m.handlers[f.Type]
+	if h == nil {
+		h = m.Default
+	}
+	m.mu.Unlock()
+	if h == nil {
+		return false
+	}
+	h(f)
+	return true
+}
@@ -0,0 +1,355 @@
+package link
+
+import (
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"audio"
+	"modem"
+)
+
+// Node is one end of the acoustic link: it plays the frames it's given on a
+// speaker, decodes whatever its microphone hears, and hands the frames meant
+// for it to Mux. There's one channel, the air, so a node only starts talking
+// once nobody else is, and it hears itself too; those frames it drops.
+// Payloads over MTU bytes go as fragments, see Fragment, and with Compress
+// set they're deflated first where that saves airtime. With Crypt set every
+// frame is sealed, and only frames that open with our key are taken in.
+// Nodes out of earshot are reached through others, see Routes and Relay.
+// With Echo set, others are heard over our own sound too.
+//
+// The fields are set between NewNode and Start and left alone after, the
+// node reads them from its own goroutines.
+type Node struct {
+	Addr     Addr
+	Profile  modem.Profile
+	Logger   *slog.Logger
+	Pcap     *modem.PcapWriter
+	Mux      *Mux
+	MTU      int
+	Compress bool
+	Crypt    *Crypt
+	// where frames for nodes we can't hear go, nil sends everything
+	// straight to its Dst
+	Routes *RouteTable
+	// pass on routed frames for others
+	Relay bool
+	// takes our own sound out of what we hear, so someone talking while we
+	// do still gets through; nil hears it as is
+	Echo *modem.EchoCanceller
+
+	sink     audio.AudioSink
+	source   audio.AudioSource
+	receiver *modem.Receiver
+	// whether the receiver is in the middle of someone's frame, set on the
+	// capture goroutine and read by Send
+	busy atomic.Bool
+	// Echo is fed on the capture goroutine and by whoever's sending
+	echo_mu sync.Mutex
+	// holds a token while someone's sending, a channel rather than a mutex
+	// so waiting for our turn can time out
+	turn   chan struct{}
+	frames chan Frame
+	done   chan struct{}
+
+	fragment_id atomic.Uint32
+	reassembler *Reassembler
+
+	stats_mu       sync.Mutex
+	sent_stats     CompressionStats
+	received_stats CompressionStats
+
+	ports_mu sync.Mutex
+	ports    map[uint16]*PacketConn
+
+	route_seq   atomic.Uint32
+	route_mu    sync.Mutex
+	hop_waiters map[ack_key]chan struct{}
+	end_waiters map[ack_key]chan struct{}
+	seen        map[route_key]time.Time
+}
+
+// Events of the link layer, see modem.OpenLogger.
+const (
+	EvLinkSent     = "link_sent"
+	EvLinkReceived = "link_received"
+	EvLinkDropped  = "link_dropped"
+)
+
+// how long Send waits for someone else to finish before talking over them
+const carrier_sense_timeout = 10 * time.Second
+
+// played after every frame so the receivers' last symbol window fills up
+// even when nothing else is heard after it
+const frame_tail = 50 * time.Millisecond
+
+// frames decoded but not yet handled before new ones get dropped
+const node_queue = 64
+
+// the most payload a frame carries unless the profile takes less, a few
+// seconds on the air with the fast profile
+const default_mtu = 512
+
+// NewNode makes a node that neither hears nor handles anything until Start.
+// The node owns neither end, close them after Close.
+func NewNode(addr Addr, p modem.Profile, sink audio.AudioSink, source audio.AudioSource) *Node {
+	n := &Node{
+		Addr:        addr,
+		Profile:     p,
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Mux:         NewMux(),
+		MTU:         min(MaxPayload(p), default_mtu),
+		sink:        sink,
+		source:      source,
+		receiver:    modem.NewReceiver(p),
+		turn:        make(chan struct{}, 1),
+		frames:      make(chan Frame, node_queue),
+		done:        make(chan struct{}),
+		reassembler: NewReassembler(),
+		ports:       map[uint16]*PacketConn{},
+		hop_waiters: map[ack_key]chan struct{}{},
+		end_waiters: map[ack_key]chan struct{}{},
+		seen:        map[route_key]time.Time{},
+	}
+	n.route_seq.Store(rand.Uint32())
+	n.Mux.Handle(TypeControl, n.on_control)
+	return n
+}
+
+// Start listens on the source and hands what's heard to Mux, with whatever
+// Crypt, Compress, Routes and the rest are set to by then.
+func (n *Node) Start() error {
+	n.reassembler.OnExpire = func(src Addr, id uint16, pieces int) {
+		n.Logger.Info(EvLinkDropped, "reason", "fragment missing", "src", src.String(), "id", id, "pieces", pieces)
+	}
+	n.receiver.OnFrame = n.on_frame
+	if err := n.source.Start(func(samples []float32) {
+		if n.Echo != nil {
+			n.echo_mu.Lock()
+			n.Echo.Cancel(samples, n.receiver.Busy())
+			n.echo_mu.Unlock()
+		}
+		n.receiver.Write(samples)
+		n.busy.Store(n.receiver.Busy())
+	}); err != nil {
+		return err
+	}
+	go n.dispatch()
+	return nil
+}
+
+// Send plays f with our address as the source and returns once it's out.
+// Sends from several goroutines take turns.
+func (n *Node) Send(f Frame) error {
+	return n.SendBefore(f, time.Time{})
+}
+
+// SendBefore is Send giving up with os.ErrDeadlineExceeded if it's not our
+// turn to talk by deadline, zero for no deadline. Once playing, the frame is
+// played to the end, all its fragments too. A frame for a node Routes has a
+// route to goes to the route's next hop, and returns once that has it.
+func (n *Node) SendBefore(f Frame, deadline time.Time) error {
+	f.Src = n.Addr
+	if r, ok := n.route(f.Dst); ok {
+		return n.send_routed(f, r.Via, deadline)
+	}
+	return n.transmit(f, deadline)
+}
+
+// transmit plays f on its own, src set
+func (n *Node) transmit(f Frame, deadline time.Time) error {
+	compressed := f
+	if n.Compress {
+		compressed = Compress(f)
+	}
+	sent := compressed
+	if n.Crypt != nil {
+		sent = n.Crypt.Seal(compressed)
+	}
+	pieces, err := Fragment(sent, n.MTU, uint16(n.fragment_id.Add(1)))
+	if err != nil {
+		return err
+	}
+	packets := []modem.BitString{}
+	for _, piece := range pieces {
+		bits, err := piece.Bits()
+		if err != nil {
+			return err
+		}
+		packet, err := n.Profile.BuildPacket(bits)
+		if err != nil {
+			return err
+		}
+		packets = append(packets, packet)
+	}
+	tail := make([]float32, int(frame_tail.Seconds()*float64(n.Profile.SampleRate)))
+
+	waited := time.Now()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case n.turn <- struct{}{}:
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+	defer func() { <-n.turn }()
+	for i, packet := range packets {
+		sensing := time.Now()
+		for n.busy.Load() && time.Since(sensing) < carrier_sense_timeout {
+			if i == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+				return os.ErrDeadlineExceeded
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n.Pcap != nil {
+			if err := n.Pcap.Write(n.Profile.SentRecord(packet)); err != nil {
+				return err
+			}
+		}
+		played := append(n.Profile.Transmission(packet), tail...)
+		if n.Echo != nil {
+			n.echo_mu.Lock()
+			n.Echo.Played(played)
+			n.echo_mu.Unlock()
+		}
+		if err := n.sink.Write(played); err != nil {
+			return err
+		}
+		if err := n.sink.Drain(); err != nil {
+			return err
+		}
+	}
+	n.stats_mu.Lock()
+	n.sent_stats.Add(f, compressed)
+	n.stats_mu.Unlock()
+	n.Logger.Debug(EvLinkSent, "frame", f.String(), "bytes_sent", len(sent.Payload), "fragments", len(packets), "waited", time.Since(waited))
+	return nil
+}
+
+// Compression is what compression saved on the frames sent and received so
+// far.
+func (n *Node) Compression() (sent, received CompressionStats) {
+	n.stats_mu.Lock()
+	defer n.stats_mu.Unlock()
+	return n.sent_stats, n.received_stats
+}
+
+// Airtime is how long Send takes to play payload bytes, fragments and all.
+func (n *Node) Airtime(payload int) time.Duration {
+	step := n.MTU - FragmentHeaderLen
+	if payload <= n.MTU || step <= 0 {
+		return frame_airtime(n.Profile, payload)
+	}
+	d := time.Duration(payload/step) * frame_airtime(n.Profile, n.MTU)
+	if rest := payload % step; rest > 0 {
+		d += frame_airtime(n.Profile, FragmentHeaderLen+rest)
+	}
+	return d
+}
+
+// frame_airtime is how long one frame with payload bytes takes to send
+func frame_airtime(p modem.Profile, payload int) time.Duration {
+	bits := p.BitsPerSymbol()
+	return p.FrameAirtime((8*(Overhead+payload)+bits-1)/bits) + frame_tail
+}
+
+// MaxPayload is the most Send takes, in fragments over MTU.
+func (n *Node) MaxPayload() int {
+	most := max(MaxFragmented, n.MTU) - RouteHeaderLen
+	if n.Crypt != nil {
+		most -= SealOverhead
+	}
+	return most
+}
+
+// Close stops handing frames to Mux.
+func (n *Node) Close() error {
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+	}
+	return nil
+}
+
+// on_frame runs on the capture goroutine, so the handlers, which may well
+// answer, run on dispatch instead
+func (n *Node) on_frame(mf modem.Frame) {
+	if n.Pcap != nil {
+		n.Pcap.Write(n.Profile.ReceivedRecord(mf))
+	}
+	f, err := FromBits(mf.Bits)
+	if err != nil {
+		n.Logger.Info(EvLinkDropped, "reason", err.Error(), "bits", len(mf.Bits), "snr_db", mf.SNR)
+		return
+	}
+	if f.Src == n.Addr {
+		return
+	}
+	if f.Dst != n.Addr && f.Dst != Broadcast {
+		n.Logger.Debug(EvLinkDropped, "reason", "not ours", "frame", f.String())
+		return
+	}
+	n.Logger.Debug(EvLinkReceived, "frame", f.String(), "snr_db", mf.SNR)
+	if f.Flags&FlagFragment != 0 {
+		whole, ok, err := n.reassembler.Add(f, FragmentTimeout(n.Profile, len(f.Payload)))
+		if err != nil {
+			n.Logger.Info(EvLinkDropped, "reason", err.Error(), "frame", f.String())
+		}
+		if !ok {
+			return
+		}
+		f = whole
+	}
+	if n.Crypt != nil {
+		opened, err := n.Crypt.Open(f)
+		if err != nil {
+			n.Logger.Warn(EvLinkDropped, "reason", err.Error(), "frame", f.String())
+			return
+		}
+		f = opened
+	} else if f.Flags&FlagEncrypted != 0 {
+		n.Logger.Info(EvLinkDropped, "reason", "encrypted and we've no key", "frame", f.String())
+		return
+	}
+	raw, err := Decompress(f)
+	if err != nil {
+		n.Logger.Info(EvLinkDropped, "reason", err.Error(), "frame", f.String())
+		return
+	}
+	n.stats_mu.Lock()
+	n.received_stats.Add(raw, f)
+	n.stats_mu.Unlock()
+	f = raw
+	select {
+	case n.frames <- f:
+	default:
+		n.Logger.Warn(EvLinkDropped, "reason", "queue full", "frame", f.String())
+	}
+}
+
+func (n *Node) dispatch() {
+	for {
+		select {
+		case f := <-n.frames:
+			if f.Flags&FlagRouted != 0 {
+				n.on_routed(f)
+				continue
+			}
+			if !n.Mux.Dispatch(f) {
+				n.Logger.Debug(EvLinkDropped, "reason", "no handler", "frame", f.String())
+			}
+		case <-n.done:
+			return
+		}
+	}
+}
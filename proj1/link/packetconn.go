@@ -0,0 +1,268 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frames of TypeData are datagrams between ports, like UDP but straight on the
+// link:
+//
+//	dst port  2 bytes
+//	src port  2 bytes
+//	data
+//
+// PacketConn is a net.PacketConn on a node's port, so code written against
+// net.ListenPacket("udp", ...) runs over sound with ListenPacket(node, ...).
+const DatagramHeaderLen = 4
+
+// ports handed out for ListenPacket(node, 0)
+const (
+	ephemeral_first = 49152
+	ephemeral_last  = 65535
+)
+
+// datagrams waiting for ReadFrom before new ones get dropped, as a full
+// socket buffer would
+const datagram_queue = 64
+
+var (
+	ErrDatagramTooLong = errors.New("link: datagram too long")
+	ErrPortInUse       = errors.New("link: port in use")
+	ErrBadAddr         = errors.New("link: not an acoustic address")
+)
+
+// NetAddr is a port on a node, written "node:port".
+type NetAddr struct {
+	Node Addr
+	Port uint16
+}
+
+func (a *NetAddr) Network() string {
+	return "acoustic"
+}
+
+func (a *NetAddr) String() string {
+	return fmt.Sprintf("%d:%d", uint8(a.Node), a.Port)
+}
+
+// ResolveAddr parses "node:port".
+func ResolveAddr(s string) (*NetAddr, error) {
+	node, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrBadAddr, s)
+	}
+	n, err := strconv.ParseUint(node, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrBadAddr, s)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrBadAddr, s)
+	}
+	return &NetAddr{Node: Addr(n), Port: uint16(p)}, nil
+}
+
+type datagram struct {
+	data []byte
+	from *NetAddr
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
+
+type PacketConn struct {
+	node  *Node
+	local *NetAddr
+	queue chan datagram
+
+	mu             sync.Mutex
+	read_deadline  time.Time
+	write_deadline time.Time
+	// closed and replaced whenever the read deadline moves, to wake ReadFrom
+	deadline_moved chan struct{}
+	closed         chan struct{}
+	close_once     sync.Once
+}
+
+// ListenPacket opens port on the node, 0 picks a free one.
+func ListenPacket(node *Node, port uint16) (*PacketConn, error) {
+	node.ports_mu.Lock()
+	defer node.ports_mu.Unlock()
+	if port == 0 {
+		for p := ephemeral_first; p <= ephemeral_last; p++ {
+			if node.ports[uint16(p)] == nil {
+				port = uint16(p)
+				break
+			}
+		}
+	}
+	if port == 0 || node.ports[port] != nil {
+		return nil, &net.OpError{Op: "listen", Net: "acoustic", Addr: &NetAddr{Node: node.Addr, Port: port}, Err: ErrPortInUse}
+	}
+	c := &PacketConn{
+		node:           node,
+		local:          &NetAddr{Node: node.Addr, Port: port},
+		queue:          make(chan datagram, datagram_queue),
+		deadline_moved: make(chan struct{}),
+		closed:         make(chan struct{}),
+	}
+	node.Mux.Handle(TypeData, node.on_datagram)
+	node.ports[port] = c
+	return c, nil
+}
+
+// MaxDatagram is the most one WriteTo carries.
+func (c *PacketConn) MaxDatagram() int {
+	return c.node.MaxPayload() - DatagramHeaderLen
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			// whatever the deadline says
+			return 0, nil, c.op_error("read", nil, net.ErrClosed)
+		default:
+		}
+		c.mu.Lock()
+		deadline, moved := c.read_deadline, c.deadline_moved
+		c.mu.Unlock()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+		var d datagram
+		var err error
+		again := false
+		select {
+		case d = <-c.queue:
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-moved:
+			again = true
+		case <-c.closed:
+			err = net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if again {
+			continue
+		}
+		if err != nil {
+			return 0, nil, c.op_error("read", nil, err)
+		}
+		// what doesn't fit is lost, as with UDP
+		return copy(b, d.data), d.from, nil
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.op_error("write", addr, net.ErrClosed)
+	default:
+	}
+	to, ok := addr.(*NetAddr)
+	if !ok {
+		var err error
+		if to, err = ResolveAddr(addr.String()); err != nil {
+			return 0, c.op_error("write", addr, err)
+		}
+	}
+	if len(b) > c.MaxDatagram() {
+		return 0, c.op_error("write", addr, ErrDatagramTooLong)
+	}
+	payload := make([]byte, DatagramHeaderLen, DatagramHeaderLen+len(b))
+	binary.BigEndian.PutUint16(payload, to.Port)
+	binary.BigEndian.PutUint16(payload[2:], c.local.Port)
+	payload = append(payload, b...)
+
+	c.mu.Lock()
+	deadline := c.write_deadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, c.op_error("write", addr, os.ErrDeadlineExceeded)
+	}
+	if err := c.node.SendBefore(Frame{Dst: to.Node, Type: TypeData, Payload: payload}, deadline); err != nil {
+		return 0, c.op_error("write", addr, err)
+	}
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	err := net.ErrClosed
+	c.close_once.Do(func() {
+		close(c.closed)
+		c.node.ports_mu.Lock()
+		delete(c.node.ports, c.local.Port)
+		c.node.ports_mu.Unlock()
+		err = nil
+	})
+	if err != nil {
+		return c.op_error("close", nil, err)
+	}
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read_deadline = t
+	close(c.deadline_moved)
+	c.deadline_moved = make(chan struct{})
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write_deadline = t
+	return nil
+}
+
+func (c *PacketConn) op_error(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: "acoustic", Source: c.local, Addr: addr, Err: err}
+}
+
+func (n *Node) on_datagram(f Frame) {
+	if len(f.Payload) < DatagramHeaderLen {
+		n.Logger.Info(EvLinkDropped, "reason", "short datagram", "frame", f.String())
+		return
+	}
+	port := binary.BigEndian.Uint16(f.Payload)
+	n.ports_mu.Lock()
+	c := n.ports[port]
+	n.ports_mu.Unlock()
+	if c == nil {
+		n.Logger.Debug(EvLinkDropped, "reason", "port closed", "port", port, "frame", f.String())
+		return
+	}
+	d := datagram{
+		data: f.Payload[DatagramHeaderLen:],
+		from: &NetAddr{Node: f.Src, Port: binary.BigEndian.Uint16(f.Payload[2:])},
+	}
+	select {
+	case c.queue <- d:
+	default:
+		n.Logger.Warn(EvLinkDropped, "reason", "port queue full", "port", port, "frame", f.String())
+	}
+}
@@ -0,0 +1,144 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"audio"
+	"modem"
+)
+
+// test_nodes starts a node for every address, all on one in-memory loopback
+// as the air, so each hears the others and itself
+func test_nodes(t *testing.T, profile string, addrs ...Addr) []*Node {
+	t.Helper()
+	return configured_nodes(t, profile, nil, addrs...)
+}
+
+// configured_nodes is test_nodes with configure run on every node before it
+// starts
+func configured_nodes(t *testing.T, profile string, configure func(n *Node), addrs ...Addr) []*Node {
+	t.Helper()
+	p, err := modem.LookupProfile(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	air := audio.NewLoopback(512, p.SampleRate)
+	t.Cleanup(func() { air.Close() })
+	nodes := []*Node{}
+	for _, addr := range addrs {
+		n := NewNode(addr, p, air, air)
+		if configure != nil {
+			configure(n)
+		}
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { n.Close() })
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func TestPacketConn(t *testing.T) {
+	nodes := test_nodes(t, "ack", 1, 2)
+	a, err := ListenPacket(nodes[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := ListenPacket(nodes[1], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err := ListenPacket(nodes[1], 7); !errors.Is(err, ErrPortInUse) {
+		t.Fatalf("second listener on port 7: %v, want ErrPortInUse", err)
+	}
+
+	sent := []byte("hello over the air")
+	if _, err := a.WriteTo(sent, &NetAddr{Node: 2, Port: 7}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	b.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, from, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], sent) {
+		t.Errorf("read %q, sent %q", buf[:n], sent)
+	}
+	if from.String() != a.LocalAddr().String() {
+		t.Errorf("from %v, want %v", from, a.LocalAddr())
+	}
+
+	// and the answer back to where it came from
+	if _, err := b.WriteTo(buf[:n], from); err != nil {
+		t.Fatal(err)
+	}
+	a.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, _, err = a.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], sent) {
+		t.Errorf("echo %q, sent %q", buf[:n], sent)
+	}
+}
+
+func TestPacketConnDeadline(t *testing.T) {
+	nodes := test_nodes(t, "ack", 1)
+	c, err := ListenPacket(nodes[0], 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := c.ReadFrom(make([]byte, 8)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read past the deadline: %v, want os.ErrDeadlineExceeded", err)
+	}
+	if _, err := c.WriteTo(make([]byte, c.MaxDatagram()+1), &NetAddr{Node: 2, Port: 9}); !errors.Is(err, ErrDatagramTooLong) {
+		t.Errorf("write over MaxDatagram: %v, want ErrDatagramTooLong", err)
+	}
+	c.Close()
+	if _, _, err := c.ReadFrom(make([]byte, 8)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("read after Close: %v, want net.ErrClosed", err)
+	}
+}
+
+// with an echo canceller on, the node still hears everyone but itself
+func TestPacketConnEcho(t *testing.T) {
+	nodes := configured_nodes(t, "burst", func(n *Node) {
+		n.Echo = modem.NewEchoCanceller(n.Profile, 256, 0.5)
+	}, 1, 2)
+	a, err := ListenPacket(nodes[0], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ListenPacket(nodes[1], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	for _, c := range []struct {
+		from, to *PacketConn
+		node     Addr
+	}{{a, b, 2}, {b, a, 1}} {
+		sent := []byte("over the echo")
+		if _, err := c.from.WriteTo(sent, &NetAddr{Node: c.node, Port: 7}); err != nil {
+			t.Fatal(err)
+		}
+		c.to.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, _, err := c.to.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], sent) {
+			t.Errorf("node %v read %q, sent %q", c.node, buf[:n], sent)
+		}
+	}
+}
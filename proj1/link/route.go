@@ -0,0 +1,506 @@
+package link
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A frame for a node out of earshot goes hop by hop, each relay passing it to
+// the next one its routes say. Such a frame has FlagRouted, its link Dst and
+// Src are the hop's, and its payload is behind a route header
+//
+//	origin  1 byte, who sent it first
+//	target  1 byte, who it's for in the end
+//	ttl     1 byte, hops it may still take
+//	flags   1 byte, route_ack_wanted
+//	seq     2 bytes, origin's, the same on every hop and retransmission
+//	data
+//
+// Every hop is acked by whoever it was for (a hop_ack control frame) once it
+// has taken the frame, to hand over or pass on, and played again until it is,
+// air being as lossy as it is. A relay passes a
+// frame on once however often it hears it. The target acks back to the
+// origin as well when asked to, see SendAcked.
+const FlagRouted = 1 << 4
+
+const RouteHeaderLen = 6
+
+const route_ack_wanted = 1 << 0
+
+// hops a routed frame may take, and the most hops a route may have
+const route_ttl = 8
+
+// Control frames (TypeControl) start with their kind
+//
+//	hop_ack  origin 1 byte, seq 2 bytes, of the routed frame heard
+//	end_ack  seq 2 bytes, routed back to the origin
+//	beacon   valid_for 2 bytes of seconds, then target 1 byte, via 1 byte
+//	         and hops 1 byte for every node the sender has a route to
+const (
+	ctl_hop_ack = 1
+	ctl_end_ack = 2
+	ctl_beacon  = 3
+)
+
+const (
+	// plays of a hop before giving up on it, 802.11 gives up after as many
+	hop_retries = 7
+	// on top of the ack's airtime for the next hop to get round to it
+	hop_slack = 500 * time.Millisecond
+	// the longest wait for an ack, in hop timeouts
+	hop_backoff = 4
+	// how long a relay remembers having passed a frame on
+	route_seen_for = 2 * time.Minute
+	// routes to an origin learned from the frames it sends
+	reverse_route_for = 5 * time.Minute
+	// beacons are taken to hold for this many of their intervals
+	beacon_lifetimes = 3
+)
+
+// Events of routing.
+const (
+	EvLinkForwarded = "link_forwarded"
+	EvLinkRetried   = "link_retried"
+	EvRouteLearned  = "route_learned"
+)
+
+var (
+	ErrNoHopAck = errors.New("link: next hop didn't ack")
+	ErrNoAck    = errors.New("link: target didn't ack")
+	ErrRoute    = errors.New("link: bad route")
+	ErrNoRoutes = errors.New("link: node has no route table")
+	// beacons say how long they hold in whole seconds
+	ErrBeaconInterval = errors.New("link: beacon interval under a second")
+)
+
+// Route says frames for Target go to Via, Hops away from Target.
+type Route struct {
+	Target Addr
+	Via    Addr
+	Hops   int
+	// learned routes are gone by then, static ones have none
+	Expires time.Time
+}
+
+func (r Route) Static() bool {
+	return r.Expires.IsZero()
+}
+
+func (r Route) String() string {
+	kind := "static"
+	if !r.Static() {
+		kind = "learned"
+	}
+	return fmt.Sprintf("%v via %v, %d hops, %s", r.Target, r.Via, r.Hops, kind)
+}
+
+// ParseRoute reads "target:via" or "target:via:hops", as -route flags give it.
+func ParseRoute(s string) (Route, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Route{}, fmt.Errorf("%w: %q, want target:via[:hops]", ErrRoute, s)
+	}
+	nums := []int{}
+	for _, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 || v > 0xff {
+			return Route{}, fmt.Errorf("%w: %q", ErrRoute, s)
+		}
+		nums = append(nums, v)
+	}
+	r := Route{Target: Addr(nums[0]), Via: Addr(nums[1]), Hops: 2}
+	if r.Target == r.Via {
+		r.Hops = 1
+	}
+	if len(nums) == 3 {
+		r.Hops = nums[2]
+	}
+	if r.Hops < 1 || r.Hops > route_ttl {
+		return Route{}, fmt.Errorf("%w: %q, hops from 1 to %d", ErrRoute, s, route_ttl)
+	}
+	return r, nil
+}
+
+// RouteTable is a node's routes, the ones it's given and the ones it learns
+// from beacons and from routed frames passing through.
+type RouteTable struct {
+	mu     sync.Mutex
+	routes map[Addr]Route
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{routes: map[Addr]Route{}}
+}
+
+// Add puts in a static route, replacing any to the same target.
+func (t *RouteTable) Add(r Route) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r.Expires = time.Time{}
+	t.routes[r.Target] = r
+}
+
+func (t *RouteTable) Lookup(target Addr) (Route, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.routes[target]
+	if ok && !r.Static() && time.Now().After(r.Expires) {
+		delete(t.routes, target)
+		return Route{}, false
+	}
+	return r, ok
+}
+
+// Routes is every route still good, by target.
+func (t *RouteTable) Routes() []Route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := []Route{}
+	now := time.Now()
+	for target, r := range t.routes {
+		if !r.Static() && now.After(r.Expires) {
+			delete(t.routes, target)
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Target < out[j].Target })
+	return out
+}
+
+// learn takes a route unless a static one or a shorter one is in the way;
+// the same way again, or any way once the old one's run out, only refreshes
+func (t *RouteTable) learn(r Route) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.routes[r.Target]
+	if ok && (old.Static() || old.Via != r.Via && old.Hops < r.Hops && time.Now().Before(old.Expires)) {
+		return false
+	}
+	t.routes[r.Target] = r
+	return !ok || old.Via != r.Via || old.Hops != r.Hops
+}
+
+type route_key struct {
+	origin Addr
+	seq    uint16
+}
+
+// ack_key is what a waiter waits for: an ack of key, and only from the node
+// it asked, not from anyone who happens to ack the same origin and seq
+type ack_key struct {
+	from Addr
+	route_key
+}
+
+type route_header struct {
+	origin Addr
+	target Addr
+	ttl    uint8
+	flags  uint8
+	seq    uint16
+}
+
+func (h route_header) wrap(f Frame) Frame {
+	payload := []byte{byte(h.origin), byte(h.target), h.ttl, h.flags}
+	payload = binary.BigEndian.AppendUint16(payload, h.seq)
+	f.Flags |= FlagRouted
+	f.Payload = append(payload, f.Payload...)
+	return f
+}
+
+func parse_route_header(b []byte) (route_header, []byte, bool) {
+	if len(b) < RouteHeaderLen {
+		return route_header{}, nil, false
+	}
+	return route_header{
+		origin: Addr(b[0]),
+		target: Addr(b[1]),
+		ttl:    b[2],
+		flags:  b[3],
+		seq:    binary.BigEndian.Uint16(b[4:]),
+	}, b[RouteHeaderLen:], true
+}
+
+// route is where a frame for dst goes, when not straight to it
+func (n *Node) route(dst Addr) (Route, bool) {
+	if n.Routes == nil || dst == Broadcast || dst == n.Addr {
+		return Route{}, false
+	}
+	return n.Routes.Lookup(dst)
+}
+
+// SendAcked sends f routed, or straight to f.Dst when Routes has no way
+// there, and returns once f.Dst says it has it, with ErrNoAck if that takes
+// longer than timeout.
+func (n *Node) SendAcked(f Frame, timeout time.Duration) error {
+	f.Src = n.Addr
+	via := f.Dst
+	if r, ok := n.route(f.Dst); ok {
+		via = r.Via
+	}
+	seq := uint16(n.route_seq.Add(1))
+	key := ack_key{from: f.Dst, route_key: route_key{origin: n.Addr, seq: seq}}
+	acked := make(chan struct{}, 1)
+	n.route_mu.Lock()
+	n.end_waiters[key] = acked
+	n.route_mu.Unlock()
+	defer func() {
+		n.route_mu.Lock()
+		delete(n.end_waiters, key)
+		n.route_mu.Unlock()
+	}()
+
+	started := time.Now()
+	h := route_header{origin: n.Addr, target: f.Dst, ttl: route_ttl, flags: route_ack_wanted, seq: seq}
+	if err := n.hop(h.wrap(f), h, via, time.Time{}); err != nil {
+		return err
+	}
+	select {
+	case <-acked:
+		return nil
+	case <-time.After(timeout - time.Since(started)):
+		return ErrNoAck
+	}
+}
+
+func (n *Node) send_routed(f Frame, via Addr, deadline time.Time) error {
+	h := route_header{origin: n.Addr, target: f.Dst, ttl: route_ttl, seq: uint16(n.route_seq.Add(1))}
+	return n.hop(h.wrap(f), h, via, deadline)
+}
+
+// hop plays a routed frame to via until via acks it
+func (n *Node) hop(f Frame, h route_header, via Addr, deadline time.Time) error {
+	key := ack_key{from: via, route_key: route_key{origin: h.origin, seq: h.seq}}
+	acked := make(chan struct{}, 1)
+	n.route_mu.Lock()
+	n.hop_waiters[key] = acked
+	n.route_mu.Unlock()
+	defer func() {
+		n.route_mu.Lock()
+		delete(n.hop_waiters, key)
+		n.route_mu.Unlock()
+	}()
+
+	f.Src, f.Dst = n.Addr, via
+	base := n.hop_timeout()
+	timeout := base
+	for try := 0; try <= hop_retries; try++ {
+		if try > 0 {
+			n.Logger.Info(EvLinkRetried, "frame", f.String(), "origin", h.origin.String(), "target", h.target.String(), "seq", h.seq, "try", try)
+			// two relays that keep missing each other's acks shouldn't
+			// keep talking over them
+			timeout = min(timeout+time.Duration(rand.Int63n(int64(timeout))), hop_backoff*base)
+		}
+		if err := n.transmit(f, deadline); err != nil {
+			return err
+		}
+		deadline = time.Time{}
+		select {
+		case <-acked:
+			return nil
+		case <-time.After(timeout):
+		case <-n.done:
+			return ErrNoHopAck
+		}
+	}
+	return ErrNoHopAck
+}
+
+// hop_timeout is how long the next hop gets to ack: the ack's airtime, twice
+// in case someone's talking, and some time to get round to it
+func (n *Node) hop_timeout() time.Duration {
+	ack := 1 + 1 + 2
+	if n.Crypt != nil {
+		ack += SealOverhead
+	}
+	return 2*frame_airtime(n.Profile, ack) + hop_slack
+}
+
+// on_routed takes a routed frame addressed to us: decides whether it's ours
+// or goes on, acks the hop only then, and hands it over or passes it on. One
+// we won't take goes unacked, so the last hop knows it didn't get through.
+func (n *Node) on_routed(f Frame) {
+	h, data, ok := parse_route_header(f.Payload)
+	if !ok {
+		n.Logger.Info(EvLinkDropped, "reason", "short route header", "frame", f.String())
+		return
+	}
+	ack := []byte{ctl_hop_ack, byte(h.origin)}
+	ack = binary.BigEndian.AppendUint16(ack, h.seq)
+	send_ack := func() {
+		n.transmit(Frame{Src: n.Addr, Dst: f.Src, Type: TypeControl, Payload: ack}, time.Time{})
+	}
+
+	key := route_key{origin: h.origin, seq: h.seq}
+	now := time.Now()
+	n.route_mu.Lock()
+	_, seen := n.seen[key]
+	n.route_mu.Unlock()
+	if seen {
+		// taken before, our ack must have been lost
+		go send_ack()
+		return
+	}
+
+	var r Route
+	if h.target != n.Addr {
+		var reason string
+		r, ok = n.route(h.target)
+		switch {
+		case !n.Relay:
+			reason = "not relaying"
+		case h.ttl <= 1:
+			reason = "ttl exceeded"
+		case !ok:
+			reason = "no route"
+		case r.Via == f.Src:
+			reason = "route leads back"
+		}
+		if reason != "" {
+			n.Logger.Info(EvLinkDropped, "reason", reason, "frame", f.String(), "target", h.target.String())
+			return
+		}
+	}
+
+	n.route_mu.Lock()
+	for k, at := range n.seen {
+		if now.Sub(at) > route_seen_for {
+			delete(n.seen, k)
+		}
+	}
+	n.seen[key] = now
+	n.route_mu.Unlock()
+	if n.Routes != nil && h.origin != n.Addr {
+		// the way back is the way it came
+		n.Routes.learn(Route{Target: h.origin, Via: f.Src, Hops: route_ttl - int(h.ttl) + 1, Expires: now.Add(reverse_route_for)})
+	}
+
+	go func() {
+		// the ack goes before anything we pass on, or the last hop would
+		// be kept waiting for it behind our own frame
+		send_ack()
+		if h.target == n.Addr {
+			n.deliver_routed(f, h, data)
+			return
+		}
+		h.ttl--
+		out := h.wrap(Frame{Flags: f.Flags &^ FlagRouted, Type: f.Type, Payload: data})
+		n.Logger.Debug(EvLinkForwarded, "frame", f.String(), "origin", h.origin.String(), "target", h.target.String(), "via", r.Via.String(), "ttl", h.ttl)
+		if err := n.hop(out, h, r.Via, time.Time{}); err != nil {
+			n.Logger.Info(EvLinkDropped, "reason", err.Error(), "origin", h.origin.String(), "target", h.target.String(), "via", r.Via.String())
+		}
+	}()
+}
+
+// deliver_routed hands a routed frame for us to Mux, and acks it back to the
+// origin when asked to
+func (n *Node) deliver_routed(f Frame, h route_header, data []byte) {
+	inner := Frame{Flags: f.Flags &^ FlagRouted, Dst: h.target, Src: h.origin, Type: f.Type, Payload: data}
+	if h.flags&route_ack_wanted != 0 {
+		end := binary.BigEndian.AppendUint16([]byte{ctl_end_ack}, h.seq)
+		via := f.Src
+		if r, ok := n.route(h.origin); ok {
+			via = r.Via
+		}
+		go n.send_routed(Frame{Src: n.Addr, Dst: h.origin, Type: TypeControl, Payload: end}, via, time.Time{})
+	}
+	if !n.Mux.Dispatch(inner) {
+		n.Logger.Debug(EvLinkDropped, "reason", "no handler", "frame", inner.String())
+	}
+}
+
+func (n *Node) on_control(f Frame) {
+	if len(f.Payload) == 0 {
+		return
+	}
+	body := f.Payload[1:]
+	switch f.Payload[0] {
+	case ctl_hop_ack:
+		if len(body) < 3 {
+			return
+		}
+		wake(n, n.hop_waiters, ack_key{from: f.Src, route_key: route_key{origin: Addr(body[0]), seq: binary.BigEndian.Uint16(body[1:])}})
+	case ctl_end_ack:
+		if len(body) < 2 {
+			return
+		}
+		// came routed, so f.Src is the target that got it, not the last hop
+		wake(n, n.end_waiters, ack_key{from: f.Src, route_key: route_key{origin: n.Addr, seq: binary.BigEndian.Uint16(body)}})
+	case ctl_beacon:
+		if len(body) < 2 || n.Routes == nil {
+			return
+		}
+		expires := time.Now().Add(time.Duration(binary.BigEndian.Uint16(body)) * time.Second)
+		n.learn(Route{Target: f.Src, Via: f.Src, Hops: 1, Expires: expires})
+		for i := 2; i+2 < len(body); i += 3 {
+			target, via, hops := Addr(body[i]), Addr(body[i+1]), int(body[i+2])+1
+			// a route through us is no way for us, taking it would have
+			// the two of us count up to route_ttl when it goes
+			if target != n.Addr && via != n.Addr && hops <= route_ttl {
+				n.learn(Route{Target: target, Via: f.Src, Hops: hops, Expires: expires})
+			}
+		}
+	}
+}
+
+func (n *Node) learn(r Route) {
+	if n.Routes.learn(r) {
+		n.Logger.Info(EvRouteLearned, "route", r.String())
+	}
+}
+
+func wake[K comparable](n *Node, waiters map[K]chan struct{}, key K) {
+	n.route_mu.Lock()
+	defer n.route_mu.Unlock()
+	if w := waiters[key]; w != nil {
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Beacon tells everyone in earshot every interval which nodes we have routes
+// to, so they learn routes through us; Routes has to be set on both ends, and
+// the interval a second or more. It stops with Close.
+func (n *Node) Beacon(interval time.Duration) error {
+	if n.Routes == nil {
+		return ErrNoRoutes
+	}
+	if interval < time.Second {
+		return ErrBeaconInterval
+	}
+	valid_for := min((beacon_lifetimes*interval+time.Second-1)/time.Second, 0xffff)
+	go func() {
+		wait := time.Duration(0)
+		for {
+			// two nodes started together shouldn't keep beaconing over
+			// each other
+			wait += time.Duration(rand.Int63n(int64(interval/5) + 1))
+			select {
+			case <-time.After(wait):
+			case <-n.done:
+				return
+			}
+			payload := binary.BigEndian.AppendUint16([]byte{ctl_beacon}, uint16(valid_for))
+			for _, r := range n.Routes.Routes() {
+				if r.Hops < route_ttl {
+					payload = append(payload, byte(r.Target), byte(r.Via), byte(r.Hops))
+				}
+			}
+			if err := n.transmit(Frame{Src: n.Addr, Dst: Broadcast, Type: TypeControl, Payload: payload}, time.Time{}); err != nil {
+				n.Logger.Warn(EvLinkDropped, "reason", err.Error(), "frame", "beacon")
+			}
+			wait = interval
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,118 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// nodes 1 and 3 go through 2; the loopback has everyone in earshot, but
+// frames to the next hop aren't for anyone else
+func relayed_nodes(t *testing.T, relay bool) []*Node {
+	return configured_nodes(t, "burst", func(n *Node) {
+		n.Routes = NewRouteTable()
+		switch n.Addr {
+		case 1:
+			n.Routes.Add(Route{Target: 3, Via: 2, Hops: 2})
+		case 2:
+			n.Routes.Add(Route{Target: 3, Via: 3, Hops: 1})
+			n.Routes.Add(Route{Target: 1, Via: 1, Hops: 1})
+			n.Relay = relay
+		case 3:
+			n.Routes.Add(Route{Target: 1, Via: 2, Hops: 2})
+		}
+	}, 1, 2, 3)
+}
+
+func TestRelay(t *testing.T) {
+	nodes := relayed_nodes(t, true)
+	to, err := ListenPacket(nodes[2], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := ListenPacket(nodes[0], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := []byte("two hops")
+	if _, err := from.WriteTo(sent, &NetAddr{Node: 3, Port: 7}); err != nil {
+		t.Fatal(err)
+	}
+	to.SetReadDeadline(time.Now().Add(30 * time.Second))
+	buf := make([]byte, 64)
+	n, addr, err := to.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], sent) || addr.String() != "1:7" {
+		t.Errorf("read %q from %v, sent %q from 1:7", buf[:n], addr, sent)
+	}
+}
+
+// a relay that won't pass a frame on doesn't ack it either, so the sender
+// never hears it got through
+func TestRelayOffNoAck(t *testing.T) {
+	nodes := relayed_nodes(t, false)
+	to, err := ListenPacket(nodes[2], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan error, 1)
+	go func() {
+		sent <- nodes[0].Send(Frame{Dst: 3, Type: TypeData, Payload: []byte{0, 7, 0, 7, 1}})
+	}()
+	// plenty for the relay to have acked, were it going to
+	select {
+	case err := <-sent:
+		t.Fatalf("send returned %v with the relay off", err)
+	case <-time.After(3 * time.Second):
+	}
+	nodes[0].Close()
+	if err := <-sent; !errors.Is(err, ErrNoHopAck) {
+		t.Errorf("send: %v, want ErrNoHopAck", err)
+	}
+	to.SetReadDeadline(time.Now())
+	if _, _, err := to.ReadFrom(make([]byte, 8)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("target read %v, want nothing", err)
+	}
+}
+
+func TestBeaconArgs(t *testing.T) {
+	nodes := test_nodes(t, "burst", 1)
+	if err := nodes[0].Beacon(time.Second); !errors.Is(err, ErrNoRoutes) {
+		t.Errorf("beacon without routes: %v, want ErrNoRoutes", err)
+	}
+	nodes = relayed_nodes(t, true)
+	if err := nodes[0].Beacon(100 * time.Millisecond); !errors.Is(err, ErrBeaconInterval) {
+		t.Errorf("beacon every 100ms: %v, want ErrBeaconInterval", err)
+	}
+}
+
+// an ack only counts from the node that was asked, whoever else sends one for
+// the same origin and seq
+func TestAckFrom(t *testing.T) {
+	n := test_nodes(t, "burst", 1)[0]
+	hop := make(chan struct{}, 1)
+	end := make(chan struct{}, 1)
+	n.route_mu.Lock()
+	n.hop_waiters[ack_key{from: 2, route_key: route_key{origin: 1, seq: 5}}] = hop
+	n.end_waiters[ack_key{from: 3, route_key: route_key{origin: 1, seq: 5}}] = end
+	n.route_mu.Unlock()
+
+	hop_ack := Frame{Dst: 1, Type: TypeControl, Payload: []byte{ctl_hop_ack, 1, 0, 5}}
+	end_ack := Frame{Dst: 1, Type: TypeControl, Payload: []byte{ctl_end_ack, 0, 5}}
+	hop_ack.Src, end_ack.Src = 4, 4
+	n.on_control(hop_ack)
+	n.on_control(end_ack)
+	if len(hop) != 0 || len(end) != 0 {
+		t.Fatalf("woken by acks from 4: hop %d, end %d", len(hop), len(end))
+	}
+	hop_ack.Src, end_ack.Src = 2, 3
+	n.on_control(hop_ack)
+	n.on_control(end_ack)
+	if len(hop) != 1 || len(end) != 1 {
+		t.Errorf("acks from 2 and 3 woke hop %d, end %d", len(hop), len(end))
+	}
+}
@@ -0,0 +1,800 @@
+package link
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Conn is a reliable byte stream between two ports, TCP's ideas on top of
+// PacketConn datagrams. Every datagram is a segment
+//
+//	flags   1 byte, seg_syn | seg_ack | seg_fin | seg_rst
+//	seq     4 bytes
+//	ack     4 bytes
+//	window  2 bytes, room left in the sender's receive buffer
+//	data
+//
+// with a three way handshake, cumulative acks, go-back-N retransmission and
+// the receiver's window for flow control. The air is half duplex, the other
+// end can't answer while we're still talking, so the retransmission timer
+// runs from when our last segment was done playing rather than from when it
+// was handed over.
+const (
+	seg_syn = 1 << 0
+	seg_ack = 1 << 1
+	seg_fin = 1 << 2
+	seg_rst = 1 << 3
+)
+
+const segment_header = 11
+
+const (
+	// data in one segment unless the profile's frames are smaller, a lost
+	// one costs its whole airtime again
+	stream_mss = 256
+	// of each direction, unread data on one side and unacked data on the other
+	stream_buffer = 16 << 10
+	// segments sent before waiting for an ack, whatever the window
+	stream_flight_segments = 4
+	// acks wait this long for more segments or for data to ride along with
+	stream_ack_delay = 100 * time.Millisecond
+	// retransmissions of one segment before giving up on the stream
+	stream_retries = 6
+	stream_max_rto = time.Minute
+	// a closed stream still answers a retransmitted FIN for this long
+	stream_time_wait = 30 * time.Second
+	// streams waiting for Accept before new ones are refused
+	stream_backlog = 16
+)
+
+var (
+	ErrConnRefused = errors.New("link: connection refused")
+	ErrConnReset   = errors.New("link: connection reset by peer")
+	ErrConnTimeout = errors.New("link: connection timed out")
+)
+
+type segment struct {
+	flags  uint8
+	seq    uint32
+	ack    uint32
+	window uint16
+	data   []byte
+}
+
+func (s segment) marshal() []byte {
+	out := []byte{s.flags}
+	out = binary.BigEndian.AppendUint32(out, s.seq)
+	out = binary.BigEndian.AppendUint32(out, s.ack)
+	out = binary.BigEndian.AppendUint16(out, s.window)
+	return append(out, s.data...)
+}
+
+func parse_segment(b []byte) (segment, bool) {
+	if len(b) < segment_header {
+		return segment{}, false
+	}
+	return segment{
+		flags:  b[0],
+		seq:    binary.BigEndian.Uint32(b[1:]),
+		ack:    binary.BigEndian.Uint32(b[5:]),
+		window: binary.BigEndian.Uint16(b[9:]),
+		data:   append([]byte{}, b[segment_header:]...),
+	}, true
+}
+
+// sequence numbers wrap, compare them by distance
+func seq_lt(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seq_le(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// endpoint is a PacketConn and the streams on it, one for a dialled stream,
+// any number for a listener
+type endpoint struct {
+	pc       *PacketConn
+	node     *Node
+	mu       sync.Mutex
+	conns    map[string]*Conn
+	listener *Listener
+}
+
+func (e *endpoint) read_loop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, from, err := e.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		seg, ok := parse_segment(buf[:n])
+		if !ok {
+			continue
+		}
+		remote := from.(*NetAddr)
+		e.mu.Lock()
+		c := e.conns[remote.String()]
+		if c == nil && seg.flags == seg_syn && e.listener != nil && e.listener.accepting() && e.listener.has_room() {
+			c = new_conn(e, remote)
+			c.rcv_nxt = seg.seq + 1
+			c.state = state_syn_received
+			c.ack_now = true
+			e.conns[remote.String()] = c
+			go c.run()
+		}
+		e.mu.Unlock()
+		if c == nil {
+			e.refuse(remote, seg)
+			continue
+		}
+		c.on_segment(seg)
+	}
+}
+
+// refuse answers a segment for a stream we don't have: a FIN gets its ack so
+// the other end can finish closing, anything else a reset
+func (e *endpoint) refuse(remote *NetAddr, seg segment) {
+	if seg.flags&seg_rst != 0 {
+		return
+	}
+	reply := segment{flags: seg_rst | seg_ack, seq: seg.ack, ack: seg.seq + uint32(len(seg.data))}
+	if seg.flags&seg_syn != 0 {
+		reply.ack++
+	}
+	if seg.flags&seg_fin != 0 {
+		reply = segment{flags: seg_ack, seq: seg.ack, ack: seg.seq + uint32(len(seg.data)) + 1}
+	}
+	// off the read loop, it takes a whole frame
+	go e.pc.WriteTo(reply.marshal(), remote)
+}
+
+func (e *endpoint) release(c *Conn) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conns[c.remote.String()] == c {
+		delete(e.conns, c.remote.String())
+	}
+	if len(e.conns) == 0 && (e.listener == nil || !e.listener.accepting()) {
+		e.pc.Close()
+	}
+}
+
+const (
+	state_syn_sent = iota
+	state_syn_received
+	state_established
+	state_closed
+)
+
+var _ net.Conn = (*Conn)(nil)
+
+type Conn struct {
+	e      *endpoint
+	remote *NetAddr
+
+	mu sync.Mutex
+	// closed and replaced on every change of state, for whoever waits on it
+	changed chan struct{}
+	state   int
+	err     error
+
+	// sending: buf holds everything from buf_seq on that isn't acked yet,
+	// sent or not; the SYN takes up isn and the FIN the seq after the data
+	isn         uint32
+	una         uint32
+	nxt         uint32
+	high        uint32
+	buf         []byte
+	buf_seq     uint32
+	fin_queued  bool
+	fin_acked   bool
+	peer_window int
+	mss         int
+	sent_at     time.Time
+	rto         time.Duration
+	min_rto     time.Duration
+	srtt        time.Duration
+	rttvar      time.Duration
+	retries     int
+	// the seq whose ack gives the next round trip sample, and when the
+	// segment before it was done
+	timing    bool
+	timed_seq uint32
+	timed_at  time.Time
+
+	// receiving
+	rcv_nxt       uint32
+	recv          []byte
+	fin_received  bool
+	read_closed   bool
+	ack_now       bool
+	ack_due       time.Time
+	window_closed bool
+
+	read_deadline  time.Time
+	write_deadline time.Time
+}
+
+func new_conn(e *endpoint, remote *NetAddr) *Conn {
+	isn := rand.Uint32()
+	mss := min(stream_mss, e.pc.MaxDatagram()-segment_header)
+	// a round trip is at least a full segment one way and an ack the other
+	min_rto := e.node.Airtime(DatagramHeaderLen+segment_header+mss) + e.node.Airtime(DatagramHeaderLen+segment_header) + stream_ack_delay
+	return &Conn{
+		e:           e,
+		remote:      remote,
+		changed:     make(chan struct{}),
+		isn:         isn,
+		una:         isn,
+		nxt:         isn,
+		high:        isn,
+		buf_seq:     isn + 1,
+		peer_window: mss,
+		mss:         mss,
+		rto:         2 * min_rto,
+		min_rto:     min_rto,
+	}
+}
+
+// Listen takes streams on port of the node.
+func Listen(node *Node, port uint16) (*Listener, error) {
+	pc, err := ListenPacket(node, port)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listener{accept: make(chan *Conn, stream_backlog), closed: make(chan struct{})}
+	l.e = &endpoint{pc: pc, node: node, conns: map[string]*Conn{}, listener: l}
+	go l.e.read_loop()
+	return l, nil
+}
+
+// Dial opens a stream from a free port of the node to addr, and returns once
+// the other end has taken it. A port nobody listens on says nothing back, so
+// that's ErrConnTimeout after the retries rather than ErrConnRefused; a
+// listener with a full backlog refuses.
+func Dial(node *Node, addr *NetAddr) (*Conn, error) {
+	return DialContext(context.Background(), node, addr)
+}
+
+// DialContext is Dial giving up when ctx is done before the other end has
+// taken the stream, with ctx's error.
+func DialContext(ctx context.Context, node *Node, addr *NetAddr) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "acoustic", Addr: addr, Err: err}
+	}
+	pc, err := ListenPacket(node, 0)
+	if err != nil {
+		return nil, err
+	}
+	e := &endpoint{pc: pc, node: node, conns: map[string]*Conn{}}
+	c := new_conn(e, addr)
+	c.state = state_syn_sent
+	e.conns[addr.String()] = c
+	go e.read_loop()
+	go c.run()
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.state == state_syn_sent {
+			c.fail(ctx.Err())
+		}
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wait(time.Time{}, func() bool { return c.state != state_syn_sent })
+	if c.state != state_established {
+		return nil, c.op_error("dial", c.err)
+	}
+	return c, nil
+}
+
+type Listener struct {
+	e          *endpoint
+	accept     chan *Conn
+	closed     chan struct{}
+	close_once sync.Once
+}
+
+var _ net.Listener = (*Listener)(nil)
+
+func (l *Listener) accepting() bool {
+	select {
+	case <-l.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// has_room says whether a stream set up now has a place in the backlog; one
+// that's still in its handshake may yet find it full, see on_segment
+func (l *Listener) has_room() bool {
+	return len(l.accept) < cap(l.accept)
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "acoustic", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close stops taking new streams, the ones taken carry on.
+func (l *Listener) Close() error {
+	l.close_once.Do(func() {
+		close(l.closed)
+		l.e.mu.Lock()
+		idle := len(l.e.conns) == 0
+		l.e.mu.Unlock()
+		if idle {
+			l.e.pc.Close()
+		}
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.e.pc.LocalAddr()
+}
+
+// signal wakes everyone waiting on c, c.mu held
+func (c *Conn) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait blocks, with c.mu held, until ready, the deadline or a failure
+func (c *Conn) wait(deadline time.Time, ready func() bool) error {
+	for !ready() {
+		if c.err != nil {
+			return c.err
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+		timed_out := false
+		select {
+		case <-changed:
+		case <-expired:
+			timed_out = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		c.mu.Lock()
+		if timed_out {
+			return os.ErrDeadlineExceeded
+		}
+	}
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.read_closed {
+			return 0, c.op_error("read", net.ErrClosed)
+		}
+		if len(c.recv) > 0 {
+			n := copy(b, c.recv)
+			c.recv = c.recv[n:]
+			if c.window_closed && stream_buffer-len(c.recv) >= c.mss {
+				// they're waiting to hear there's room again
+				c.ack_now = true
+				c.signal()
+			}
+			return n, nil
+		}
+		if c.fin_received {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.op_error("read", c.err)
+		}
+		deadline := c.read_deadline
+		err := c.wait(deadline, func() bool {
+			return len(c.recv) > 0 || c.fin_received || c.read_closed || c.read_deadline != deadline
+		})
+		if err != nil {
+			return 0, c.op_error("read", err)
+		}
+	}
+}
+
+// Write returns once b is queued, not when it's been heard; Close waits for
+// that.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.fin_queued {
+			return written, c.op_error("write", net.ErrClosed)
+		}
+		if c.err != nil {
+			return written, c.op_error("write", c.err)
+		}
+		if room := stream_buffer - len(c.buf); room > 0 {
+			n := min(room, len(b)-written)
+			c.buf = append(c.buf, b[written:written+n]...)
+			written += n
+			c.signal()
+			continue
+		}
+		deadline := c.write_deadline
+		err := c.wait(deadline, func() bool {
+			return len(c.buf) < stream_buffer || c.fin_queued || c.write_deadline != deadline
+		})
+		if err != nil {
+			return written, c.op_error("write", err)
+		}
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN once everything written is out, the other end reads
+// io.EOF after it; we can still read what they send.
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fin_queued {
+		return c.op_error("close", net.ErrClosed)
+	}
+	c.fin_queued = true
+	c.signal()
+	return nil
+}
+
+// Close sends a FIN once everything written is out and returns when it's
+// been acked, so nothing written is lost on the way.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.read_closed {
+		return c.op_error("close", net.ErrClosed)
+	}
+	c.read_closed = true
+	c.recv = nil
+	c.fin_queued = true
+	c.signal()
+	err := c.wait(time.Time{}, func() bool { return c.fin_acked })
+	if err != nil {
+		c.release()
+		return c.op_error("close", err)
+	}
+	// the other end may not have heard our ack of their FIN yet
+	time.AfterFunc(stream_time_wait, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.release()
+	})
+	return nil
+}
+
+// release lets go of the stream for good, c.mu held
+func (c *Conn) release() {
+	if c.state == state_closed {
+		return
+	}
+	c.state = state_closed
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.signal()
+	go c.e.release(c)
+}
+
+// fail ends the stream with err, c.mu held
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.release()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.e.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read_deadline = t
+	c.signal()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write_deadline = t
+	c.signal()
+	return nil
+}
+
+func (c *Conn) op_error(op string, err error) error {
+	return &net.OpError{Op: op, Net: "acoustic", Source: c.e.pc.LocalAddr(), Addr: c.remote, Err: err}
+}
+
+// run sends whatever's due for as long as the stream lives
+func (c *Conn) run() {
+	for {
+		c.mu.Lock()
+		if c.state == state_closed {
+			c.mu.Unlock()
+			return
+		}
+		seg, ok, wake := c.next_segment(time.Now())
+		if !ok {
+			changed := c.changed
+			c.mu.Unlock()
+			var expired <-chan time.Time
+			var timer *time.Timer
+			if !wake.IsZero() {
+				timer = time.NewTimer(time.Until(wake))
+				expired = timer.C
+			}
+			select {
+			case <-changed:
+			case <-expired:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		c.mu.Unlock()
+
+		_, err := c.e.pc.WriteTo(seg.marshal(), c.remote)
+
+		c.mu.Lock()
+		now := time.Now()
+		if seg.flags&(seg_syn|seg_fin) != 0 || len(seg.data) > 0 {
+			c.sent_at = now
+			if c.timing && c.timed_seq == seg.seq+segment_length(seg) {
+				c.timed_at = now
+			}
+		}
+		// a routed segment the next hop never took is lost like any other,
+		// it goes again
+		if err != nil && !errors.Is(err, ErrNoHopAck) {
+			c.fail(err)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// segment_length is how much sequence space a segment takes up
+func segment_length(seg segment) uint32 {
+	n := uint32(len(seg.data))
+	if seg.flags&seg_syn != 0 {
+		n++
+	}
+	if seg.flags&seg_fin != 0 {
+		n++
+	}
+	return n
+}
+
+// next_segment picks what to send now, or when to look again, c.mu held
+func (c *Conn) next_segment(now time.Time) (segment, bool, time.Time) {
+	in_flight := seq_lt(c.una, c.nxt)
+	if in_flight && now.Sub(c.sent_at) >= c.rto {
+		c.retries++
+		if c.retries > stream_retries {
+			c.fail(ErrConnTimeout)
+			return segment{}, false, time.Time{}
+		}
+		// go back to the first unacked segment and send everything after
+		// it again
+		c.nxt = c.una
+		c.rto = min(2*c.rto, stream_max_rto)
+		c.timing = false
+		in_flight = false
+	}
+
+	seg := segment{seq: c.nxt}
+	fin_seq := c.buf_seq + uint32(len(c.buf))
+	switch {
+	case c.nxt == c.isn:
+		seg.flags = seg_syn
+	case c.state == state_established:
+		limit := min(c.peer_window, stream_flight_segments*c.mss)
+		if limit == 0 && !in_flight && now.Sub(c.sent_at) >= c.rto {
+			// probe a closed window with a byte, the ack says when it opens
+			limit = 1
+		}
+		offset := int(c.nxt - c.buf_seq)
+		room := limit - int(c.nxt-c.una)
+		if n := min(len(c.buf)-offset, c.mss, room); n > 0 {
+			seg.data = c.buf[offset : offset+n]
+		}
+		if c.fin_queued && !c.fin_acked && c.nxt+uint32(len(seg.data)) == fin_seq {
+			seg.flags |= seg_fin
+		}
+	}
+
+	if segment_length(seg) == 0 {
+		if !c.ack_now && (c.ack_due.IsZero() || now.Before(c.ack_due)) {
+			wake := c.ack_due
+			if in_flight || c.peer_window == 0 && len(c.buf) > 0 {
+				if retransmit := c.sent_at.Add(c.rto); wake.IsZero() || retransmit.Before(wake) {
+					wake = retransmit
+				}
+			}
+			return segment{}, false, wake
+		}
+		if c.state == state_syn_sent {
+			// nothing to ack yet
+			c.ack_now, c.ack_due = false, time.Time{}
+			return segment{}, false, time.Time{}
+		}
+	}
+
+	if c.state != state_syn_sent {
+		seg.flags |= seg_ack
+		seg.ack = c.rcv_nxt
+	}
+	room := max(stream_buffer-len(c.recv), 0)
+	seg.window = uint16(min(room, 0xffff))
+	c.window_closed = room < c.mss
+	c.ack_now, c.ack_due = false, time.Time{}
+
+	c.nxt += segment_length(seg)
+	if seq_lt(c.high, c.nxt) {
+		c.high = c.nxt
+		if !c.timing && segment_length(seg) > 0 && c.retries == 0 {
+			c.timing, c.timed_seq, c.timed_at = true, c.nxt, time.Time{}
+		}
+	}
+	return seg, true, time.Time{}
+}
+
+// on_segment takes in what the other end sent
+func (c *Conn) on_segment(seg segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.signal()
+	if c.state == state_closed {
+		return
+	}
+	if seg.flags&seg_rst != 0 {
+		if c.state == state_syn_sent {
+			c.fail(ErrConnRefused)
+		} else {
+			c.fail(ErrConnReset)
+		}
+		return
+	}
+
+	switch c.state {
+	case state_syn_sent:
+		if seg.flags&(seg_syn|seg_ack) != seg_syn|seg_ack || seg.ack != c.isn+1 {
+			return
+		}
+		c.rcv_nxt = seg.seq + 1
+		c.state = state_established
+		c.on_ack(seg)
+		c.ack_now = true
+		return
+	case state_syn_received:
+		if seg.flags&seg_syn != 0 {
+			// they didn't hear our SYN|ACK, the timer sends it again
+			return
+		}
+		if seg.flags&seg_ack == 0 || !seq_lt(c.isn, seg.ack) {
+			return
+		}
+		c.state = state_established
+		select {
+		case c.e.listener.accept <- c:
+		default:
+			// the backlog filled up during the handshake, the other end
+			// thinks it's through so it hears of it as a reset
+			c.fail(ErrConnRefused)
+			c.e.refuse(c.remote, seg)
+			return
+		}
+	}
+
+	if seg.flags&seg_syn != 0 {
+		// a SYN|ACK again, our ack of it was lost
+		c.ack_now = true
+		return
+	}
+	if seg.flags&seg_ack != 0 {
+		c.on_ack(seg)
+	}
+	if len(seg.data) == 0 && seg.flags&seg_fin == 0 {
+		return
+	}
+	if seg.seq != c.rcv_nxt || c.fin_received {
+		// out of order or heard before, say what we're waiting for
+		c.ack_now = true
+		return
+	}
+	n := min(stream_buffer-len(c.recv), len(seg.data))
+	if !c.read_closed {
+		c.recv = append(c.recv, seg.data[:n]...)
+	}
+	c.rcv_nxt += uint32(n)
+	switch {
+	case n < len(seg.data):
+		c.ack_now = true
+	case seg.flags&seg_fin != 0:
+		c.rcv_nxt++
+		c.fin_received = true
+		c.ack_now = true
+	default:
+		c.ack_due = time.Now().Add(stream_ack_delay)
+	}
+}
+
+// on_ack moves our side along with what they've acked, c.mu held
+func (c *Conn) on_ack(seg segment) {
+	c.peer_window = int(seg.window)
+	if !seq_lt(c.una, seg.ack) || seq_lt(c.high, seg.ack) {
+		return
+	}
+	if c.timing && seq_le(c.timed_seq, seg.ack) {
+		c.timing = false
+		if !c.timed_at.IsZero() {
+			c.sample_rtt(time.Since(c.timed_at))
+		}
+	}
+	if seq_lt(c.buf_seq, seg.ack) {
+		drop := min(int(seg.ack-c.buf_seq), len(c.buf))
+		c.buf = c.buf[drop:]
+		c.buf_seq += uint32(drop)
+	}
+	if c.fin_queued && len(c.buf) == 0 && seg.ack == c.buf_seq+1 {
+		c.fin_acked = true
+	}
+	c.una = seg.ack
+	if seq_lt(c.nxt, c.una) {
+		c.nxt = c.una
+	}
+	c.retries = 0
+}
+
+// sample_rtt is RFC 6298's smoothing, c.mu held
+func (c *Conn) sample_rtt(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		diff := c.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttvar = (3*c.rttvar + diff) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = min(max(c.srtt+4*c.rttvar, c.min_rto), stream_max_rto)
+}
@@ -0,0 +1,86 @@
+package link
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	nodes := test_nodes(t, "burst", 1, 2)
+	l, err := Listen(nodes[1], 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// more than a flight of segments, so it takes a few rounds of acks; the
+	// burst profile keeps that short even under -race
+	sent := make([]byte, 2*stream_flight_segments*stream_mss+100)
+	rand.New(rand.NewSource(1)).Read(sent)
+	echoed := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			echoed <- err
+			return
+		}
+		defer c.Close()
+		_, err = io.Copy(c, c)
+		echoed <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c, err := DialContext(ctx, nodes[0], &NetAddr{Node: 2, Port: 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(2 * time.Minute))
+	if _, err := c.Write(sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Errorf("echoed %d bytes, sent %d, first difference at %d", len(got), len(sent), first_difference(got, sent))
+	}
+	if err := <-echoed; err != nil {
+		t.Errorf("echo side: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	nodes := test_nodes(t, "ack", 1)
+	// nobody listens, so nobody answers the SYN
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := DialContext(ctx, nodes[0], &NetAddr{Node: 3, Port: 80}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dial past the deadline: %v, want context.DeadlineExceeded", err)
+	}
+	if waited := time.Since(started); waited > 10*time.Second {
+		t.Errorf("dial took %v to give up", waited)
+	}
+}
+
+func first_difference(a, b []byte) int {
+	for i := 0; i < min(len(a), len(b)); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
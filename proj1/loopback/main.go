@@ -0,0 +1,309 @@
+// Runs a whole transfer in one process: the sender's preamble and data go into
+// an in-memory audio link and come out of it, in device sized chunks, into the
+// receiver. No speaker or microphone involved, so this doubles as the
+// integration check for the modem, it exits non-zero when the bits that come
+// out don't match the ones that went in.
+//
+//	loopback -input ../sender/INPUT.txt
+//	loopback -profile fast -realtime -snr 10
+//	loopback -sample-rate 44100 -device-rate 48000
+//	loopback -profile burst -bits 40 -jam 0.5
+//	loopback -profile fast -echo 3 -snr 20
+//	loopback -profile fast -channels 3 -channel 1 -neighbours
+//	loopback -profile fast -link -pcap link.pcapng
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"time"
+
+	"audio"
+	"link"
+	"modem"
+)
+
+func main() {
+	profile_name := flag.String("profile", "default", "modulation profile")
+	input := flag.String("input", "../sender/INPUT.txt", "file of 0/1 characters to send, empty sends random bits")
+	bits := flag.Int("bits", 1000, "number of random bits to send when there's no input file")
+	realtime := flag.Bool("realtime", false, "pace the link to the sample rate instead of running as fast as possible")
+	chunk := flag.Int("chunk", 512, "frames per receiver callback, like a sound card's period")
+	snr := flag.Float64("snr", math.Inf(1), "add white noise at this SNR in dB")
+	drift := flag.Float64("drift", 0, "sample clock drift between the two ends in ppm")
+	seed := flag.Int64("seed", 1, "random seed for the channel noise")
+	jam := flag.Float64("jam", 0, "add JammingWav.m style gated noise of this peak amplitude, 0 leaves it out")
+	echo := flag.Float64("echo", 0, "have the receiving node talk over the incoming frame, its echo heard at this gain relative to it")
+	aec := flag.Bool("aec", true, "cancel the receiving node's own echo")
+	aec_taps := flag.Int("aec-taps", 256, "length of the echo canceller's filter in frames, a shorter one knows the whole band from fewer of our tones")
+	aec_mu := flag.Float64("aec-mu", 0.5, "step size of the echo canceller")
+	channel_k := flag.Int("channel", 0, "channel of the link, 0 to -channels minus 1")
+	channels := flag.Int("channels", 1, "split the profile's spectrum into this many channels")
+	neighbours := flag.Bool("neighbours", false, "run a transfer of random bits on every other channel at the same time")
+	link_frame := flag.Bool("link", false, "send the bits as the payload of a link frame, padded to whole bytes")
+	pcap_path := flag.String("pcap", "", "write the frame sent and the one received to this pcapng file")
+	sample_rate := flag.Int("sample-rate", 0, "rate the modem runs at, 0 keeps the profile's")
+	device_rate := flag.Int("device-rate", 0, "rate the link runs at, both ends resample to it, 0 means the modem's")
+	timeout := flag.Duration("timeout", 0, "give up after this long, 0 picks the airtime plus a margin")
+	log_level := flag.String("log-level", "warn", "lowest event level to log: debug, info, warn or error")
+	log_format := flag.String("log-format", "json", "event log format: json or text")
+	log_output := flag.String("log-output", "-", "where events go: - for stderr, stdout, or a file path")
+	flag.Parse()
+
+	logger, log_closer, err := modem.OpenLogger(*log_level, *log_format, *log_output)
+	chk(err)
+	defer log_closer.Close()
+
+	p, err := modem.LookupProfile(*profile_name)
+	chk(err)
+	p = p.WithSampleRate(*sample_rate)
+	base := p
+	p, err = p.WithChannel(*channel_k, *channels)
+	chk(err)
+	chk(p.Validate())
+	if *channels > 1 {
+		for _, line := range base.ChannelPlan(*channels) {
+			fmt.Println(line)
+		}
+	}
+
+	message := modem.RandomBitString(*bits)
+	if *input != "" {
+		content, err := os.ReadFile(*input)
+		chk(err)
+		message = modem.ReadBitString(string(content))
+	}
+	sent := message
+	if *link_frame {
+		sent = frame_message(message)
+	}
+	packet, err := p.BuildPacket(sent)
+	chk(err)
+
+	signal := p.Transmission(packet)
+	channel := modem.NewChannel(p.SampleRate, *snr, *drift, *seed)
+	if *echo > 0 {
+		channel.Delay += echo_lead(p)
+	}
+	if *jam > 0 {
+		channel.Jammer = modem.NewJammer(p.SampleRate, *seed)
+		channel.Jammer.Level = *jam
+	}
+	captured := channel.Apply(signal)
+	if *neighbours {
+		captured = add_neighbours(base, *channel_k, *channels, captured, len(message), *snr, *seed)
+	}
+	var own []float32
+	if *echo > 0 {
+		own, captured = talk_over(p, captured, len(message), *echo, *seed)
+	}
+
+	spec := "loopback:link"
+	if *realtime {
+		spec += ",realtime"
+	}
+	cfg := audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, ChunkFrames: *chunk}
+	sink, err := audio.OpenSink(spec, cfg)
+	chk(err)
+	defer sink.Close()
+	source, err := audio.OpenSource(spec, cfg)
+	chk(err)
+	defer source.Close()
+
+	var capture *modem.PcapWriter
+	if *pcap_path != "" {
+		capture, err = modem.NewPcapWriter(*pcap_path, "loopback")
+		chk(err)
+		defer capture.Close()
+	}
+
+	frames := make(chan modem.Frame, 1)
+	receiver := modem.NewReceiver(p)
+	receiver.Logger = logger
+	receiver.OnFrame = func(f modem.Frame) {
+		select {
+		case frames <- f:
+		default:
+		}
+	}
+	if *echo > 0 && *aec {
+		canceller := modem.NewEchoCanceller(p, *aec_taps, *aec_mu)
+		// starts playing as the link starts
+		canceller.Played(own)
+		chk(source.Start(func(samples []float32) {
+			canceller.Cancel(samples, receiver.Busy())
+			receiver.Write(samples)
+		}))
+	} else {
+		chk(source.Start(receiver.Write))
+	}
+
+	airtime := time.Duration(float64(len(captured)) / float64(p.SampleRate) * float64(time.Second))
+	if *timeout == 0 {
+		*timeout = time.Minute
+		if *realtime {
+			*timeout += airtime
+		}
+	}
+	start := time.Now()
+	if capture != nil {
+		chk(capture.Write(p.SentRecord(packet)))
+	}
+	go func() {
+		chk(sink.Write(captured))
+	}()
+
+	select {
+	case f := <-frames:
+		if capture != nil {
+			chk(capture.Write(p.ReceivedRecord(f)))
+			chk(capture.Close())
+		}
+		if *link_frame {
+			f.Bits = unframe_message(f.Bits, len(message))
+		}
+		errors := 0
+		for i, v := range message {
+			if i >= len(f.Bits) || int64(f.Bits[i]) != v.Int64() {
+				errors++
+			}
+		}
+		errors += max(len(f.Bits)-len(message), 0)
+		fmt.Printf("Sent %d bits over %v of audio in %v, received %d bits, %d errors, checksum ok: %v, snr %.1f dB\n",
+			len(message), airtime.Round(time.Millisecond), time.Since(start).Round(time.Millisecond), len(f.Bits), errors, f.ChecksumOK, f.SNR)
+		if errors > 0 || !f.ChecksumOK {
+			os.Exit(1)
+		}
+	case <-time.After(*timeout):
+		fmt.Printf("No frame received within %v\n", *timeout)
+		os.Exit(1)
+	}
+}
+
+// the two ends of the link, as far as link frames go
+const (
+	sender_addr   link.Addr = 1
+	receiver_addr link.Addr = 2
+)
+
+// frame_message wraps the message in a link frame of data to the receiver
+func frame_message(message modem.BitString) modem.BitString {
+	bits := make([]byte, len(message))
+	for i, v := range message {
+		bits[i] = byte(v.Int64())
+	}
+	f := link.Frame{Dst: receiver_addr, Src: sender_addr, Type: link.TypeData, Payload: modem.PackBits(bits)}
+	out, err := f.Bits()
+	chk(err)
+	return out
+}
+
+// unframe_message takes the first n bits of the payload out of a received link
+// frame, nothing when the frame doesn't check out or isn't ours
+func unframe_message(bits []byte, n int) []byte {
+	f, err := link.FromBits(bits)
+	if err != nil {
+		fmt.Println("Dropped the link frame:", err)
+		return nil
+	}
+	var payload []byte
+	mux := link.NewMux()
+	mux.Handle(link.TypeData, func(f link.Frame) {
+		if f.Dst == receiver_addr || f.Dst == link.Broadcast {
+			payload = f.Payload
+		}
+	})
+	if !mux.Dispatch(f) {
+		fmt.Println("Dropped a link frame nobody handles:", f)
+	}
+	out := []byte{}
+	for i := 0; i < min(n, 8*len(payload)); i++ {
+		out = append(out, payload[i/8]>>(7-i%8)&1)
+	}
+	return out
+}
+
+// our own speaker as our microphone hears it: later by the sound cards'
+// latency, and smeared by a couple of reflections
+const echo_latency = 30 * time.Millisecond
+
+var echo_reflections = []struct {
+	delay time.Duration
+	gain  float64
+}{{0, 1}, {2 * time.Millisecond, 0.4}, {5 * time.Millisecond, -0.2}}
+
+// how long the receiving node has been sending data when the other frame
+// starts arriving, for its echo canceller to learn the room. The canceller
+// only learns the room at the tones we've played, and the default profile
+// plays ten a symbol for 0.8s each, so it's fast and burst that reliably
+// hear through an echo as loud as the other end.
+const echo_head_start = time.Second
+
+func echo_lead(p modem.Profile) time.Duration {
+	return p.PreambleDuration + p.SleepDuration + echo_head_start
+}
+
+// talk_over has the receiving node send a long frame of its own, the other one
+// arriving echo_lead into it, and mixes its echo into what was captured. It
+// returns what the node played and the new capture.
+func talk_over(p modem.Profile, captured []float32, bits int, gain float64, seed int64) ([]float32, []float32) {
+	rng := rand.New(rand.NewSource(seed))
+	message := make(modem.BitString, bits+int(p.BitRate()*echo_lead(p).Seconds()))
+	for i := range message {
+		message[i] = big.NewInt(rng.Int63n(2))
+	}
+	packet, err := p.BuildPacket(message)
+	chk(err)
+	own := p.Transmission(packet)
+	frames := func(d time.Duration) int {
+		return int(d.Seconds() * float64(p.SampleRate))
+	}
+	last := echo_reflections[len(echo_reflections)-1].delay
+	out := make([]float32, max(len(captured), frames(echo_latency+last)+len(own)))
+	copy(out, captured)
+	for _, r := range echo_reflections {
+		offset := frames(echo_latency + r.delay)
+		for i, f := range own {
+			out[offset+i] += float32(float64(f) * gain * r.gain)
+		}
+	}
+	return own, out
+}
+
+const neighbour_stagger = 37 * time.Millisecond
+
+// add_neighbours mixes a transfer on every channel but ours into what was
+// captured, each starting a little later than the one before so their
+// preambles don't all line up with ours
+func add_neighbours(base modem.Profile, ours int, n int, captured []float32, bits int, snr float64, seed int64) []float32 {
+	for k := 0; k < n; k++ {
+		if k == ours {
+			continue
+		}
+		q, err := base.WithChannel(k, n)
+		chk(err)
+		packet, err := q.BuildPacket(modem.RandomBitString(bits))
+		chk(err)
+		channel := modem.NewChannel(q.SampleRate, snr, 0, seed+int64(k)+1)
+		channel.Delay += time.Duration(k+1) * neighbour_stagger
+		signal := channel.Apply(q.Transmission(packet))
+		if len(signal) > len(captured) {
+			captured = append(captured, make([]float32, len(signal)-len(captured))...)
+		}
+		for i, f := range signal {
+			captured[i] += f
+		}
+	}
+	return captured
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
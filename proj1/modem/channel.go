@@ -0,0 +1,78 @@
+package modem
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Channel is a crude model of the speaker -> room -> microphone path, good
+// enough to compare profiles without a noisy room: the signal is delayed,
+// attenuated, stretched by the clock mismatch between the two sound cards,
+// buried in white noise and, when there's a Jammer, jammed.
+type Channel struct {
+	SampleRate int
+	// signal to noise ratio in dB, measured against the average power of the
+	// signal passed to Apply; +Inf means no noise
+	SNR float64
+	// sample clock mismatch between sender and receiver in parts per million,
+	// positive means the receiver runs faster
+	DriftPPM float64
+	Gain     float64
+	Delay    time.Duration
+	// silence appended after the signal so the receiver sees the last symbol through
+	Tail time.Duration
+	Rand *rand.Rand
+	// played into the room alongside the signal, over the whole output
+	Jammer *Jammer
+}
+
+func NewChannel(sample_rate int, snr float64, drift_ppm float64, seed int64) *Channel {
+	return &Channel{
+		SampleRate: sample_rate,
+		SNR:        snr,
+		DriftPPM:   drift_ppm,
+		Gain:       1,
+		Delay:      200 * time.Millisecond,
+		Tail:       200 * time.Millisecond,
+		Rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (c *Channel) Apply(signal []float32) []float32 {
+	fs := float64(c.SampleRate)
+	delay := int(c.Delay.Seconds() * fs)
+	tail := int(c.Tail.Seconds() * fs)
+
+	// resample with linear interpolation, the receiver takes
+	// 1 + drift samples for every sample the sender played
+	ratio := 1 + c.DriftPPM*1e-6
+	stretched := make([]float32, int(float64(len(signal))*ratio))
+	for i := range stretched {
+		pos := float64(i) / ratio
+		j := int(pos)
+		frac := float32(pos - float64(j))
+		a := signal[min(j, len(signal)-1)]
+		b := signal[min(j+1, len(signal)-1)]
+		stretched[i] = a + (b-a)*frac
+	}
+
+	out := make([]float32, delay+len(stretched)+tail)
+	power := 0.0
+	for i, f := range stretched {
+		v := float64(f) * c.Gain
+		out[delay+i] = float32(v)
+		power += v * v
+	}
+	if len(stretched) > 0 && !math.IsInf(c.SNR, 1) {
+		power /= float64(len(stretched))
+		sigma := math.Sqrt(power / math.Pow(10, c.SNR/10))
+		for i := range out {
+			out[i] += float32(c.Rand.NormFloat64() * sigma)
+		}
+	}
+	if c.Jammer != nil {
+		c.Jammer.Add(out)
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package modem
+
+import "math"
+
+// The slice detector in detect_preamble needs a long chirp to follow. Short
+// frames that have to fit between a jammer's bursts use a short preamble, and
+// find it by correlating the input with the waveform they expect instead,
+// which also pins down where it ends to the sample.
+
+// normalized correlation a preamble has to reach unless the profile sets
+// PreambleThreshold, noise alone stays within a few 1/sqrt(template length)
+const correlate_threshold = 0.3
+
+func (p Profile) correlate_threshold() float64 {
+	if p.PreambleThreshold > 0 {
+		return p.PreambleThreshold
+	}
+	return correlate_threshold
+}
+
+const (
+	DetectSlices    = "slices"
+	DetectCorrelate = "correlate"
+)
+
+// preamble_template is the preamble as the receiver will see it after the
+// prefilter, scaled to unit energy
+func preamble_template(p Profile) []float64 {
+	preamble, _ := Samples(NewPreambleSig(p))
+	template := make([]float64, len(preamble))
+	for i, f := range preamble {
+		template[i] = float64(f)
+	}
+	NewPrefilter(p).Apply(template)
+	energy := 0.0
+	for _, v := range template {
+		energy += v * v
+	}
+	for i := range template {
+		template[i] /= math.Sqrt(energy)
+	}
+	return template
+}
+
+// correlate slides the template over the count newest samples, remembers the
+// best match above the threshold, and commits to it once half a template
+// length has gone by without a better one.
+func (r *Receiver) correlate(count int) {
+	N := len(r.template)
+	count = min(count, r.frame_count_all-N+1)
+	if count <= 0 {
+		return
+	}
+	threshold := r.Profile.correlate_threshold()
+	window := r.rb.CopyStrideRight(0, N+count-1)
+	energy := 0.0
+	for _, v := range window[:N-1] {
+		energy += v * v
+	}
+	for end := N - 1; end < len(window); end++ {
+		energy += window[end] * window[end]
+		if end >= N {
+			energy -= window[end-N] * window[end-N]
+		}
+		if energy <= 0 {
+			continue
+		}
+		dot := 0.0
+		for i, t := range r.template {
+			dot += window[end-N+1+i] * t
+		}
+		rho := dot / math.Sqrt(energy)
+		// frames received up to and including this end
+		at := r.frame_count_all - (len(window) - 1 - end)
+		if rho >= threshold && (!r.candidate || rho > r.best_correlation) {
+			r.candidate = true
+			r.best_correlation, r.best_at = rho, at
+		}
+	}
+	if r.candidate && r.frame_count_all-r.best_at > N/2 {
+		r.Logger.Info(EvPreambleDetected, "correlation", r.best_correlation, "gain", r.agc.Gain())
+		r.is_idle = false
+		r.candidate = false
+		r.frame_count_all -= r.best_at
+	}
+}
@@ -0,0 +1,136 @@
+package modem
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// When a transfer fails the Printf dump only tells us what we decided, not why.
+// The diagnostics writer records, for every symbol window and every band, the
+// energy around each candidate tone, the index we picked, the runner-up and
+// the margin between the two. Render it with ../waterfall.
+
+type DiagRecord struct {
+	Symbol   int       `json:"symbol"`
+	Band     int       `json:"band"`
+	LowFreq  float64   `json:"low_freq"`
+	Chosen   int       `json:"chosen"`
+	RunnerUp int       `json:"runner_up"`
+	Margin   float64   `json:"margin"`
+	Energy   []float64 `json:"energy"`
+}
+
+type DiagWriter struct {
+	file    *os.File
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	json    *json.Encoder
+	columns int
+}
+
+// NewDiagWriter picks the output format from the extension: .json/.jsonl give one JSON object
+// per line, anything else is CSV
+func NewDiagWriter(path string) (*DiagWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiagWriter{file: file, buf: bufio.NewWriter(file)}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".jsonl":
+		d.json = json.NewEncoder(d.buf)
+	default:
+		d.csv = csv.NewWriter(d.buf)
+	}
+	return d, nil
+}
+
+func (d *DiagWriter) Write(r DiagRecord) error {
+	if d.json != nil {
+		return d.json.Encode(r)
+	}
+	if d.columns == 0 {
+		d.columns = len(r.Energy)
+		header := []string{"symbol", "band", "low_freq", "chosen", "runner_up", "margin"}
+		for i := 0; i < d.columns; i++ {
+			header = append(header, "e"+strconv.Itoa(i))
+		}
+		if err := d.csv.Write(header); err != nil {
+			return err
+		}
+	}
+	row := []string{
+		strconv.Itoa(r.Symbol),
+		strconv.Itoa(r.Band),
+		strconv.FormatFloat(r.LowFreq, 'f', 2, 64),
+		strconv.Itoa(r.Chosen),
+		strconv.Itoa(r.RunnerUp),
+		strconv.FormatFloat(r.Margin, 'g', 6, 64),
+	}
+	for i := 0; i < d.columns; i++ {
+		v := 0.0
+		if i < len(r.Energy) {
+			v = r.Energy[i]
+		}
+		row = append(row, strconv.FormatFloat(v, 'g', 6, 64))
+	}
+	return d.csv.Write(row)
+}
+
+func (d *DiagWriter) Close() error {
+	if d.csv != nil {
+		d.csv.Flush()
+		if err := d.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := d.buf.Flush(); err != nil {
+		return err
+	}
+	return d.file.Close()
+}
+
+// energy[i] corresponds to frequency fs * i / L, for every candidate tone
+// base_freq + j * step we take the peak within half a step around it
+func tone_energies(energy []float64, L int, fs float64, base_freq float64, step float64, states int) []float64 {
+	out := make([]float64, states)
+	for j := 0; j < states; j++ {
+		freq := base_freq + float64(j)*step
+		i_start := max(int(math.Ceil((freq-step/2)*float64(L)/fs)), 0)
+		i_end := min(int(math.Floor((freq+step/2)*float64(L)/fs)), len(energy)-1)
+		peak := math.Inf(-1)
+		for i := i_start; i <= i_end; i++ {
+			peak = max(peak, energy[i])
+		}
+		if math.IsInf(peak, -1) {
+			peak = 0
+		}
+		out[j] = peak
+	}
+	return out
+}
+
+// runner-up is the best candidate other than the chosen one, the margin is how
+// much energy the chosen tone had over it (negative if we picked a weaker tone)
+func runner_up(energies []float64, chosen int) (int, float64) {
+	best := -1
+	for j, v := range energies {
+		if j != chosen && (best == -1 || v > energies[best]) {
+			best = j
+		}
+	}
+	if best == -1 {
+		return -1, 0
+	}
+	chosen_energy := 0.0
+	if chosen >= 0 && chosen < len(energies) {
+		chosen_energy = energies[chosen]
+	}
+	return best, chosen_energy - energies[best]
+}
@@ -0,0 +1,268 @@
+package modem
+
+import (
+	"math"
+	"math/cmplx"
+	"time"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+// A node that listens while it talks hears itself far louder than anyone else.
+// EchoCanceller takes what we played as the reference, learns the path from
+// our speaker to our microphone with an NLMS filter and subtracts its estimate
+// of our own sound from the capture.
+//
+// The reference is stamped with the capture clock when it's handed over, which
+// is ahead of when it's actually heard by the sound card's latency. That delay
+// is found once, by cross-correlating the first echo with what we played, and
+// the filter only has to cover the room's reverb after it. Until then, and
+// for echo_training after, the capture is muted while we play.
+//
+// What's left of the echo is some 30 dB under it, enough to hear someone
+// about as loud as we are; an echo much louder than them still comes through
+// above the room's noise. Over a quiet room though what's left of our own
+// preamble is still a clean chirp the receiver takes for someone else's, so
+// the echo of every preamble we play is muted too.
+
+// longest speaker to microphone latency we look for
+const echo_max_delay = 250 * time.Millisecond
+
+// the delay is looked for as soon as this much of the first transmission is
+// in beyond the lag, and taken once the match is clear, or once we've heard
+// echo_estimate of it whatever the match
+const echo_min_estimate = 20 * time.Millisecond
+const echo_estimate = 200 * time.Millisecond
+const echo_lock_correlation = 0.5
+
+// how long the filter learns, with the capture muted, before we listen
+// through it
+const echo_training = 100 * time.Millisecond
+
+// NLMS can't tell our echo from someone else talking at the same time, and
+// with tones on the same frequencies as ours it happily learns to cancel them
+// too. The receiver knows when someone else is talking, Receiver.Busy, and
+// that's what holds the filter still in Cancel. It only knows once their
+// preamble is nearly over though, and learning from that much of it leaves
+// the filter off at the frequencies it swept. So once the filter has had
+// echo_converge to learn the room, the step shrinks with how long it's been
+// learning, down to echo_settled_mu of mu: still quick to pick up a tone we
+// hadn't played yet, but it minds their preamble a lot less.
+const echo_converge = time.Second
+const echo_settled_mu = 0.5
+
+// taps kept in front of the estimated delay in case the direct path isn't the
+// strongest
+const echo_lead_taps = 16
+
+type EchoCanceller struct {
+	sample_rate int
+	mu          float64
+	w           []float64
+	tmp         []float64
+	// what we played on the capture clock, far[i] went out around the time
+	// capture frame far_start+i was taken
+	far       []float64
+	far_start int
+	// capture frames seen
+	now    int
+	delay  int
+	locked bool
+	// capture position of the first thing we played, -1 before, and the raw
+	// capture from there on until the delay is known
+	first int
+	near  []float64
+	// frames the filter has learned from
+	trained int
+	// where each frame we played starts on the capture clock, and how long
+	// the echo of its preamble lasts
+	starts   []int
+	preamble int
+}
+
+// NewEchoCanceller makes a canceller for frames of profile p whose filter
+// spans taps frames after the bulk delay, adapting with step size mu
+// (0 < mu < 2, smaller adapts slower but minds a far end talking at the same
+// time less).
+func NewEchoCanceller(p Profile, taps int, mu float64) *EchoCanceller {
+	return &EchoCanceller{
+		sample_rate: p.SampleRate,
+		mu:          mu,
+		w:           make([]float64, taps),
+		tmp:         make([]float64, taps),
+		first:       -1,
+		preamble:    p.frames(p.PreambleDuration) + taps,
+	}
+}
+
+// Played hands over a frame just written to the speaker, preamble first.
+// Frames written back to back follow on from each other, as they do in the
+// device's queue.
+func (c *EchoCanceller) Played(samples []float32) {
+	if len(c.far) == 0 {
+		c.far_start = c.now
+	}
+	pos := max(c.now, c.far_start+len(c.far))
+	for c.far_start+len(c.far) < pos {
+		c.far = append(c.far, 0)
+	}
+	for _, f := range samples {
+		c.far = append(c.far, float64(f))
+	}
+	if c.first < 0 {
+		c.first = pos
+	}
+	c.starts = append(c.starts, pos)
+}
+
+// Delay is the estimated latency from speaker to microphone, 0 until known.
+func (c *EchoCanceller) Delay() time.Duration {
+	return time.Duration(float64(c.delay) / float64(c.sample_rate) * float64(time.Second))
+}
+
+func (c *EchoCanceller) frames(d time.Duration) int {
+	return int(d.Seconds() * float64(c.sample_rate))
+}
+
+// Cancel removes our own echo from captured samples in place, learning the
+// echo path as it goes unless hold is set.
+func (c *EchoCanceller) Cancel(samples []float32, hold bool) {
+	taps := len(c.w)
+	for i, f := range samples {
+		d := float64(f)
+		if !c.locked && c.first >= 0 && c.now >= c.first {
+			// until we know where our echo is we'd mostly hear ourselves,
+			// better to hear nothing
+			c.near = append(c.near, d)
+			samples[i] = 0
+		}
+		if c.locked {
+			// reference frames [newest-taps+1, newest] line up with the taps
+			newest := c.now - c.delay + echo_lead_taps
+			x := c.window(newest - taps + 1)
+			if x != nil {
+				y, energy := 0.0, 0.0
+				for k, v := range x {
+					y += c.w[k] * v
+					energy += v * v
+				}
+				e := d - y
+				if energy > 1e-9 && !hold {
+					mu := c.mu
+					if converged := c.frames(echo_converge); c.trained > converged {
+						mu *= max(float64(converged)/float64(c.trained), echo_settled_mu)
+					}
+					step := mu * e / (energy + 1e-6)
+					for k, v := range x {
+						c.w[k] += step * v
+					}
+					c.trained++
+				}
+				samples[i] = float32(e)
+				if c.trained < c.frames(echo_training) || c.in_preamble(newest-echo_lead_taps) {
+					samples[i] = 0
+				}
+			}
+		}
+		c.now++
+	}
+	if !c.locked && c.first >= 0 {
+		c.estimate_delay()
+	}
+	c.trim()
+}
+
+// in_preamble tells if the reference at capture position pos is in the
+// preamble of one of our frames or its reverb, pos only ever moves forward
+func (c *EchoCanceller) in_preamble(pos int) bool {
+	for len(c.starts) > 0 && c.starts[0]+c.preamble <= pos {
+		c.starts = c.starts[1:]
+	}
+	return len(c.starts) > 0 && c.starts[0] <= pos
+}
+
+// window returns the taps reference frames from capture position start on,
+// nil when we played nothing in that stretch
+func (c *EchoCanceller) window(start int) []float64 {
+	end := start + len(c.w)
+	if end <= c.far_start || start >= c.far_start+len(c.far) {
+		return nil
+	}
+	if start >= c.far_start && end <= c.far_start+len(c.far) {
+		return c.far[start-c.far_start : end-c.far_start]
+	}
+	for k := range c.tmp {
+		c.tmp[k] = c.far_at(start + k)
+	}
+	return c.tmp
+}
+
+func (c *EchoCanceller) far_at(pos int) float64 {
+	if pos < c.far_start || pos >= c.far_start+len(c.far) {
+		return 0
+	}
+	return c.far[pos-c.far_start]
+}
+
+// estimate_delay looks for the lag at which the capture looks most like what
+// we played, and locks onto it when it's clear enough
+func (c *EchoCanceller) estimate_delay() {
+	n := len(c.near)
+	lags := min(c.frames(echo_max_delay), n-c.frames(echo_min_estimate))
+	if lags < 0 {
+		return
+	}
+	size := 1
+	for size < 2*n {
+		size *= 2
+	}
+	near := make([]float64, size)
+	far := make([]float64, size)
+	copy(near, c.near)
+	for t := 0; t < n; t++ {
+		far[t] = c.far_at(c.first + t)
+	}
+	spectrum := fft.FFTReal(near)
+	for k, v := range fft.FFTReal(far) {
+		spectrum[k] *= cmplx.Conj(v)
+	}
+	corr := fft.IFFT(spectrum)
+	best := 0
+	for lag := 0; lag <= lags; lag++ {
+		if math.Abs(real(corr[lag])) > math.Abs(real(corr[best])) {
+			best = lag
+		}
+	}
+	near_energy, far_energy := 0.0, 0.0
+	for t := 0; t < n; t++ {
+		near_energy += near[t] * near[t]
+		far_energy += far[t] * far[t]
+	}
+	rho := math.Abs(real(corr[best])) / math.Sqrt(near_energy*far_energy+1e-20)
+	if rho < echo_lock_correlation && n < c.frames(echo_max_delay+echo_estimate) {
+		return
+	}
+	c.delay = max(best, echo_lead_taps)
+	c.locked = true
+	c.near = nil
+}
+
+// trim drops reference nobody will look at again
+func (c *EchoCanceller) trim() {
+	keep := c.now - c.delay + echo_lead_taps - len(c.w)
+	if !c.locked {
+		if c.first < 0 {
+			return
+		}
+		keep = c.first
+	}
+	drop := keep - c.far_start
+	switch {
+	case drop >= len(c.far):
+		c.far, c.far_start = c.far[:0], keep
+	case drop > c.sample_rate:
+		// in batches, so we're not copying on every call
+		c.far = append(c.far[:0], c.far[drop:]...)
+		c.far_start = keep
+	}
+}
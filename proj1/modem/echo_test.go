@@ -0,0 +1,114 @@
+package modem
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// our own speaker as our microphone hears it, as ../loopback has it: later by
+// the sound cards' latency and smeared by a couple of reflections
+var test_echo_reflections = []struct {
+	delay time.Duration
+	gain  float64
+}{{0, 1}, {2 * time.Millisecond, 0.4}, {5 * time.Millisecond, -0.2}}
+
+const test_echo_latency = 30 * time.Millisecond
+
+func random_bits(random *rand.Rand, n int) BitString {
+	out := make(BitString, n)
+	for i := range out {
+		out[i] = big.NewInt(random.Int63n(2))
+	}
+	return out
+}
+
+// a node talks, its echo far louder than the frame someone else starts a
+// second into its data; only that frame comes out, and right, with or without
+// noise
+func TestEchoCanceller(t *testing.T) {
+	p, err := LookupProfile("fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lead := p.PreambleDuration + p.SleepDuration + time.Second
+	cases := []struct {
+		snr  float64
+		gain float64
+		far  bool
+	}{
+		{math.Inf(1), 3, false},
+		{math.Inf(1), 0.5, true},
+		{math.Inf(1), 3, true},
+		{30, 3, true},
+		{20, 3, true},
+	}
+	for _, c := range cases {
+		random := rand.New(rand.NewSource(1))
+		message := random_bits(random, 100)
+		channel := NewChannel(p.SampleRate, c.snr, 0, 1)
+		channel.Delay += lead
+		signal := []float32{}
+		if c.far {
+			packet, err := p.BuildPacket(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signal = p.Transmission(packet)
+		}
+		captured := channel.Apply(signal)
+
+		// ours goes on past theirs
+		own_packet, err := p.BuildPacket(random_bits(random, 100+int(p.BitRate()*lead.Seconds())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		own := p.Transmission(own_packet)
+		last := test_echo_reflections[len(test_echo_reflections)-1].delay
+		heard := make([]float32, max(len(captured), p.frames(test_echo_latency+last)+len(own)))
+		copy(heard, captured)
+		for _, r := range test_echo_reflections {
+			offset := p.frames(test_echo_latency + r.delay)
+			for i, f := range own {
+				heard[offset+i] += float32(float64(f) * c.gain * r.gain)
+			}
+		}
+
+		frames := []Frame{}
+		receiver := NewReceiver(p)
+		receiver.OnFrame = func(f Frame) { frames = append(frames, f) }
+		canceller := NewEchoCanceller(p, 256, 0.5)
+		canceller.Played(own)
+		for i := 0; i < len(heard); i += 512 {
+			chunk := heard[i:min(i+512, len(heard))]
+			canceller.Cancel(chunk, receiver.Busy())
+			receiver.Write(chunk)
+		}
+
+		if got := canceller.Delay(); got < test_echo_latency-time.Millisecond || got > test_echo_latency+time.Millisecond {
+			t.Errorf("echo %v at %v dB: delay %v, want %v", c.gain, c.snr, got, test_echo_latency)
+		}
+		if !c.far {
+			if len(frames) != 0 {
+				t.Errorf("echo %v at %v dB, nobody else talking: received %d frames", c.gain, c.snr, len(frames))
+			}
+			continue
+		}
+		if len(frames) != 1 {
+			t.Errorf("echo %v at %v dB: received %d frames, want 1", c.gain, c.snr, len(frames))
+			continue
+		}
+		f := frames[0]
+		errors := 0
+		for i, v := range message {
+			if i >= len(f.Bits) || int64(f.Bits[i]) != v.Int64() {
+				errors++
+			}
+		}
+		if !f.ChecksumOK || len(f.Bits) != len(message) || errors > 0 {
+			t.Errorf("echo %v at %v dB: %d bits, %d of %d wrong, checksum ok %v", c.gain, c.snr, len(f.Bits), errors, len(message), f.ChecksumOK)
+		}
+	}
+}
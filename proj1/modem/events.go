@@ -0,0 +1,69 @@
+package modem
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Progress is reported as a stream of structured events (JSON lines by
+// default) instead of free-form Printf, so runs can be grepped and compared.
+const (
+	EvModemConfig      = "modem_config"
+	EvMessageReady     = "message_ready"
+	EvJamPattern       = "jam_pattern"
+	EvPreambleSent     = "preamble_sent"
+	EvHeaderSent       = "header_sent"
+	EvSymbolSent       = "symbol_sent"
+	EvFrameSent        = "frame_sent"
+	EvNotchAdded       = "notch_added"
+	EvPreambleScore    = "preamble_score"
+	EvPreambleDetected = "preamble_detected"
+	EvBandDecoded      = "band_decoded"
+	EvSymbolDecoded    = "symbol_decoded"
+	EvSymbolDiscarded  = "symbol_discarded"
+	EvCarrierLost      = "carrier_lost"
+	EvHeaderDecoded    = "header_decoded"
+	EvPacketReceived   = "packet_received"
+	EvChecksum         = "checksum"
+	EvFrameDelivered   = "frame_delivered"
+)
+
+// output is "-" or "stderr", "stdout", or a file path the events get appended to
+func OpenLogger(level string, format string, output string) (*slog.Logger, io.Closer, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, nil, err
+	}
+
+	var w io.Writer
+	var closer io.Closer = io.NopCloser(nil)
+	switch output {
+	case "", "-", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, closer = file, file
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), closer, nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), closer, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// a logger that drops everything, for library users that don't care
+func discard_logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
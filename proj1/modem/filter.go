@@ -0,0 +1,179 @@
+package modem
+
+import (
+	"math"
+	"time"
+)
+
+// The prefilter cleans captured audio before the receiver looks at it: a high
+// pass takes out DC and rumble, a band pass keeps only what the preamble and
+// the data tones use, and notches take out tones that won't go away, like a
+// fan or mains hum. Which stages run is part of the Profile.
+
+// a peak this far above the median of a quiet slice's data bins is a tone
+const notch_threshold_db = 20.0
+
+// a tone has to stay put for this long, and for a few symbols, before we notch
+// it, so a neighbour's transmission doesn't get one
+const notch_persist = 2 * time.Second
+const notch_persist_symbols = 3
+
+// Q of a 4th order butterworth split into two biquads
+var butterworth4_q = []float64{0.5412, 1.3066}
+
+// Biquad is a second order IIR section, transposed direct form II, with
+// coefficients from the RBJ audio EQ cookbook.
+type Biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	z1, z2     float64
+}
+
+func (f *Biquad) Process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+func new_biquad(b0, b1, b2, a0, a1, a2 float64) *Biquad {
+	return &Biquad{b0: b0 / a0, b1: b1 / a0, b2: b2 / a0, a1: a1 / a0, a2: a2 / a0}
+}
+
+func HighPass(fs float64, f0 float64, q float64) *Biquad {
+	w := 2 * math.Pi * f0 / fs
+	alpha := math.Sin(w) / (2 * q)
+	c := math.Cos(w)
+	return new_biquad((1+c)/2, -(1 + c), (1+c)/2, 1+alpha, -2*c, 1-alpha)
+}
+
+func LowPass(fs float64, f0 float64, q float64) *Biquad {
+	w := 2 * math.Pi * f0 / fs
+	alpha := math.Sin(w) / (2 * q)
+	c := math.Cos(w)
+	return new_biquad((1-c)/2, 1-c, (1-c)/2, 1+alpha, -2*c, 1-alpha)
+}
+
+// Notch cuts f0 with a -3 dB width of bandwidth Hz.
+func Notch(fs float64, f0 float64, bandwidth float64) *Biquad {
+	w := 2 * math.Pi * f0 / fs
+	alpha := math.Sin(w) / (2 * f0 / bandwidth)
+	c := math.Cos(w)
+	return new_biquad(1, -2*c, 1, 1+alpha, -2*c, 1-alpha)
+}
+
+type Prefilter struct {
+	p        Profile
+	sections []*Biquad
+	notches  []float64
+	// the tone we're watching for persistence and since when
+	tone       float64
+	tone_since time.Duration
+}
+
+func NewPrefilter(p Profile) *Prefilter {
+	fs := float64(p.SampleRate)
+	f := &Prefilter{p: p}
+	if p.HighPassFreq > 0 {
+		f.sections = append(f.sections, HighPass(fs, p.HighPassFreq, 1/math.Sqrt2))
+	}
+	if p.BandPass {
+		low, high := p.PassBand()
+		qs := butterworth4_q
+		if p.Channels > 1 {
+			qs = butterworth8_q
+		}
+		for _, q := range qs {
+			f.sections = append(f.sections, HighPass(fs, low, q), LowPass(fs, high, q))
+		}
+	}
+	for _, freq := range p.NotchFreqs {
+		f.add_notch(freq)
+	}
+	return f
+}
+
+// PassBand is what the band pass keeps: the preamble and all the data tones,
+// with some room so the filter's roll off doesn't touch them, or on a channel
+// plan, the channel.
+func (p Profile) PassBand() (float64, float64) {
+	low, high := p.Span()
+	low, high = low*0.8, high*1.1
+	if p.Channels > 1 {
+		low, high = p.ChannelLowFreq, p.ChannelHighFreq
+	}
+	return low, min(high, 0.95*float64(p.SampleRate)/2)
+}
+
+func (f *Prefilter) add_notch(freq float64) {
+	// narrow enough to sit between two data tones
+	bandwidth := max(f.p.FreqStep/4, 5)
+	f.sections = append(f.sections, Notch(float64(f.p.SampleRate), freq, bandwidth))
+	f.notches = append(f.notches, freq)
+}
+
+func (f *Prefilter) Notches() []float64 {
+	return f.notches
+}
+
+// Apply filters samples in place, the state carries over between calls.
+func (f *Prefilter) Apply(samples []float64) {
+	for _, s := range f.sections {
+		for i, x := range samples {
+			samples[i] = s.Process(x)
+		}
+	}
+}
+
+// Observe looks at the amplitude spectrum of a quiet window of L frames that
+// came after d of other quiet windows, and adds a notch once the same strong
+// tone has been in all of them for long enough. It reports the new notch.
+func (f *Prefilter) Observe(energy []float64, L int, d time.Duration) (float64, bool) {
+	if len(f.notches)-len(f.p.NotchFreqs) >= f.p.AdaptiveNotches || len(energy) < 3 {
+		return 0, false
+	}
+	fs := float64(f.p.SampleRate)
+	peak := arg_max(energy[1:len(energy)-1]) + 1
+	// the floor is taken where our tones are; the band pass has the rest of
+	// the spectrum near zero, on a channel plan most of it
+	if 20*math.Log10(energy[peak]/max(median(f.data_bins(energy, L)), min_noise_density)) < notch_threshold_db {
+		f.tone_since = 0
+		return 0, false
+	}
+	// parabolic interpolation between the bins around the peak
+	a, b, c := energy[peak-1], energy[peak], energy[peak+1]
+	offset := 0.0
+	if denominator := a - 2*b + c; denominator != 0 {
+		offset = 0.5 * (a - c) / denominator
+	}
+	freq := (float64(peak) + offset) * fs / float64(L)
+	for _, n := range f.notches {
+		if math.Abs(n-freq) < fs/float64(L) {
+			// already notched, what's left of it isn't worth another one
+			return 0, false
+		}
+	}
+	if math.Abs(freq-f.tone) > fs/float64(L) {
+		f.tone, f.tone_since = freq, 0
+		return 0, false
+	}
+	f.tone_since += d
+	if f.tone_since < max(notch_persist, notch_persist_symbols*f.p.SymbolDuration) {
+		return 0, false
+	}
+	f.add_notch(freq)
+	f.tone_since = 0
+	return freq, true
+}
+
+// data_bins is the part of the spectrum of a window of L frames the data tones
+// are in, all of it for a window too short to tell them apart
+func (f *Prefilter) data_bins(energy []float64, L int) []float64 {
+	fs := float64(f.p.SampleRate)
+	low := max(int(math.Ceil(f.p.LowFreq*float64(L)/fs)), 0)
+	high := min(int(math.Floor(f.p.HighFreq*float64(L)/fs)), len(energy)-1)
+	if high-low < 2 {
+		return energy
+	}
+	return energy[low : high+1]
+}
@@ -0,0 +1,5 @@
+module modem
+
+go 1.21.3
+
+require github.com/mjibson/go-dsp v0.0.0-20180508042940-11479a337f12
@@ -0,0 +1,69 @@
+package modem
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Jammer makes the same gated noise as proj2's JammingWav.m: uniform noise at
+// full scale, switched on for 50-100ms bursts between 100-200ms quiet gaps,
+// starting with a gap. It keeps its place in the pattern between calls, so it
+// can be generated in chunks for as long as needed.
+type Jammer struct {
+	SampleRate int
+	QuietMin   time.Duration
+	QuietMax   time.Duration
+	BurstMin   time.Duration
+	BurstMax   time.Duration
+	// peak amplitude of the noise, 1 is full scale
+	Level float64
+	Rand  *rand.Rand
+	// frames left in the current gap or burst
+	left   int
+	jammed bool
+}
+
+func NewJammer(sample_rate int, seed int64) *Jammer {
+	return &Jammer{
+		SampleRate: sample_rate,
+		QuietMin:   100 * time.Millisecond,
+		QuietMax:   200 * time.Millisecond,
+		BurstMin:   50 * time.Millisecond,
+		BurstMax:   100 * time.Millisecond,
+		Level:      1,
+		Rand:       rand.New(rand.NewSource(seed)),
+		// so the first thing picked is a gap, like in the script
+		jammed: true,
+	}
+}
+
+// a length picked uniformly between low and high, in frames
+func (j *Jammer) pick(low, high time.Duration) int {
+	d := low.Seconds() + j.Rand.Float64()*(high-low).Seconds()
+	return max(int(d*float64(j.SampleRate)), 1)
+}
+
+// Generate returns the next frames of jamming.
+func (j *Jammer) Generate(frames int) []float32 {
+	out := make([]float32, frames)
+	j.Add(out)
+	return out
+}
+
+// Add mixes the next len(samples) frames of jamming into samples.
+func (j *Jammer) Add(samples []float32) {
+	for i := range samples {
+		if j.left == 0 {
+			j.jammed = !j.jammed
+			if j.jammed {
+				j.left = j.pick(j.BurstMin, j.BurstMax)
+			} else {
+				j.left = j.pick(j.QuietMin, j.QuietMax)
+			}
+		}
+		if j.jammed {
+			samples[i] += float32((2*j.Rand.Float64() - 1) * j.Level)
+		}
+		j.left--
+	}
+}
@@ -0,0 +1,207 @@
+package modem
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// A jammer like proj2's JammingWav.m alternates 100-200ms quiet gaps with
+// 50-100ms bursts of full scale noise. Anything sent through a burst is lost,
+// so instead of transmitting straight through we listen, learn the pattern and
+// send short frames (the "burst" profile) right after a burst ends, sized to
+// fit the shortest gap seen so far.
+
+// level of the channel is judged on blocks this long
+const jam_block = 5 * time.Millisecond
+
+// quiet and jammed have to be this far apart before we call it a jammer
+const jam_min_contrast_db = 10.0
+const jam_hysteresis_db = 2.0
+
+// how many gaps and bursts we remember, and how many gaps we want to have seen
+// before predicting
+const jam_history = 16
+const jam_min_gaps = 3
+
+// listening this long without a burst means there's no jammer
+const jam_learn = time.Second
+
+// JamTracker is fed what the microphone hears and predicts how much longer
+// the channel will stay quiet. Write runs on the capture callback while the
+// sender asks QuietLeft, so it's safe for concurrent use.
+type JamTracker struct {
+	mu    sync.Mutex
+	rate  int
+	block int
+	// the block being accumulated
+	power  float64
+	filled int
+	now    int
+	// envelope of block levels in dB
+	low, high float64
+	primed    bool
+	jammed    bool
+	// when the current state began, and whether we saw it begin and have
+	// been listening since, so its length means something
+	since  int
+	fresh  bool
+	muted  bool
+	gaps   []int
+	bursts []int
+}
+
+func NewJamTracker(sample_rate int) *JamTracker {
+	block := max(int(jam_block.Seconds()*float64(sample_rate)), 1)
+	return &JamTracker{rate: sample_rate, block: block}
+}
+
+func (t *JamTracker) Write(samples []float32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range samples {
+		t.power += float64(f) * float64(f)
+		t.filled++
+		if t.filled == t.block {
+			t.now += t.block
+			if !t.muted {
+				t.judge(10 * math.Log10(t.power/float64(t.block)+1e-20))
+			}
+			t.power, t.filled = 0, 0
+		}
+	}
+}
+
+// judge places the level of the block that just ended as quiet or jammed
+func (t *JamTracker) judge(level float64) {
+	if !t.primed {
+		t.low, t.high, t.primed = level, level, true
+	}
+	// the envelope snaps out to new extremes and creeps back in
+	if level < t.low {
+		t.low = level
+	} else {
+		t.low += 0.01 * (level - t.low)
+	}
+	if level > t.high {
+		t.high = level
+	} else {
+		t.high -= 0.01 * (t.high - level)
+	}
+	if t.high-t.low < jam_min_contrast_db {
+		return
+	}
+	mid := (t.low + t.high) / 2
+	switch {
+	case !t.jammed && level > mid+jam_hysteresis_db:
+		t.edge(true)
+	case t.jammed && level < mid-jam_hysteresis_db:
+		t.edge(false)
+	}
+}
+
+func (t *JamTracker) edge(jammed bool) {
+	start := t.now - t.block
+	if t.fresh {
+		if t.jammed {
+			t.bursts = append(t.bursts, start-t.since)
+		} else {
+			t.gaps = append(t.gaps, start-t.since)
+		}
+		t.bursts = t.bursts[max(len(t.bursts)-jam_history, 0):]
+		t.gaps = t.gaps[max(len(t.gaps)-jam_history, 0):]
+	}
+	t.jammed, t.since, t.fresh = jammed, start, true
+}
+
+// Mute stops judging the channel while we transmit ourselves. Samples written
+// meanwhile still move the clock, but the current state no longer counts as
+// seen from its start.
+func (t *JamTracker) Mute(muted bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.muted = muted
+	if muted {
+		t.fresh = false
+	}
+}
+
+func (t *JamTracker) duration(frames int) time.Duration {
+	return time.Duration(float64(frames) / float64(t.rate) * float64(time.Second))
+}
+
+// Jammed tells whether there's a jammer at all.
+func (t *JamTracker) Jammed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.primed && t.high-t.low >= jam_min_contrast_db
+}
+
+// Learned is true once there's enough to predict from: jam_learn of listening
+// and, when there's a jammer, jam_min_gaps complete gaps.
+func (t *JamTracker) Learned() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.duration(t.now) < jam_learn {
+		return false
+	}
+	return t.high-t.low < jam_min_contrast_db || len(t.gaps) >= jam_min_gaps
+}
+
+// MinGap is the shortest quiet gap remembered, what we can count on after a
+// burst ends. Without a jammer it's unbounded.
+func (t *JamTracker) MinGap() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.min_gap()
+}
+
+func (t *JamTracker) min_gap() time.Duration {
+	if t.high-t.low < jam_min_contrast_db {
+		return time.Duration(math.MaxInt64)
+	}
+	if len(t.gaps) == 0 {
+		return 0
+	}
+	return t.duration(slices.Min(t.gaps))
+}
+
+// QuietLeft is how much longer the channel should stay quiet: the shortest gap
+// minus how long the current one has lasted. It's 0 during a burst and when we
+// didn't see the current gap begin.
+func (t *JamTracker) QuietLeft() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.high-t.low < jam_min_contrast_db {
+		return t.min_gap()
+	}
+	if t.jammed || !t.fresh || t.muted {
+		return 0
+	}
+	return max(t.min_gap()-t.duration(t.now-t.since), 0)
+}
+
+// Pattern is the remembered gap and burst lengths, oldest first.
+func (t *JamTracker) Pattern() (gaps []time.Duration, bursts []time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, g := range t.gaps {
+		gaps = append(gaps, t.duration(g))
+	}
+	for _, b := range t.bursts {
+		bursts = append(bursts, t.duration(b))
+	}
+	return gaps, bursts
+}
+
+// FrameAirtime is how long a frame carrying data_symbols takes to send.
+func (p Profile) FrameAirtime(data_symbols int) time.Duration {
+	return p.PreambleDuration + p.SleepDuration + time.Duration(p.LenLength+2+data_symbols)*p.SymbolDuration
+}
+
+// SymbolsFitting is how many data symbols a frame can carry and still take at
+// most d on the air, 0 if not even an empty frame fits.
+func (p Profile) SymbolsFitting(d time.Duration) int {
+	return max(int((d-p.FrameAirtime(0))/p.SymbolDuration), 0)
+}
@@ -0,0 +1,83 @@
+package modem
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// a jammer like JammingWav.m's but strictly periodic, over a quiet room
+func TestJamTracker(t *testing.T) {
+	const rate = 44100
+	const gap, burst = 150 * time.Millisecond, 75 * time.Millisecond
+	jammer := NewJammer(rate, 1)
+	jammer.QuietMin, jammer.QuietMax = gap, gap
+	jammer.BurstMin, jammer.BurstMax = burst, burst
+	room := rand.New(rand.NewSource(2))
+	listen := func(frames int) []float32 {
+		out := make([]float32, frames)
+		for i := range out {
+			out[i] = float32(room.NormFloat64() * 1e-3)
+		}
+		jammer.Add(out)
+		return out
+	}
+
+	tracker := NewJamTracker(rate)
+	for i := 0; i < 2*rate; i += 512 {
+		tracker.Write(listen(512))
+	}
+	if !tracker.Learned() || !tracker.Jammed() {
+		t.Fatalf("learned %v, jammed %v after 2s of jamming", tracker.Learned(), tracker.Jammed())
+	}
+	near := func(d, want time.Duration) bool {
+		return d > want-2*jam_block && d < want+2*jam_block
+	}
+	gaps, bursts := tracker.Pattern()
+	for _, d := range gaps {
+		if !near(d, gap) {
+			t.Errorf("gaps %v, want %v", gaps, gap)
+			break
+		}
+	}
+	for _, d := range bursts {
+		if !near(d, burst) {
+			t.Errorf("bursts %v, want %v", bursts, burst)
+			break
+		}
+	}
+	if !near(tracker.MinGap(), gap) {
+		t.Errorf("min gap %v, want %v", tracker.MinGap(), gap)
+	}
+
+	// block by block through the next burst into the gap after it
+	block := int(jam_block.Seconds() * rate)
+	for i := 0; tracker.QuietLeft() > 0; i++ {
+		if i > 2*rate/block {
+			t.Fatal("no burst in 2s")
+		}
+		tracker.Write(listen(block))
+	}
+	for i := 0; tracker.QuietLeft() == 0; i++ {
+		if i > 2*rate/block {
+			t.Fatal("no gap in 2s")
+		}
+		tracker.Write(listen(block))
+	}
+	// never more quiet than there is, and not much of it wasted: the gap is
+	// only seen to start a block or two in
+	safe := func(left, want time.Duration) bool {
+		return left <= want && left > want-3*jam_block
+	}
+	if left := tracker.QuietLeft(); !safe(left, gap) {
+		t.Errorf("%v quiet left as the gap starts, want a little under %v", left, gap)
+	}
+	tracker.Write(listen(rate / 20))
+	if left := tracker.QuietLeft(); !safe(left, gap-50*time.Millisecond) {
+		t.Errorf("%v quiet left 50ms into the gap, want a little under %v", left, gap-50*time.Millisecond)
+	}
+	tracker.Write(listen(rate / 10))
+	if left := tracker.QuietLeft(); left != 0 {
+		t.Errorf("%v quiet left in the burst", left)
+	}
+}
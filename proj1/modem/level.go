@@ -0,0 +1,156 @@
+package modem
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// The receiver can't tell a weak tone from a loud room by the fft peak alone,
+// so it keeps track of how loud the room is. While idle it measures the noise
+// power in every band, and every decision afterwards is made relative to it.
+//
+// Noise is kept as power spectral density in raw input units (before the AGC),
+// mean |X|^2*L over the band, so a peak of amplitude a in a window of L frames
+// compares as a^2*L/density regardless of window length and gain changes.
+
+// a stretch of preamble slices has to average this far above the noise floor
+const min_preamble_snr_db = 6.0
+
+// a symbol whose median band is below this is taken as the sender having gone
+// quiet, e.g. the preamble was a false alarm, and the frame is dropped
+const min_symbol_snr_db = 3.0
+
+// floor for the noise estimate, so digital silence doesn't divide by zero
+const min_noise_density = 1e-12
+
+// the floor drops quickly after a noise burst ends but rises slowly, so a
+// preamble that hasn't been recognized yet barely moves it
+const noise_alpha_down = 0.3
+const noise_alpha_up = 0.02
+
+const agc_target_rms = 0.1
+const agc_max_gain = 1000.0
+const agc_min_gain = 0.001
+const agc_attack = 50 * time.Millisecond
+const agc_release = time.Second
+
+type NoiseFloor struct {
+	p       Profile
+	density []float64
+	primed  bool
+}
+
+func NewNoiseFloor(p Profile) *NoiseFloor {
+	return &NoiseFloor{p: p, density: make([]float64, p.Bands)}
+}
+
+// band that frequency f falls into, clamped to the modulation band
+func (n *NoiseFloor) band(f float64) int {
+	k := int((f - n.p.LowFreq) / n.p.BandWidth())
+	return min(max(k, 0), n.p.Bands-1)
+}
+
+// Update folds in the amplitude spectrum of a window of L frames that holds
+// no signal, measured after the given gain.
+func (n *NoiseFloor) Update(energy []float64, L int, gain float64) {
+	// digital silence, a muted input or the receiver's warm-up, says
+	// nothing about the room
+	silent := true
+	for _, a := range energy {
+		if a != 0 {
+			silent = false
+			break
+		}
+	}
+	if silent {
+		return
+	}
+	fs := float64(n.p.SampleRate)
+	for k := range n.density {
+		low := n.p.LowFreq + float64(k)*n.p.BandWidth()
+		i_start := int(low * float64(L) / fs)
+		i_end := min(int((low+n.p.BandWidth())*float64(L)/fs), len(energy))
+		if i_end <= i_start {
+			continue
+		}
+		sum := 0.0
+		for _, a := range energy[i_start:i_end] {
+			sum += a * a
+		}
+		density := max(sum/float64(i_end-i_start)*float64(L)/(gain*gain), min_noise_density)
+		switch {
+		case !n.primed:
+			n.density[k] = density
+		case density < n.density[k]:
+			n.density[k] += noise_alpha_down * (density - n.density[k])
+		default:
+			n.density[k] += noise_alpha_up * (density - n.density[k])
+		}
+	}
+	n.primed = true
+}
+
+// SNR in dB of a peak of the given amplitude at frequency f, measured in a
+// window of L frames after the given gain.
+func (n *NoiseFloor) SNR(f float64, amplitude float64, L int, gain float64) float64 {
+	power := amplitude * amplitude * float64(L) / (gain * gain)
+	return 10 * math.Log10(max(power, min_noise_density)/max(n.density[n.band(f)], min_noise_density))
+}
+
+// Level is the noise floor of every band in dB relative to full scale.
+func (n *NoiseFloor) Level() []float64 {
+	levels := make([]float64, len(n.density))
+	for k, d := range n.density {
+		levels[k] = 10 * math.Log10(max(d, min_noise_density))
+	}
+	return levels
+}
+
+// AGC scales the input so it sits around agc_target_rms, whatever the
+// distance to the speaker. It follows a rising level within agc_attack and a
+// falling one within agc_release, and can be held while a frame is decoded so
+// the symbols of one frame are all scaled alike.
+type AGC struct {
+	gain         float64
+	power        float64
+	attack_coef  float64
+	release_coef float64
+}
+
+func NewAGC(sample_rate int) *AGC {
+	coef := func(d time.Duration) float64 {
+		return 1 - math.Exp(-1/(d.Seconds()*float64(sample_rate)))
+	}
+	return &AGC{gain: 1, attack_coef: coef(agc_attack), release_coef: coef(agc_release)}
+}
+
+func (a *AGC) Gain() float64 {
+	return a.gain
+}
+
+// Apply scales samples in place, updating the gain unless hold is set.
+func (a *AGC) Apply(samples []float64, hold bool) {
+	for i, x := range samples {
+		if !hold {
+			coef := a.release_coef
+			if x*x > a.power {
+				coef = a.attack_coef
+			}
+			a.power += coef * (x*x - a.power)
+			if a.power > 0 {
+				a.gain = min(max(agc_target_rms/math.Sqrt(a.power), agc_min_gain), agc_max_gain)
+			}
+		}
+		samples[i] = x * a.gain
+	}
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
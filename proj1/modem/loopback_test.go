@@ -0,0 +1,88 @@
+package modem
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// loopback_frame_bits is how much of the message goes in every frame, well
+// under MaxPacketBits so a message takes several
+const loopback_frame_bits = 1000
+
+// a message of random bits, split into frames played one after the other
+// through the simulated channel and heard by a receiver fed in sound card
+// sized chunks, as the loopback command does
+func TestLoopbackFrames(t *testing.T) {
+	cases := []struct {
+		profile string
+		bits    int
+		snr     float64
+		drift   float64
+	}{
+		{"default", 2000, math.Inf(1), 0},
+		{"fast", 10000, math.Inf(1), 0},
+		{"fast", 10000, 20, 0},
+		{"fast", 10000, 20, 20},
+		{"burst", 10000, 20, 0},
+	}
+	for _, c := range cases {
+		p, err := LookupProfile(c.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		random := rand.New(rand.NewSource(1))
+		message := make(BitString, c.bits)
+		for i := range message {
+			message[i] = big.NewInt(random.Int63n(2))
+		}
+
+		// the receiver wants two symbols' worth of samples after a frame
+		// before it looks for the next preamble
+		gap := make([]float32, p.frames(2*p.SymbolDuration))
+		signal := []float32{}
+		for i := 0; i < len(message); i += loopback_frame_bits {
+			packet, err := p.BuildPacket(message[i:min(i+loopback_frame_bits, len(message))])
+			if err != nil {
+				t.Fatal(err)
+			}
+			signal = append(signal, p.Transmission(packet)...)
+			signal = append(signal, gap...)
+		}
+		captured := NewChannel(p.SampleRate, c.snr, c.drift, 1).Apply(signal)
+
+		frames := []Frame{}
+		receiver := NewReceiver(p)
+		receiver.OnFrame = func(f Frame) { frames = append(frames, f) }
+		for i := 0; i < len(captured); i += 512 {
+			receiver.Write(captured[i:min(i+512, len(captured))])
+		}
+
+		want := (len(message) + loopback_frame_bits - 1) / loopback_frame_bits
+		if len(frames) != want {
+			t.Errorf("%s at %v dB: received %d frames, sent %d", c.profile, c.snr, len(frames), want)
+			continue
+		}
+		got := []byte{}
+		for i, f := range frames {
+			if !f.ChecksumOK {
+				t.Errorf("%s at %v dB: frame %d failed the checksum", c.profile, c.snr, i)
+			}
+			got = append(got, f.Bits...)
+		}
+		if len(got) != len(message) {
+			t.Errorf("%s at %v dB: received %d bits, sent %d", c.profile, c.snr, len(got), len(message))
+			continue
+		}
+		errors := 0
+		for i, v := range message {
+			if int64(got[i]) != v.Int64() {
+				errors++
+			}
+		}
+		if errors > 0 {
+			t.Errorf("%s at %v dB, %v ppm drift: %d of %d bits wrong", c.profile, c.snr, c.drift, errors, len(message))
+		}
+	}
+}
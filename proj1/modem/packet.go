@@ -0,0 +1,162 @@
+package modem
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"slices"
+)
+
+// A packet on the air is
+//
+//	[length (LenLength symbols), modulo, hash, data...]
+//
+// where length counts modulo + hash + data and modulo is the number of bits
+// in the last data symbol (0 if it is full).
+type BitString = []*big.Int
+
+var ErrMessageTooLong = errors.New("message too long")
+
+func ReadBitString(s string) BitString {
+	out := BitString{}
+	for _, v := range s {
+		if v == '1' {
+			out = append(out, big.NewInt(1))
+		} else if v == '0' {
+			out = append(out, big.NewInt(0))
+		}
+	}
+	return out
+}
+
+// BytesToBitString spreads bytes out into bits MSB first, for messages that
+// start out as bytes.
+func BytesToBitString(data []byte) BitString {
+	out := make(BitString, 8*len(data))
+	for i := range out {
+		out[i] = big.NewInt(int64(data[i/8] >> (7 - i%8) & 1))
+	}
+	return out
+}
+
+// PackBits packs 0/1 bytes, as in Frame.Bits, into bytes MSB first, the last
+// one padded with 0.
+func PackBits(bits []byte) []byte {
+	out := make([]byte, (len(bits)+7)/8)
+	for i, b := range bits {
+		if b != 0 {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+func RandomBitString(l int) BitString {
+	out := make(BitString, l)
+	for i := 0; i < len(out); i++ {
+		out[i] = big.NewInt(rand.Int63n(2))
+	}
+	return out
+}
+
+func encode_int(_l int64, bit_per_sym int) BitString {
+	l := big.NewInt(_l)
+
+	output := BitString{}
+	mask := big.NewInt(1)
+	mask.Lsh(mask, uint(bit_per_sym))
+	mask.Sub(mask, big.NewInt(1))
+	for !(l.IsInt64() && l.Int64() == 0) {
+		last_bit := big.NewInt(0)
+		last_bit.And(l, mask)
+		l.Rsh(l, uint(bit_per_sym))
+		output = append(output, last_bit)
+	}
+	slices.Reverse(output)
+	return output
+}
+
+func CalculateHash(msg BitString) *big.Int {
+	ret := big.NewInt(0)
+	for _, v := range msg {
+		ret.Xor(ret, v)
+	}
+	return ret
+}
+
+func pad_bitstring(length int, msg BitString) (BitString, error) {
+	if len(msg) > length {
+		return nil, ErrMessageTooLong
+	}
+	zeros := make(BitString, length-len(msg))
+	for i := 0; i < len(zeros); i++ {
+		zeros[i] = big.NewInt(0)
+	}
+	return append(zeros, msg...), nil
+}
+
+// packs bit_per_sym bits into every symbol MSB first, the last symbol is
+// padded with zeros on the right
+func ConvertBase(message BitString, bit_per_sym int) BitString {
+	out := BitString{}
+	for i := 0; i < len(message); i += bit_per_sym {
+		cur := big.NewInt(0)
+		for j := 0; j < bit_per_sym; j++ {
+			cur.Lsh(cur, 1)
+			if i+j < len(message) {
+				cur.Or(cur, message[i+j])
+			}
+		}
+		out = append(out, cur)
+	}
+	return out
+}
+
+// inverse of ConvertBase, modulo is the number of bits used in the last symbol,
+// a modulo out of range (it came over a noisy channel) is taken as a full one
+func SymbolsToBits(symbols BitString, bit_per_sym int, modulo int) []byte {
+	length := bit_per_sym * len(symbols)
+	if modulo > 0 && modulo < bit_per_sym && len(symbols) > 0 {
+		length -= bit_per_sym - modulo
+	}
+	output := make([]byte, max(length, 0))
+	for id, v := range symbols {
+		for i := 0; i < bit_per_sym; i++ {
+			cur_offset := id*bit_per_sym + (bit_per_sym - 1 - i)
+			if cur_offset >= len(output) {
+				continue
+			}
+			output[cur_offset] = byte(v.Bit(i))
+		}
+	}
+	return output
+}
+
+// BuildPacket turns a message of bits into the symbols of one packet.
+func (p Profile) BuildPacket(message BitString) (BitString, error) {
+	bit_per_sym := p.BitsPerSymbol()
+	modulo := len(message) % bit_per_sym
+	data := ConvertBase(message, bit_per_sym)
+	hash := CalculateHash(data)
+
+	// the 1 + 1 below is for modulo and hash
+	length := len(data) + 1 + 1
+	length_encoded, err := pad_bitstring(p.LenLength, encode_int(int64(length), bit_per_sym))
+	if err != nil {
+		return nil, err
+	}
+
+	output := append(length_encoded, big.NewInt(int64(modulo)), hash)
+	return append(output, data...), nil
+}
+
+// MaxPacketBits is the longest message BuildPacket accepts.
+func (p Profile) MaxPacketBits() int {
+	bit_per_sym := p.BitsPerSymbol()
+	max_len := new(big.Int).Lsh(big.NewInt(1), uint(bit_per_sym*p.LenLength))
+	max_len.Sub(max_len, big.NewInt(1+1+1))
+	if !max_len.IsInt64() || max_len.Int64() > int64(1<<31)/int64(bit_per_sym) {
+		return 1 << 31
+	}
+	return int(max_len.Int64()) * bit_per_sym
+}
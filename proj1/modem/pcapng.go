@@ -0,0 +1,236 @@
+package modem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every frame sent or received can go into a pcapng file, so framing can be
+// looked at in Wireshark instead of in a dump of big.Ints. Frames use the
+// first user link type, each one a record of
+//
+//	version      1 byte, PcapVersion
+//	flags        1 byte, PcapReceived | PcapChecksumOK | PcapSNRKnown
+//	snr          2 bytes, signed, centi-dB
+//	length       4 bytes, the header's length field in symbols
+//	modulo       1 byte
+//	bits/symbol  1 byte
+//	hash length  2 bytes
+//	bit count    4 bytes
+//	hash         hash length bytes, big endian
+//	bits         bit count bits packed MSB first, the last byte padded with 0
+//
+// all big endian. The direction, and a readable summary as a comment, also go
+// into the block's options so they show without a dissector; the dissector
+// is ../wireshark/acoustic.lua, and it goes on into the bits when they're a
+// link frame, see ../link.
+
+const (
+	PcapLinkType = 147 // LINKTYPE_USER0
+	PcapVersion  = 1
+
+	PcapReceived   = 1 << 0
+	PcapChecksumOK = 1 << 1
+	PcapSNRKnown   = 1 << 2
+)
+
+const (
+	pcap_shb = 0x0A0D0D0A
+	pcap_idb = 0x00000001
+	pcap_epb = 0x00000006
+
+	pcap_opt_end     = 0
+	pcap_opt_comment = 1
+	pcap_shb_appl    = 4
+	pcap_if_name     = 2
+	pcap_epb_flags   = 2
+)
+
+type PcapRecord struct {
+	// when the frame was done, sent or received
+	Time       time.Time
+	Received   bool
+	ChecksumOK bool
+	// NaN when we don't know it, as for frames we sent
+	SNR           float64
+	Length        int
+	Modulo        int
+	BitsPerSymbol int
+	Hash          *big.Int
+	Bits          []byte
+}
+
+// SentRecord describes a packet BuildPacket made, as it goes out.
+func (p Profile) SentRecord(packet BitString) PcapRecord {
+	length := 0
+	for _, sym := range packet[:p.LenLength] {
+		length = length<<p.BitsPerSymbol() | int(sym.Int64())
+	}
+	modulo := int(packet[p.LenLength].Int64())
+	return PcapRecord{
+		Time:          time.Now(),
+		ChecksumOK:    true,
+		SNR:           math.NaN(),
+		Length:        length,
+		Modulo:        modulo,
+		BitsPerSymbol: p.BitsPerSymbol(),
+		Hash:          packet[p.LenLength+1],
+		Bits:          SymbolsToBits(packet[p.LenLength+2:], p.BitsPerSymbol(), modulo),
+	}
+}
+
+// ReceivedRecord describes a frame the receiver handed to OnFrame.
+func (p Profile) ReceivedRecord(f Frame) PcapRecord {
+	return PcapRecord{
+		Time:          time.Now(),
+		Received:      true,
+		ChecksumOK:    f.ChecksumOK,
+		SNR:           f.SNR,
+		Length:        len(f.Symbols) + 1 + 1,
+		Modulo:        f.Modulo,
+		BitsPerSymbol: p.BitsPerSymbol(),
+		Hash:          f.Hash,
+		Bits:          f.Bits,
+	}
+}
+
+// PcapWriter is safe to share between a sending and a receiving goroutine.
+type PcapWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+}
+
+// NewPcapWriter creates path and writes the section and interface headers,
+// name ends up as the interface's name.
+func NewPcapWriter(path string, name string) (*PcapWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &PcapWriter{file: file, buf: bufio.NewWriter(file)}
+
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1A2B3C4D)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	// section length unknown
+	shb = binary.LittleEndian.AppendUint64(shb, math.MaxUint64)
+	shb = pcap_option(shb, pcap_shb_appl, []byte("cs120 modem"))
+	shb = pcap_option(shb, pcap_opt_end, nil)
+	w.block(pcap_shb, shb)
+
+	idb := binary.LittleEndian.AppendUint16(nil, PcapLinkType)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	// no snap length
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	idb = pcap_option(idb, pcap_if_name, []byte(name))
+	idb = pcap_option(idb, pcap_opt_end, nil)
+	w.block(pcap_idb, idb)
+	return w, w.buf.Flush()
+}
+
+// Write adds one frame, flushed right away so the file is usable while the
+// link is still up.
+func (w *PcapWriter) Write(r PcapRecord) error {
+	data := r.Marshal()
+	micros := uint64(r.Time.UnixMicro())
+	epb := binary.LittleEndian.AppendUint32(nil, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(micros>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(micros))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pad4(len(data)))...)
+
+	// direction in the low two bits, 1 inbound, 2 outbound
+	direction := uint32(2)
+	if r.Received {
+		direction = 1
+	}
+	epb = pcap_option(epb, pcap_epb_flags, binary.LittleEndian.AppendUint32(nil, direction))
+	epb = pcap_option(epb, pcap_opt_comment, []byte(r.Summary()))
+	epb = pcap_option(epb, pcap_opt_end, nil)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.block(pcap_epb, epb)
+	return w.buf.Flush()
+}
+
+func (w *PcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Marshal is the record as it goes into the capture.
+func (r PcapRecord) Marshal() []byte {
+	flags := byte(0)
+	if r.Received {
+		flags |= PcapReceived
+	}
+	if r.ChecksumOK {
+		flags |= PcapChecksumOK
+	}
+	snr := int16(0)
+	if !math.IsNaN(r.SNR) {
+		flags |= PcapSNRKnown
+		snr = int16(max(min(math.Round(r.SNR*100), math.MaxInt16), math.MinInt16))
+	}
+	var hash []byte
+	if r.Hash != nil {
+		hash = r.Hash.Bytes()
+	}
+	out := []byte{PcapVersion, flags}
+	out = binary.BigEndian.AppendUint16(out, uint16(snr))
+	out = binary.BigEndian.AppendUint32(out, uint32(r.Length))
+	out = append(out, byte(r.Modulo), byte(r.BitsPerSymbol))
+	out = binary.BigEndian.AppendUint16(out, uint16(len(hash)))
+	out = binary.BigEndian.AppendUint32(out, uint32(len(r.Bits)))
+	out = append(out, hash...)
+	return append(out, PackBits(r.Bits)...)
+}
+
+func (r PcapRecord) Summary() string {
+	direction := "sent"
+	if r.Received {
+		direction = "received"
+	}
+	checksum := "checksum ok"
+	if !r.ChecksumOK {
+		checksum = "checksum bad"
+	}
+	s := fmt.Sprintf("%s %d bits, %s", direction, len(r.Bits), checksum)
+	if !math.IsNaN(r.SNR) {
+		s += fmt.Sprintf(", snr %.1f dB", r.SNR)
+	}
+	return s
+}
+
+func (w *PcapWriter) block(kind uint32, body []byte) {
+	total := uint32(12 + len(body))
+	w.buf.Write(binary.LittleEndian.AppendUint32(nil, kind))
+	w.buf.Write(binary.LittleEndian.AppendUint32(nil, total))
+	w.buf.Write(body)
+	w.buf.Write(binary.LittleEndian.AppendUint32(nil, total))
+}
+
+func pcap_option(out []byte, code uint16, value []byte) []byte {
+	out = binary.LittleEndian.AppendUint16(out, code)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(value)))
+	out = append(out, value...)
+	return append(out, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,83 @@
+package modem
+
+import "fmt"
+
+// A channel plan lets several links share a room. The spectrum a profile
+// spans, preamble and data, is cut into Channels equal slices with a guard
+// at either edge, and a link on channel k moves into slice k: the preamble
+// sweeps (or a code spreads over) all of it, and the data tones keep their
+// spacing, there are just fewer bands. The receiver's band pass then sits on
+// the slice's edges, see PassBand, and is steeper than usual so neighbours
+// barely get through.
+
+// fraction of a channel's width kept free at either edge
+const channel_guard = 0.1
+
+// Q of an 8th order butterworth split into four biquads, for the steeper band
+// pass of a channel
+var butterworth8_q = []float64{0.5098, 0.6013, 0.9000, 2.5629}
+
+// Span is the part of the spectrum the profile uses, preamble and data.
+func (p Profile) Span() (float64, float64) {
+	return min(p.LowFreq, p.PreambleStartFreq, p.PreambleFinalFreq), max(p.HighFreq, p.PreambleStartFreq, p.PreambleFinalFreq)
+}
+
+// WithChannel moves the profile onto channel k of a plan of n channels over
+// its span. n of 0 or 1 is the whole span, as if there was no plan.
+func (p Profile) WithChannel(k int, n int) (Profile, error) {
+	if n <= 1 {
+		if k != 0 {
+			return p, fmt.Errorf("profile %s: channel %d without a channel plan", p.Name, k)
+		}
+		return p, nil
+	}
+	if k < 0 || k >= n {
+		return p, fmt.Errorf("profile %s: channel %d out of 0..%d", p.Name, k, n-1)
+	}
+	low, high := p.Span()
+	width := (high - low) / float64(n)
+	inner_low := low + float64(k)*width + channel_guard*width
+	inner_high := low + float64(k+1)*width - channel_guard*width
+
+	band_width := p.BandWidth()
+	q := p
+	q.Name = fmt.Sprintf("%s/ch%d", p.Name, k)
+	q.Channel, q.Channels = k, n
+	q.ChannelLowFreq, q.ChannelHighFreq = low+float64(k)*width, low+float64(k+1)*width
+	q.BandPass = true
+	q.Bands = max(int((inner_high-inner_low)/band_width), 1)
+	q.LowFreq = inner_low
+	q.HighFreq = min(inner_low+float64(q.Bands)*band_width, inner_high)
+	// the chirp keeps sweeping up or down
+	q.PreambleStartFreq, q.PreambleFinalFreq = inner_low, inner_high
+	if p.PreambleFinalFreq < p.PreambleStartFreq {
+		q.PreambleStartFreq, q.PreambleFinalFreq = inner_high, inner_low
+	}
+	// the receiver takes a non-zero first length symbol for noise, so the
+	// length has to fit in the symbols after it, keep as much room as before
+	// up to 16 bits
+	length_bits := min(p.BitsPerSymbol()*(p.LenLength-1), 16)
+	if bits := q.BitsPerSymbol(); bits > 0 {
+		q.LenLength = max(p.LenLength, 1+(length_bits+bits-1)/bits)
+	}
+	if err := q.Validate(); err != nil {
+		return p, fmt.Errorf("%d channels are too narrow for profile %s: %w", n, p.Name, err)
+	}
+	return q, nil
+}
+
+// ChannelPlan lists the bands of every channel of a plan of n over the profile,
+// for tools to print.
+func (p Profile) ChannelPlan(n int) []string {
+	plan := []string{}
+	for k := 0; k < n; k++ {
+		q, err := p.WithChannel(k, n)
+		if err != nil {
+			plan = append(plan, fmt.Sprintf("channel %d: %v", k, err))
+			continue
+		}
+		plan = append(plan, fmt.Sprintf("channel %d: %.0f-%.0f Hz, data %.0f-%.0f Hz in %d bands, preamble %.0f-%.0f Hz, %.0f bit/s",
+			k, q.ChannelLowFreq, q.ChannelHighFreq, q.LowFreq, q.HighFreq, q.Bands, q.PreambleStartFreq, q.PreambleFinalFreq, q.BitRate()))
+	}
+	return plan
+}
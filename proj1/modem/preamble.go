@@ -0,0 +1,144 @@
+package modem
+
+import (
+	"fmt"
+	"math"
+)
+
+// Besides the linear chirp, a preamble can be a spreading code keyed onto a
+// carrier in the middle of [PreambleStartFreq, PreambleFinalFreq]. The code's
+// PreambleLength chips share PreambleDuration between them, so the chip rate,
+// and with it the bandwidth, is PreambleLength/PreambleDuration. Codes only
+// make sense with DetectCorrelate, which looks for whatever waveform the
+// profile sends. Codes of different families or roots correlate less with
+// each other than with themselves, so profiles sharing a room can tell their
+// frames apart with a PreambleThreshold in between; Zadoff-Chu codes of one
+// prime length and different roots are the furthest apart.
+const (
+	FamilyChirp = "chirp"
+	// binary phase keyed Barker code, lengths 2, 3, 4, 5, 7, 11 and 13
+	FamilyBarker = "barker"
+	// binary phase keyed maximal length sequence, lengths 2^n-1 for n in 2..12
+	FamilyMSequence = "mseq"
+	// Zadoff-Chu sequence of root PreambleRoot, any odd length coprime to
+	// the root, keyed onto the carrier's phase so the envelope stays flat
+	FamilyZadoffChu = "zc"
+)
+
+var barker_codes = map[int][]float64{
+	2:  {1, -1},
+	3:  {1, 1, -1},
+	4:  {1, 1, -1, 1},
+	5:  {1, 1, 1, -1, 1},
+	7:  {1, 1, 1, -1, -1, 1, -1},
+	11: {1, 1, 1, -1, -1, -1, 1, -1, -1, 1, -1},
+	13: {1, 1, 1, 1, 1, -1, -1, 1, 1, -1, 1, -1, 1},
+}
+
+// feedback taps of a primitive polynomial for every LFSR degree we support
+var m_sequence_taps = map[int][]int{
+	2:  {2, 1},
+	3:  {3, 2},
+	4:  {4, 3},
+	5:  {5, 3},
+	6:  {6, 5},
+	7:  {7, 6},
+	8:  {8, 6, 5, 4},
+	9:  {9, 5},
+	10: {10, 7},
+	11: {11, 9},
+	12: {12, 11, 10, 4},
+}
+
+func (p Profile) PreambleFamilyName() string {
+	if p.PreambleFamily == "" {
+		return FamilyChirp
+	}
+	return p.PreambleFamily
+}
+
+// m_sequence runs a Fibonacci LFSR of the given degree for one period
+func m_sequence(degree int) []float64 {
+	taps := m_sequence_taps[degree]
+	state := uint(1)
+	out := make([]float64, 1<<degree-1)
+	for i := range out {
+		out[i] = float64(int(state&1)*2 - 1)
+		bit := uint(0)
+		for _, t := range taps {
+			bit ^= state >> (degree - t) & 1
+		}
+		state = state>>1 | bit<<(degree-1)
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// preamble_phases is the code as carrier phases: 0 or pi for the binary codes,
+// anything for Zadoff-Chu
+func (p Profile) preamble_phases() ([]float64, error) {
+	n := p.PreambleLength
+	var chips []float64
+	switch p.PreambleFamilyName() {
+	case FamilyBarker:
+		chips = barker_codes[n]
+		if chips == nil {
+			return nil, fmt.Errorf("no barker code of length %d", n)
+		}
+	case FamilyMSequence:
+		degree := 0
+		for 1<<degree-1 < n {
+			degree++
+		}
+		if 1<<degree-1 != n || m_sequence_taps[degree] == nil {
+			return nil, fmt.Errorf("no m-sequence of length %d, try 2^n-1 for n in 2..12", n)
+		}
+		chips = m_sequence(degree)
+	case FamilyZadoffChu:
+		root := max(p.PreambleRoot, 1)
+		if n < 3 || n%2 == 0 || gcd(n, root) != 1 {
+			return nil, fmt.Errorf("zadoff-chu needs an odd length coprime to the root, got %d and %d", n, root)
+		}
+		phases := make([]float64, n)
+		for k := range phases {
+			phases[k] = -math.Pi * float64(root) * float64(k) * float64(k+1) / float64(n)
+		}
+		return phases, nil
+	default:
+		return nil, fmt.Errorf("unknown preamble family %q", p.PreambleFamily)
+	}
+	phases := make([]float64, len(chips))
+	for k, c := range chips {
+		if c < 0 {
+			phases[k] = math.Pi
+		}
+	}
+	return phases, nil
+}
+
+// validate_preamble checks the family against the rest of the profile
+func (p Profile) validate_preamble() error {
+	if p.PreambleFamilyName() == FamilyChirp {
+		return nil
+	}
+	if p.PreambleDetector != DetectCorrelate {
+		return fmt.Errorf("profile %s: a %s preamble needs the %s detector", p.Name, p.PreambleFamilyName(), DetectCorrelate)
+	}
+	if _, err := p.preamble_phases(); err != nil {
+		return fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	chip_rate := float64(p.PreambleLength) / p.PreambleDuration.Seconds()
+	if chip_rate > math.Abs(p.PreambleFinalFreq-p.PreambleStartFreq) {
+		return fmt.Errorf("profile %s: %d chips in %v take %f Hz, more than the preamble band", p.Name, p.PreambleLength, p.PreambleDuration, chip_rate)
+	}
+	if p.frames(p.PreambleDuration) < 4*p.PreambleLength {
+		return fmt.Errorf("profile %s: %d chips in %v leave less than 4 samples a chip", p.Name, p.PreambleLength, p.PreambleDuration)
+	}
+	return nil
+}
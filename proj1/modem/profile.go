@@ -0,0 +1,259 @@
+package modem
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Profile is everything both ends have to agree on: how the band is split,
+// how long a symbol lasts and what the preamble looks like.
+//
+// The band [LowFreq, HighFreq] is split into Bands pieces, inside each piece
+// there's StatesPerBand() tones FreqStep Hz apart. A symbol picks one tone in
+// every piece, so it carries StatesPerBand()^Bands states, which we round down
+// to 2^BitsPerSymbol() for simplicity.
+type Profile struct {
+	Name string
+
+	SampleRate     int
+	SymbolDuration time.Duration
+	// cut from both ends of a symbol window before the fourier transform so
+	// we're more likely to analyze a single symbol
+	GuardDuration time.Duration
+
+	LowFreq  float64
+	HighFreq float64
+	FreqStep float64
+	Bands    int
+
+	// uses a linear chirp here
+	// f(t) = sin(2pi ((c / 2)t^2 + f0t) )
+	// unless PreambleFamily picks a code, see preamble.go, PreambleLength
+	// chips long (and of PreambleRoot for Zadoff-Chu) sent in the same band
+	PreambleDuration  time.Duration
+	PreambleStartFreq float64
+	PreambleFinalFreq float64
+	PreambleFamily    string
+	PreambleLength    int
+	PreambleRoot      int
+	// silence between the end of the preamble and the first symbol
+	SleepDuration time.Duration
+	// how the receiver looks for the preamble, DetectSlices (the default) or
+	// DetectCorrelate for preambles too short to follow slice by slice
+	PreambleDetector string
+	// normalized correlation DetectCorrelate wants, 0 for the default. Raise it
+	// when other profiles' preambles in the room come close
+	PreambleThreshold float64
+
+	// number of symbols used to send the packet length
+	LenLength int
+
+	// receiver prefilter, see Prefilter. A high pass at HighPassFreq (0 for
+	// none), a band pass around PassBand(), fixed notches and up to
+	// AdaptiveNotches more placed on tones that persist while idle
+	HighPassFreq    float64
+	BandPass        bool
+	NotchFreqs      []float64
+	AdaptiveNotches int
+
+	// where WithChannel put the profile, Channels is 0 without a channel plan
+	Channel         int
+	Channels        int
+	ChannelLowFreq  float64
+	ChannelHighFreq float64
+}
+
+var Profiles = map[string]Profile{
+	"default": {
+		Name:              "default",
+		SampleRate:        44100,
+		SymbolDuration:    800 * time.Millisecond,
+		GuardDuration:     20 * time.Millisecond,
+		LowFreq:           1000.0,
+		HighFreq:          17000.0,
+		FreqStep:          200.0,
+		Bands:             10,
+		PreambleDuration:  800 * time.Millisecond,
+		PreambleStartFreq: 1000.0,
+		PreambleFinalFreq: 5000.0,
+		SleepDuration:     500 * time.Millisecond,
+		LenLength:         2,
+		HighPassFreq:      20.0,
+		BandPass:          true,
+		AdaptiveNotches:   2,
+	},
+	"fast": {
+		Name:              "fast",
+		SampleRate:        44100,
+		SymbolDuration:    100 * time.Millisecond,
+		GuardDuration:     10 * time.Millisecond,
+		LowFreq:           700.0,
+		HighFreq:          18000.0,
+		FreqStep:          60.0,
+		Bands:             25,
+		PreambleDuration:  800 * time.Millisecond,
+		PreambleStartFreq: 1000.0,
+		PreambleFinalFreq: 5000.0,
+		SleepDuration:     300 * time.Millisecond,
+		LenLength:         2,
+		HighPassFreq:      20.0,
+		BandPass:          true,
+		AdaptiveNotches:   2,
+	},
+	// the fast profile's symbols behind 20ms of Zadoff-Chu code instead of
+	// 800ms of chirp, for short frames like acknowledgements
+	"ack": {
+		Name:              "ack",
+		SampleRate:        44100,
+		SymbolDuration:    100 * time.Millisecond,
+		GuardDuration:     10 * time.Millisecond,
+		LowFreq:           700.0,
+		HighFreq:          18000.0,
+		FreqStep:          60.0,
+		Bands:             25,
+		PreambleDuration:  20 * time.Millisecond,
+		PreambleStartFreq: 1000.0,
+		PreambleFinalFreq: 5000.0,
+		PreambleFamily:    FamilyZadoffChu,
+		PreambleLength:    31,
+		PreambleRoot:      1,
+		SleepDuration:     20 * time.Millisecond,
+		PreambleDetector:  DetectCorrelate,
+		LenLength:         2,
+		HighPassFreq:      20.0,
+		BandPass:          true,
+		AdaptiveNotches:   2,
+	},
+	// short frames that fit in the quiet gaps of a jammer, see JamTracker
+	"burst": {
+		Name:              "burst",
+		SampleRate:        44100,
+		SymbolDuration:    10 * time.Millisecond,
+		GuardDuration:     500 * time.Microsecond,
+		LowFreq:           1000.0,
+		HighFreq:          19000.0,
+		FreqStep:          450.0,
+		Bands:             20,
+		PreambleDuration:  10 * time.Millisecond,
+		PreambleStartFreq: 2000.0,
+		PreambleFinalFreq: 10000.0,
+		SleepDuration:     2 * time.Millisecond,
+		PreambleDetector:  DetectCorrelate,
+		LenLength:         2,
+		HighPassFreq:      20.0,
+		BandPass:          true,
+	},
+}
+
+func LookupProfile(name string) (Profile, error) {
+	p, ok := Profiles[name]
+	if !ok {
+		names := []string{}
+		for n := range Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("unknown profile %q, have %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// WithSampleRate runs the profile at another rate, 0 keeps its own. Tones and
+// durations are in Hz and seconds, so the two ends don't have to use the same
+// rate, only the same profile.
+func (p Profile) WithSampleRate(rate int) Profile {
+	if rate > 0 {
+		p.SampleRate = rate
+	}
+	return p
+}
+
+func (p Profile) BandWidth() float64 {
+	return (p.HighFreq - p.LowFreq) / float64(p.Bands)
+}
+
+func (p Profile) StatesPerBand() int {
+	return int(p.BandWidth() / p.FreqStep)
+}
+
+// StatesPerBand()^Bands
+func (p Profile) SymbolSetSize() *big.Int {
+	states := big.NewInt(int64(p.StatesPerBand()))
+	size := big.NewInt(1)
+	for i := 0; i < p.Bands; i++ {
+		size.Mul(size, states)
+	}
+	return size
+}
+
+func (p Profile) BitsPerSymbol() int {
+	return p.SymbolSetSize().BitLen() - 1
+}
+
+// number of frames per single symbol
+func (p Profile) FramesPerSymbol() int {
+	return p.frames(p.SymbolDuration)
+}
+
+func (p Profile) BitRate() float64 {
+	return float64(p.BitsPerSymbol()) / p.SymbolDuration.Seconds()
+}
+
+func (p Profile) frames(d time.Duration) int {
+	return int(math.Ceil(d.Seconds() * float64(p.SampleRate)))
+}
+
+// the finest difference we can tell with sample rate fs is fs/L where L is the
+// length of the signal(L = t * fs), thus to differentiate by 20hz, 1/t = 20hz,
+// t = 1/20s = 500ms
+func (p Profile) Validate() error {
+	if p.SampleRate <= 0 {
+		return fmt.Errorf("profile %s: sample rate must be positive", p.Name)
+	}
+	if p.Bands <= 0 || p.LowFreq <= 0 || p.HighFreq <= p.LowFreq {
+		return fmt.Errorf("profile %s: empty modulation band [%f %f] / %d", p.Name, p.LowFreq, p.HighFreq, p.Bands)
+	}
+	for _, f := range []float64{p.HighFreq, p.PreambleStartFreq, p.PreambleFinalFreq} {
+		if f >= float64(p.SampleRate)/2 {
+			return fmt.Errorf("profile %s: %f Hz is above the nyquist frequency at %d Hz", p.Name, f, p.SampleRate)
+		}
+	}
+	for _, f := range p.NotchFreqs {
+		if f <= 0 || f >= float64(p.SampleRate)/2 {
+			return fmt.Errorf("profile %s: can't put a notch at %f Hz", p.Name, f)
+		}
+	}
+	if p.HighPassFreq >= min(p.LowFreq, p.PreambleStartFreq, p.PreambleFinalFreq) {
+		return fmt.Errorf("profile %s: high pass at %f Hz cuts into the signal", p.Name, p.HighPassFreq)
+	}
+	if err := p.validate_preamble(); err != nil {
+		return err
+	}
+	switch p.PreambleDetector {
+	case "", DetectSlices:
+		if p.PreambleDuration < slice_num*slice_duration {
+			return fmt.Errorf("profile %s: a %v preamble is too short to detect by slices", p.Name, p.PreambleDuration)
+		}
+	case DetectCorrelate:
+	default:
+		return fmt.Errorf("profile %s: unknown preamble detector %q", p.Name, p.PreambleDetector)
+	}
+	if p.StatesPerBand() < 2 {
+		return fmt.Errorf("profile %s: band width %f fits less than 2 tones %f Hz apart", p.Name, p.BandWidth(), p.FreqStep)
+	}
+	window := p.SymbolDuration - 2*p.GuardDuration
+	if window <= 0 {
+		return fmt.Errorf("profile %s: guard %v leaves nothing of a %v symbol", p.Name, p.GuardDuration, p.SymbolDuration)
+	}
+	if lower_bound := 1.0 / window.Seconds(); lower_bound > p.FreqStep {
+		return fmt.Errorf("profile %s: frequency difference(%f) for modulation is too small compare to the lower limit %f", p.Name, p.FreqStep, lower_bound)
+	}
+	if p.BitsPerSymbol() < 1 {
+		return fmt.Errorf("profile %s: symbols carry no bits", p.Name)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package modem
+
+import (
+	"log/slog"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"time"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+const slice_duration = 40 * time.Millisecond
+const slice_inner_duration = 10 * time.Millisecond
+const slice_num = 10
+
+// the issue with this is: the bigger this is we can tollerant weaker signals but the possibility
+// of misidentification increases
+const cutoff_variance_preamble = 0.5
+
+// A Frame is one packet as the receiver decoded it.
+type Frame struct {
+	Bits       []byte
+	Modulo     int
+	Hash       *big.Int
+	ChecksumOK bool
+	Symbols    BitString
+	// mean over the symbols of the median band's tone to noise floor ratio
+	SNR float64
+}
+
+// Receiver is fed captured samples in whatever chunks the audio device hands
+// out. It waits for the preamble, then decodes one symbol every
+// SymbolDuration until it has the whole packet and passes it to OnFrame, after
+// which it goes back to waiting for the next preamble.
+type Receiver struct {
+	Profile Profile
+	Logger  *slog.Logger
+	Diag    *DiagWriter
+	OnFrame func(Frame)
+
+	rb               RingBuffer
+	samples_required int
+	is_idle          bool
+	frame_count_all  int
+	// the best preamble match seen so far, we only commit once the match
+	// starts getting worse so we don't lock on before the chirp is over
+	candidate     bool
+	best_variance float64
+	best_shift    float64
+	best_snr      float64
+	// or, when correlating, how well it matched the template
+	best_correlation float64
+	best_at          int
+	template         []float64
+	prefilter        *Prefilter
+	noise            *NoiseFloor
+	since_noise      int
+	agc              *AGC
+	snr_sum          float64
+	received         BitString
+	packet_length    int
+	do_offset        int
+	tmp              []float64
+}
+
+func NewReceiver(p Profile) *Receiver {
+	samples_required := p.frames(p.PreambleDuration)
+	samples_required = max(samples_required, p.frames(2*p.SymbolDuration))
+	r := &Receiver{
+		Profile:          p,
+		Logger:           discard_logger(),
+		rb:               newRb(max(samples_required*10, p.SampleRate)),
+		samples_required: samples_required,
+		tmp:              make([]float64, p.FramesPerSymbol()*3),
+		prefilter:        NewPrefilter(p),
+		noise:            NewNoiseFloor(p),
+		agc:              NewAGC(p.SampleRate),
+	}
+	if p.PreambleDetector == DetectCorrelate {
+		r.template = preamble_template(p)
+	}
+	r.Reset()
+	// start out as if we'd been listening to a quiet room, so a preamble right at
+	// the start of a recording isn't missed
+	r.Write(make([]float32, samples_required))
+	return r
+}
+
+// Reset drops whatever packet is in progress and waits for a new preamble.
+func (r *Receiver) Reset() {
+	r.is_idle = true
+	r.frame_count_all = 0
+	r.candidate = false
+	r.received = BitString{}
+	r.packet_length = 0
+	r.do_offset = 0
+	r.snr_sum = 0
+}
+
+func (r *Receiver) Idle() bool {
+	return r.is_idle
+}
+
+// Busy is true from the first sign of a preamble to the end of the frame,
+// while someone is talking to us.
+func (r *Receiver) Busy() bool {
+	return !r.is_idle || r.candidate
+}
+
+// NoiseLevel is the noise floor of every band in dB, lowest band first.
+func (r *Receiver) NoiseLevel() []float64 {
+	return r.noise.Level()
+}
+
+// Notches are the frequencies the prefilter currently cuts.
+func (r *Receiver) Notches() []float64 {
+	return r.prefilter.Notches()
+}
+
+// Gain is what the AGC currently multiplies the input by.
+func (r *Receiver) Gain() float64 {
+	return r.agc.Gain()
+}
+
+func (r *Receiver) Write(samples []float32) {
+	if len(samples) > r.rb.Length() {
+		panic("ring buffer too small")
+	}
+	r.frame_count_all += len(samples)
+	scaled := make([]float64, len(samples))
+	for i, f := range samples {
+		scaled[i] = float64(f)
+	}
+	r.prefilter.Apply(scaled)
+	// the gain holds from the first sign of a preamble to the end of the frame
+	r.agc.Apply(scaled, r.Busy())
+	for _, f := range scaled {
+		r.rb.Write(f)
+	}
+	if r.is_idle {
+		r.track_noise(len(samples))
+		if r.template != nil {
+			r.correlate(len(samples))
+		} else {
+			r.detect_preamble()
+		}
+	} else {
+		r.decode_symbols()
+	}
+}
+
+// measure the noise floor and look for tones to notch on the latest slice
+// whenever a new one is complete, unless it might be the start of a preamble
+func (r *Receiver) track_noise(count int) {
+	p := r.Profile
+	r.since_noise += count
+	slice_width := p.frames(slice_duration)
+	if r.since_noise < slice_width || r.candidate || r.frame_count_all < slice_width {
+		return
+	}
+	r.since_noise = 0
+	energy := sig_to_energy_at_freq(r.rb.CopyStrideRight(0, slice_width))
+	r.noise.Update(energy, slice_width, r.agc.Gain())
+	if freq, ok := r.prefilter.Observe(energy, slice_width, slice_duration); ok {
+		r.Logger.Info(EvNotchAdded, "freq", freq, "notches", r.prefilter.Notches())
+	}
+}
+
+// check whether we can start to work, the following conditions need to met:
+// 1. we have enough samples to accept a preamble
+// 2. in the last slice the peak frequency is around the final chirp frequency
+// 3. the peak frequency in the last slice_num slices follows the characteristic of the chirp signal
+// 4. the peaks stand out from the noise floor by min_preamble_snr_db on average
+func (r *Receiver) detect_preamble() {
+	p := r.Profile
+	if r.frame_count_all < r.samples_required {
+		return
+	}
+	fs := float64(p.SampleRate)
+	chirp_rate := (p.PreambleFinalFreq - p.PreambleStartFreq) / p.PreambleDuration.Seconds()
+	slice_width := p.frames(slice_duration)
+	slice_inner_width := p.frames(slice_inner_duration)
+
+	variance := 0.0
+	freq_shift := 0.0
+	snr := 0.0
+	for i := 0; i < slice_num; i++ {
+		to_analyze := r.rb.CopyStrideRight(i*slice_width+slice_inner_width, slice_width-2*slice_inner_width)
+		energy := sig_to_energy_at_freq(to_analyze)
+		L := len(to_analyze)
+
+		peak := arg_max(energy)
+		max_energy_freq := fs * float64(peak) / float64(L)
+		snr += r.noise.SNR(max_energy_freq, energy[peak], L, r.agc.Gain()) / slice_num
+
+		avg_freq := p.PreambleFinalFreq - (float64(i)+0.5)*slice_duration.Seconds()*chirp_rate
+		if i == 0 && math.Abs(avg_freq-max_energy_freq) < slice_duration.Seconds()*chirp_rate {
+			freq_shift = max_energy_freq - avg_freq
+		}
+		delta := (avg_freq - max_energy_freq + freq_shift) / avg_freq
+		variance += delta * delta
+	}
+	r.Logger.Debug(EvPreambleScore, "variance", variance, "freq_shift", freq_shift, "snr_db", snr)
+	if variance < cutoff_variance_preamble && snr >= min_preamble_snr_db && (!r.candidate || variance < r.best_variance) {
+		r.candidate = true
+		r.best_variance, r.best_shift, r.best_snr, r.best_at = variance, freq_shift, snr, r.frame_count_all
+		return
+	}
+	if r.candidate {
+		r.Logger.Info(EvPreambleDetected, "variance", r.best_variance, "freq_shift", r.best_shift, "snr_db", r.best_snr, "gain", r.agc.Gain())
+		r.is_idle = false
+		r.candidate = false
+		// we reset and start to count frames since the end of the preamble, a
+		// negative shift means the chirp hadn't finished yet at the best match
+		time_shift := r.best_shift / chirp_rate
+		r.frame_count_all = r.frame_count_all - r.best_at + int(time_shift*fs)
+	}
+}
+
+func (r *Receiver) decode_symbols() {
+	p := r.Profile
+	fs := float64(p.SampleRate)
+	sleep_frames := p.frames(p.SleepDuration)
+	if r.frame_count_all <= sleep_frames {
+		return
+	}
+	bit_per_sym := p.BitsPerSymbol()
+	mod_state_num := big.NewInt(int64(p.StatesPerBand()))
+	band_width := p.BandWidth()
+	gap_freq := p.FreqStep / 2
+
+	bits_read := len(r.received)
+	modulated_width := p.FramesPerSymbol()
+	frame_count_effective := r.frame_count_all - sleep_frames
+	bits_expected := frame_count_effective / modulated_width
+	left_over := frame_count_effective % modulated_width
+	gap_width := p.frames(p.GuardDuration)
+	for ; bits_read < bits_expected; bits_read++ {
+		// leave gap_width empty on both sides so we're more likely get a good result from fourier transform
+		to_analyze := r.rb.CopyStrideRight(gap_width+left_over+(bits_expected-bits_read-1)*modulated_width, modulated_width-2*gap_width)
+		L := len(to_analyze)
+		// energy[i] correponds to frequency Fs * i/L
+		energy_cur := sig_to_energy_at_freq(to_analyze)
+
+		sym := big.NewInt(0)
+		band_snr := make([]float64, 0, p.Bands)
+		start_freq := p.HighFreq - band_width - gap_freq
+		for k := p.Bands - 1; k >= 0; k-- {
+			end_freq := start_freq + band_width
+			// Fs * i_start / L = start_freq
+			i_start := int(start_freq * float64(L) / fs)
+			i_end := int(end_freq * float64(L) / fs)
+			for i := i_start; i < i_end; i++ {
+				ratio := float64(i-i_start) / float64(i_end-i_start)
+				r.tmp[i] = energy_cur[i] - ((1-ratio)*energy_cur[i_start] + ratio*energy_cur[i_end])
+			}
+			peak := arg_max(r.tmp[i_start:i_end]) + i_start
+			max_energy_freq := fs * float64(peak) / float64(L)
+			band_snr = append(band_snr, r.noise.SNR(max_energy_freq, energy_cur[peak], L, r.agc.Gain()))
+			// max_energy_freq = start_freq + gap_freq + part * step
+			part := int(math.Round((max_energy_freq - (start_freq + gap_freq)) / p.FreqStep))
+			r.Logger.Debug(EvBandDecoded, "symbol", len(r.received), "band", k, "low_freq", start_freq+gap_freq, "high_freq", end_freq+gap_freq, "peak_freq", max_energy_freq, "part", part)
+			if r.Diag != nil {
+				energies := tone_energies(r.tmp[:i_end], L, fs, start_freq+gap_freq, p.FreqStep, p.StatesPerBand())
+				second, margin := runner_up(energies, part)
+				err := r.Diag.Write(DiagRecord{
+					Symbol:   len(r.received),
+					Band:     k,
+					LowFreq:  start_freq + gap_freq,
+					Chosen:   part,
+					RunnerUp: second,
+					Margin:   margin,
+					Energy:   energies,
+				})
+				if err != nil {
+					r.Logger.Warn("diagnostics", "err", err)
+				}
+			}
+			part = min(max(part, 0), p.StatesPerBand()-1)
+			sym.Mul(sym, mod_state_num)
+			sym.Add(sym, big.NewInt(int64(part)))
+			start_freq -= band_width
+		}
+
+		snr := median(band_snr)
+		if snr < min_symbol_snr_db {
+			r.Logger.Warn(EvCarrierLost, "index", len(r.received), "snr_db", snr)
+			r.Reset()
+			return
+		}
+		r.snr_sum += snr
+		r.received = append(r.received, sym)
+		r.Logger.Info(EvSymbolDecoded, "index", len(r.received)-1, "symbol", sym.String(), "snr_db", snr)
+		// first symbol of length must be 0 if we never sent data over 2^bit_per_sym symbols
+		if len(r.received) == r.do_offset+1 && !(sym.IsInt64() && sym.Int64() == 0) {
+			r.do_offset += 1
+			r.Logger.Debug(EvSymbolDiscarded, "index", len(r.received)-1, "reason", "non-zero symbol before length")
+		} else if len(r.received)-r.do_offset <= p.LenLength {
+			r.packet_length = (r.packet_length << bit_per_sym) | int(sym.Int64())
+			if len(r.received)-r.do_offset == p.LenLength && r.packet_length == 0 {
+				r.do_offset += 1
+				r.Logger.Debug(EvSymbolDiscarded, "index", len(r.received)-1, "reason", "leading zero")
+			} else if len(r.received)-r.do_offset == p.LenLength {
+				r.Logger.Info(EvHeaderDecoded, "length", r.packet_length)
+			}
+		} else if len(r.received)-r.do_offset == p.LenLength+r.packet_length {
+			r.finale()
+			return
+		}
+	}
+}
+
+func (r *Receiver) finale() {
+	p := r.Profile
+	header := r.do_offset + p.LenLength
+	modulo := int(r.received[header].Int64())
+	packet_hash := r.received[header+1]
+	packet_data := r.received[header+1+1:]
+	r.Logger.Debug(EvPacketReceived, "length", r.packet_length, "modulo", modulo, "hash", packet_hash, "content", packet_data)
+
+	computed_hash := CalculateHash(packet_data)
+	hash_ok := computed_hash.Cmp(packet_hash) == 0
+	snr := r.snr_sum / float64(len(r.received))
+	if hash_ok {
+		r.Logger.Info(EvChecksum, "ok", true, "hash", packet_hash.String(), "snr_db", snr)
+	} else {
+		r.Logger.Warn(EvChecksum, "ok", false, "hash", packet_hash.String(), "computed", computed_hash.String(), "snr_db", snr)
+	}
+	frame := Frame{
+		Bits:       SymbolsToBits(packet_data, p.BitsPerSymbol(), modulo),
+		Modulo:     modulo,
+		Hash:       packet_hash,
+		ChecksumOK: hash_ok,
+		Symbols:    packet_data,
+		SNR:        snr,
+	}
+	r.Reset()
+	if r.OnFrame != nil {
+		r.OnFrame(frame)
+	}
+}
+
+func sig_to_energy_at_freq(to_analyze []float64) []float64 {
+	spectrum := fft.FFTReal(to_analyze)
+	L := len(to_analyze)
+
+	energy := make([]float64, L/2+1)
+	energy[0] = cmplx.Abs(spectrum[0]) / float64(L)
+	for i := 1; i < L/2; i += 1 {
+		energy[i] = 2 * cmplx.Abs(spectrum[i]) / float64(L)
+	}
+	return energy
+}
+
+func arg_max(s []float64) int {
+	ans := -1
+	val := 0.0
+	for i, v := range s {
+		if ans == -1 || v > val {
+			ans, val = i, v
+		}
+	}
+	return ans
+}
+
+type RingBuffer struct {
+	head  int
+	tail  int
+	inner []float64
+}
+
+func newRb(size int) RingBuffer {
+	return RingBuffer{
+		head:  0,
+		tail:  1,
+		inner: make([]float64, size+1),
+	}
+}
+
+func (rb *RingBuffer) Length() int {
+	return int(len(rb.inner))
+}
+
+func (rb *RingBuffer) Write(f float64) {
+	rb.inner[rb.tail] = f
+	rb.tail = (rb.tail + 1) % len(rb.inner)
+	if rb.tail == rb.head {
+		rb.head = (rb.head + 1) % len(rb.inner)
+	}
+}
+
+func (rb *RingBuffer) CopyStrideRight(rbegin int, count int) []float64 {
+	length := rb.tail - rb.head
+	end := len(rb.inner)
+	if rb.tail < rb.head {
+		length = rb.tail + (end - rb.head)
+	}
+	if length < count+rbegin {
+		panic("RB doesn't have enough data")
+	}
+	r_edge := rb.tail - rbegin
+	if r_edge <= 0 {
+		r_edge += end
+	}
+	result := make([]float64, count)
+	if r_edge >= count {
+		copy(result, rb.inner[r_edge-count:r_edge])
+	} else {
+		copy(result[count-r_edge:count], rb.inner[0:r_edge])
+		copy(result[0:count-r_edge], rb.inner[end-(count-r_edge):end])
+	}
+	return result
+}
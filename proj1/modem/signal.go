@@ -0,0 +1,166 @@
+package modem
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"time"
+)
+
+// The signals below are io.Readers producing mono float32 little endian
+// samples, which is what both oto and malgo want.
+
+type DataSig struct {
+	Profile Profile
+	Logger  *slog.Logger
+	data    BitString
+	offset  int
+}
+
+func NewDataSig(p Profile, data BitString) *DataSig {
+	return &DataSig{Profile: p, data: data}
+}
+
+func (c *DataSig) Len() int {
+	return len(c.data) * c.Profile.FramesPerSymbol()
+}
+
+func (c *DataSig) Read(buf []byte) (int, error) {
+	p := c.Profile
+	frame_per_sym := p.FramesPerSymbol()
+	mod_state_num := big.NewInt(int64(p.StatesPerBand()))
+	band_width := p.BandWidth()
+
+	sym := big.NewInt(0)
+	index_at_range_k_b := big.NewInt(0)
+	for buf_offset := 0; buf_offset+4 <= len(buf); buf_offset += 4 {
+		symbol_sent := c.offset / frame_per_sym
+		symbol_frame_id := c.offset % frame_per_sym
+		if symbol_sent >= len(c.data) {
+			return eof_if_empty(buf_offset)
+		}
+
+		sym.Set(c.data[symbol_sent])
+		if symbol_frame_id == 0 && c.Logger != nil {
+			c.Logger.Debug(EvSymbolSent, "index", symbol_sent, "symbol", sym.String())
+		}
+		phase := 2 * math.Pi * float64(symbol_frame_id) / float64(p.SampleRate)
+		cur_f := 0.0
+
+		cur_range_start_freq := p.LowFreq
+		for k := 0; k < p.Bands; k++ {
+			sym.DivMod(sym, mod_state_num, index_at_range_k_b)
+			index_at_range_k, _ := index_at_range_k_b.Float64()
+			freq_at_range_k := cur_range_start_freq + p.FreqStep*index_at_range_k
+			cur_f += math.Sin(freq_at_range_k * phase)
+			cur_range_start_freq += band_width
+		}
+		put_sample(buf[buf_offset:], float32(cur_f))
+		c.offset += 1
+	}
+	return len(buf) / 4 * 4, nil
+}
+
+type PreambleSig struct {
+	Profile Profile
+	offset  int
+	// the code's chips as carrier phases, nil for the chirp
+	phases []float64
+}
+
+func NewPreambleSig(p Profile) *PreambleSig {
+	s := &PreambleSig{Profile: p}
+	if p.PreambleFamilyName() != FamilyChirp {
+		// Validate has checked the code
+		s.phases, _ = p.preamble_phases()
+	}
+	return s
+}
+
+func (s *PreambleSig) Len() int {
+	return int(float64(s.Profile.SampleRate) * s.Profile.PreambleDuration.Seconds())
+}
+
+func (s *PreambleSig) Read(buf []byte) (int, error) {
+	p := s.Profile
+	chirp_rate := (p.PreambleFinalFreq - p.PreambleStartFreq) / p.PreambleDuration.Seconds()
+	carrier := (p.PreambleStartFreq + p.PreambleFinalFreq) / 2
+	fs := float64(p.SampleRate)
+	length := s.Len()
+	for i := 0; i < len(buf)/4; i++ {
+		if s.offset >= length {
+			return eof_if_empty(i * 4)
+		}
+		t := float64(s.offset)
+		var f float32
+		if s.phases == nil {
+			f = float32(math.Sin(2 * math.Pi * (chirp_rate/2.0/fs/fs*t*t + p.PreambleStartFreq/fs*t)))
+		} else {
+			chip := s.offset * len(s.phases) / length
+			f = float32(math.Sin(2*math.Pi*carrier/fs*t + s.phases[chip]))
+		}
+		put_sample(buf[4*i:], f)
+		s.offset += 1
+	}
+	return len(buf) / 4 * 4, nil
+}
+
+type Silence struct {
+	frames int
+}
+
+func NewSilence(p Profile, d time.Duration) *Silence {
+	return &Silence{frames: p.frames(d)}
+}
+
+func (s *Silence) Read(buf []byte) (int, error) {
+	n := min(len(buf)/4, s.frames)
+	clear(buf[:n*4])
+	s.frames -= n
+	return eof_if_empty(n * 4)
+}
+
+func eof_if_empty(n int) (int, error) {
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func put_sample(buf []byte, f float32) {
+	binary.LittleEndian.PutUint32(buf, math.Float32bits(f))
+}
+
+// Samples drains a float32 little endian reader.
+func Samples(r io.Reader) ([]float32, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return BytesToSamples(raw), nil
+}
+
+func BytesToSamples(raw []byte) []float32 {
+	out := make([]float32, len(raw)/4)
+	for i := range out {
+		out[i] = math.Float32frombits(binary.LittleEndian.Uint32(raw[4*i:]))
+	}
+	return out
+}
+
+func SamplesToBytes(samples []float32) []byte {
+	out := make([]byte, 4*len(samples))
+	for i, f := range samples {
+		put_sample(out[4*i:], f)
+	}
+	return out
+}
+
+// Transmission is what the sender puts on the air for one packet: the preamble,
+// the sleep and the data symbols back to back.
+func (p Profile) Transmission(packet BitString) []float32 {
+	samples, _ := Samples(io.MultiReader(NewPreambleSig(p), NewSilence(p, p.SleepDuration), NewDataSig(p, packet)))
+	return samples
+}
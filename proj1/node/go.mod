@@ -0,0 +1,26 @@
+module node
+
+go 1.21.3
+
+require (
+	audio v0.0.0
+	ip v0.0.0
+	link v0.0.0
+	modem v0.0.0
+)
+
+require (
+	github.com/ebitengine/oto/v3 v3.1.0 // indirect
+	github.com/ebitengine/purego v0.5.0 // indirect
+	github.com/gen2brain/malgo v0.11.10 // indirect
+	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5 // indirect
+	github.com/mjibson/go-dsp v0.0.0-20180508042940-11479a337f12 // indirect
+	golang.org/x/sys v0.12.0 // indirect
+)
+
+replace (
+	audio => ../audio
+	ip => ../ip
+	link => ../link
+	modem => ../modem
+)
@@ -0,0 +1,183 @@
+// A node of the acoustic link that just sits there and answers: ICMP echo, so
+// ../ping has someone to talk to, and datagrams sent to the echo port come
+// straight back, for link.PacketConn users to try theirs against, as do the
+// bytes of streams to the stream echo port for link.Dial. With -nat it's the
+// gateway too, passing UDP between the link and the host's network, for
+// ../udp.
+//
+//	node -addr 2
+//	node -addr 2 -profile fast -pcap node.pcapng -log-level debug
+//	node -addr 2 -nat
+//	node -addr 2 -aec
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"audio"
+	"ip"
+	"link"
+	"modem"
+)
+
+func main() {
+	profile_name := flag.String("profile", "fast", "modulation profile, has to match the other nodes'")
+	addr := flag.Int("addr", 2, "our link address, our IP address is "+ip.Subnet.String()+" with it as the last byte")
+	output := flag.String("output", "malgo", "audio backend to play on, one of "+audio.BackendsUsage())
+	input := flag.String("input", "malgo", "audio backend to capture from")
+	echo_port := flag.Int("echo-port", 7, "port whose datagrams get sent back where they came from, 0 for none")
+	stream_echo_port := flag.Int("stream-echo-port", 8, "port whose streams get everything sent back, 0 for none")
+	compress := flag.Bool("compress", false, "deflate frames where it saves airtime")
+	key := flag.String("key", "", "passphrase to encrypt and authenticate frames with, has to match the other nodes', frames that don't authenticate with it are dropped")
+	key_file := flag.String("key-file", "", "file with the key, 32 bytes of it as they are or else a passphrase")
+	routes := link.NewRouteTable()
+	flag.Func("route", "target:via[:hops], send frames for target to via, 2 hops away unless target is via; may be given more than once", func(s string) error {
+		r, err := link.ParseRoute(s)
+		if err == nil {
+			routes.Add(r)
+		}
+		return err
+	})
+	relay := flag.Bool("relay", false, "pass on routed frames meant for other nodes")
+	aec := flag.Bool("aec", false, "cancel our own echo from what the microphone hears, so frames that arrive while we talk get through")
+	aec_taps := flag.Int("aec-taps", 256, "length of the echo canceller's filter in frames")
+	aec_mu := flag.Float64("aec-mu", 0.5, "step size of the echo canceller")
+	nat := flag.Bool("nat", false, "be the gateway: pass UDP from the other nodes on to the host's network and the answers back, as a NAT")
+	gateway := flag.Int("gateway", 0, "link address of the node everything outside "+ip.Subnet.String()+" goes to, 0 for none")
+	beacon := flag.Duration("beacon", 0, "tell the nodes in earshot about our routes this often so they learn routes through us, 1s or more, 0 for never")
+	pcap_path := flag.String("pcap", "", "write every frame sent and received to this pcapng file")
+	sample_rate := flag.Int("sample-rate", 0, "rate the modem runs at, 0 keeps the profile's")
+	device_rate := flag.Int("device-rate", 0, "rate the audio devices run at, resampled from the modem's, 0 means the same")
+	log_level := flag.String("log-level", "info", "lowest event level to log: debug, info, warn or error")
+	log_format := flag.String("log-format", "json", "event log format: json or text")
+	log_output := flag.String("log-output", "-", "where events go: - for stderr, stdout, or a file path")
+	devices := audio.AddDeviceFlags(flag.CommandLine, true, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
+
+	logger, log_closer, err := modem.OpenLogger(*log_level, *log_format, *log_output)
+	chk(err)
+	defer log_closer.Close()
+
+	p, err := modem.LookupProfile(*profile_name)
+	chk(err)
+	p = p.WithSampleRate(*sample_rate)
+	chk(p.Validate())
+
+	device, err := devices.Output(*output)
+	chk(err)
+	sink, err := audio.OpenSink(*output, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: device})
+	chk(err)
+	defer sink.Close()
+	device, err = devices.Input(*input)
+	chk(err)
+	source, err := audio.OpenSource(*input, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: device})
+	chk(err)
+	defer source.Close()
+
+	node := link.NewNode(link.Addr(*addr), p, sink, source)
+	defer node.Close()
+	node.Logger = logger
+	node.Compress = *compress
+	node.Crypt, err = link.OpenCrypt(*key, *key_file)
+	chk(err)
+	node.Routes = routes
+	node.Relay = *relay
+	if *aec {
+		node.Echo = modem.NewEchoCanceller(p, *aec_taps, *aec_mu)
+	}
+	if *pcap_path != "" {
+		node.Pcap, err = modem.NewPcapWriter(*pcap_path, "node")
+		chk(err)
+		defer node.Pcap.Close()
+	}
+	stack := ip.NewStack(node)
+	stack.Gateway = link.Addr(*gateway)
+	var gw *ip.Gateway
+	if *nat {
+		gw = ip.NewGateway(stack)
+		defer gw.Close()
+	}
+	chk(node.Start())
+	fmt.Printf("Node %v is up as %v on profile %s\n", node.Addr, stack.Addr, p.Name)
+	if *beacon > 0 {
+		chk(node.Beacon(*beacon))
+	}
+	if *echo_port != 0 {
+		conn, err := link.ListenPacket(node, uint16(*echo_port))
+		chk(err)
+		defer conn.Close()
+		go echo(conn)
+	}
+	if *stream_echo_port != 0 {
+		listener, err := link.Listen(node, uint16(*stream_echo_port))
+		chk(err)
+		defer listener.Close()
+		go stream_echo(listener)
+	}
+
+	// live devices run until Enter, files until they run out
+	done := make(chan struct{}, 2)
+	go func() {
+		source.Wait()
+		done <- struct{}{}
+	}()
+	go func() {
+		fmt.Println("Press Enter to exit...")
+		fmt.Scanln()
+		done <- struct{}{}
+	}()
+	<-done
+	for _, r := range routes.Routes() {
+		fmt.Printf("Route to %v\n", r)
+	}
+	if gw != nil {
+		for _, m := range gw.Mappings() {
+			fmt.Printf("Gateway maps %v to %v, idle for %v\n", m.Inside, m.Outside, m.Idle.Round(time.Millisecond))
+		}
+	}
+	if *compress {
+		sent_stats, received_stats := node.Compression()
+		fmt.Printf("Compression sent: %v\nCompression received: %v\n", sent_stats, received_stats)
+	}
+}
+
+// echo sends every datagram back, like the echo service of old
+func echo(conn net.PacketConn) {
+	buf := make([]byte, 1<<16)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteTo(buf[:n], from)
+	}
+}
+
+// stream_echo sends back every stream's bytes until the other end closes it
+func stream_echo(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
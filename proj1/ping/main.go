@@ -0,0 +1,173 @@
+// ping over the air: ICMP echo requests to another node of the acoustic link,
+// with the round trip time and loss at the end like the real one. The other
+// end has to run ../node, or -peer runs it in this process, which with a
+// loopback for both ends checks the whole stack without a sound card.
+//
+//	ping 10.120.0.2
+//	ping -addr 3 -count 10 -size 32 2
+//	ping -input loopback:air -output loopback:air -peer 2 2
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"audio"
+	"ip"
+	"link"
+	"modem"
+)
+
+func main() {
+	profile_name := flag.String("profile", "fast", "modulation profile, has to match the other node's")
+	addr := flag.Int("addr", 1, "our link address, our IP address is "+ip.Subnet.String()+" with it as the last byte")
+	output := flag.String("output", "malgo", "audio backend to play on, one of "+audio.BackendsUsage())
+	input := flag.String("input", "malgo", "audio backend to capture from")
+	count := flag.Int("count", 4, "echo requests to send, 0 keeps going until killed")
+	interval := flag.Duration("interval", time.Second, "pause between a reply, or giving up on it, and the next request")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long to wait for every reply")
+	size := flag.Int("size", 8, "bytes of data in every request")
+	compress := flag.Bool("compress", false, "deflate frames where it saves airtime, the requests' data compresses well")
+	peer := flag.Int("peer", 0, "also run the node with this link address in this process, answering, 0 for none")
+	key := flag.String("key", "", "passphrase to encrypt and authenticate frames with, has to match the other node's, frames that don't authenticate with it are dropped")
+	key_file := flag.String("key-file", "", "file with the key, 32 bytes of it as they are or else a passphrase")
+	routes := link.NewRouteTable()
+	flag.Func("route", "target:via[:hops], send frames for target to via, 2 hops away unless target is via; may be given more than once", func(s string) error {
+		r, err := link.ParseRoute(s)
+		if err == nil {
+			routes.Add(r)
+		}
+		return err
+	})
+	pcap_path := flag.String("pcap", "", "write every frame sent and received to this pcapng file")
+	sample_rate := flag.Int("sample-rate", 0, "rate the modem runs at, 0 keeps the profile's")
+	device_rate := flag.Int("device-rate", 0, "rate the audio devices run at, resampled from the modem's, 0 means the same")
+	log_level := flag.String("log-level", "warn", "lowest event level to log: debug, info, warn or error")
+	log_format := flag.String("log-format", "json", "event log format: json or text")
+	log_output := flag.String("log-output", "-", "where events go: - for stderr, stdout, or a file path")
+	devices := audio.AddDeviceFlags(flag.CommandLine, true, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: ping [flags] <ip address or link address>")
+		os.Exit(2)
+	}
+	dst, err := parse_target(flag.Arg(0))
+	chk(err)
+
+	logger, log_closer, err := modem.OpenLogger(*log_level, *log_format, *log_output)
+	chk(err)
+	defer log_closer.Close()
+
+	p, err := modem.LookupProfile(*profile_name)
+	chk(err)
+	p = p.WithSampleRate(*sample_rate)
+	chk(p.Validate())
+
+	output_device, err := devices.Output(*output)
+	chk(err)
+	sink, err := audio.OpenSink(*output, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: output_device})
+	chk(err)
+	defer sink.Close()
+	input_device, err := devices.Input(*input)
+	chk(err)
+	source, err := audio.OpenSource(*input, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: input_device})
+	chk(err)
+	defer source.Close()
+
+	node := link.NewNode(link.Addr(*addr), p, sink, source)
+	defer node.Close()
+	node.Logger = logger
+	node.Compress = *compress
+	node.Routes = routes
+	node.Crypt, err = link.OpenCrypt(*key, *key_file)
+	chk(err)
+	if *pcap_path != "" {
+		node.Pcap, err = modem.NewPcapWriter(*pcap_path, "ping")
+		chk(err)
+		defer node.Pcap.Close()
+	}
+	stack := ip.NewStack(node)
+	chk(node.Start())
+
+	if *peer != 0 {
+		// the same backends give the same loopback, a sound card gets opened
+		// a second time
+		peer_sink, err := audio.OpenSink(*output, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: output_device})
+		chk(err)
+		defer peer_sink.Close()
+		peer_source, err := audio.OpenSource(*input, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: input_device})
+		chk(err)
+		defer peer_source.Close()
+		peer_node := link.NewNode(link.Addr(*peer), p, peer_sink, peer_source)
+		defer peer_node.Close()
+		peer_node.Logger = logger
+		peer_node.Compress = *compress
+		peer_node.Crypt, err = link.OpenCrypt(*key, *key_file)
+		chk(err)
+		ip.NewStack(peer_node)
+		chk(peer_node.Start())
+	}
+
+	fmt.Printf("PING %v from %v over profile %s, %d bytes of data\n", dst, stack.Addr, p.Name, *size)
+	id := uint16(os.Getpid())
+	sent, received := 0, 0
+	rtts := []time.Duration{}
+	for seq := 0; *count == 0 || seq < *count; seq++ {
+		if seq > 0 {
+			time.Sleep(*interval)
+		}
+		sent++
+		rtt, reply, err := stack.Ping(dst, id, uint16(seq), *size, *timeout)
+		switch {
+		case errors.Is(err, ip.ErrTimeout):
+			fmt.Printf("no reply for icmp_seq=%d within %v\n", seq, *timeout)
+		case err != nil:
+			fmt.Printf("icmp_seq=%d: %v\n", seq, err)
+		default:
+			received++
+			rtts = append(rtts, rtt)
+			fmt.Printf("%d bytes from %v: icmp_seq=%d ttl=%d time=%v\n", len(reply.Payload), reply.Src, seq, reply.TTL, rtt.Round(time.Millisecond))
+		}
+	}
+
+	fmt.Printf("--- %v ping statistics ---\n", dst)
+	fmt.Printf("%d packets transmitted, %d received, %.0f%% packet loss\n", sent, received, 100*float64(sent-received)/float64(max(sent, 1)))
+	if len(rtts) > 0 {
+		lo, hi, sum := rtts[0], rtts[0], time.Duration(0)
+		for _, rtt := range rtts {
+			lo, hi, sum = min(lo, rtt), max(hi, rtt), sum+rtt
+		}
+		fmt.Printf("rtt min/avg/max = %v/%v/%v\n", lo.Round(time.Millisecond), (sum / time.Duration(len(rtts))).Round(time.Millisecond), hi.Round(time.Millisecond))
+	}
+	if *compress {
+		sent_stats, received_stats := node.Compression()
+		fmt.Printf("compression sent: %v\ncompression received: %v\n", sent_stats, received_stats)
+	}
+	if received == 0 {
+		os.Exit(1)
+	}
+}
+
+// parse_target takes an IP address, or a bare link address for the node's
+// address in the subnet
+func parse_target(s string) (netip.Addr, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > 0 && n < int(link.Broadcast) {
+		return ip.NodeAddr(link.Addr(n)), nil
+	}
+	return netip.ParseAddr(s)
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -1,401 +1,196 @@
-// This example simply captures data from your default microphone until you press Enter, after which it plays back the captured audio.
+// Receiver listens for frames from the sender and writes their bits to
+// received.txt, until the frames asked for are in or Enter is pressed.
 package main
 
 import (
 	"bufio"
 	"encoding/binary"
+	"flag"
 	"fmt"
-	"math"
-	"math/big"
-	"math/cmplx"
-	"slices"
-	"time"
-
 	"os"
 
-	"github.com/gen2brain/malgo"
-	"github.com/mjibson/go-dsp/fft"
+	"audio"
+	"link"
+	"modem"
 )
 
-
-const mod_duration = 800 * time.Millisecond
-const mod_low_freq = 1000.0
-const mod_high_freq = 17000.0
-const mod_width = mod_high_freq - mod_low_freq
-const mod_freq_step = 200.0
-const mod_freq_range_num = 10
-const mod_freq_range_width = mod_width / mod_freq_range_num
-const gap_freq = mod_freq_step / 2
-
-const mod_duration_gap = 20 * time.Millisecond
-// const mod_freq_range_num = 80
-var mod_state_num *big.Int
-var sym_size *big.Int
-
-var bit_per_sym int
-
-const shift_duration = 120 * time.Millisecond
-
-const len_length = 2
-
-func pad_bitstring(length int, msg BitString) BitString {
-	if len(msg) > length {
-		panic("input bitstring too long")
-	}
-	return append(make(BitString, length - len(msg)), msg...)
-}
-
-func calculate_hash(msg BitString) *big.Int {
-	ret := big.NewInt(0)
-	for i, v := range(msg) {
-		prod := big.NewInt(int64(i))
-		prod.Mul(prod, v)
-		ret.Xor(ret, v)
-	}
-	return ret
-}
-
-func encode_int(_l int64) BitString {
-	l := big.NewInt(_l)
-
-	output := BitString{}
-	mask := big.NewInt(1)
-	mask.Lsh(mask, uint(bit_per_sym))
-	mask.Sub(mask, big.NewInt(1))
-	for !(l.IsInt64() && l.Int64() == 0) {
-		last_bit := big.NewInt(0)
-		last_bit.And(l, mask)
-		l.Rsh(l, uint(bit_per_sym))
-		output = append(output, last_bit)
-	}
-	slices.Reverse(output)
-	return output
-}
-
-const sampleRate = 44100.0
-
-const sleep_duration = 500 * time.Millisecond
-const preamble_duration = 800 * time.Millisecond
-// in general we want higher preamble freqency to distinguish from the noises
-const preamble_start_freq = 1000.0
-const preamble_final_freq = 5000.0
-
-const slice_duration = 40 * time.Millisecond
-const slice_inner_duration = 10 * time.Millisecond
-const slice_num = 10
-// the issue with this is: the bigger this is we can tollerant weaker signals but the possibility 
-// of misidentification increases
-const cutoff_variance_preamble = 0.5
-
-// const self_correction_after_sym = 8 // do a self correction every 8 symbols
-
-type BitString = []*big.Int
-
-
-// is_idle := true
-var is_idle bool
-func sig_to_energy_at_freq(to_analyze []float64) []float64 {
-	spectrum := fft.FFTReal(to_analyze)
-	// if !is_idle {
-	// 	fmt.Printf("%v", to_analyze)
-	// 	fmt.Printf("%v", spectrum)
-	// }
-	
-	L := len(to_analyze)
-
-	energy := make([]float64, L/2+1)
-	energy[0] = cmplx.Abs(spectrum[0]) / float64(L)
-	for i := 1; i < L / 2; i += 1 {
-		energy[i] = 2 * cmplx.Abs(spectrum[i]) / float64(L)
-	}
-	return energy
-}
-
-func arg_max(s []float64) int {
-	ans := -1
-	val := 0.0
-	for i, v := range(s) {
-		if ans == -1 || v > val {
-			ans, val = i, v
-		}
-	}
-	return ans
-}
-
-// func get_energy_by_sym(energy []float64, sym int, fs float64, L int) float64 {
-// 	ratio := float64(sym) / float64(sym_num)
-// 	freq_expect := ratio * modulate_low_freq + (1 - ratio) * modulate_high_freq
-// 	return energy[int(freq_expect * float64(L) / fs)]
-// }
-
 func main() {
-	f := mod_freq_range_width / mod_freq_step
-	mod_state_num = big.NewInt(int64(f))
-	sym_size = big.NewInt(1)
-	for i := 0; i < mod_freq_range_num; i++ {
-		sym_size.Mul(sym_size, mod_state_num)
-	}
-	bit_per_sym = sym_size.BitLen() - 1
-
-	is_idle = true
-	ctx, err := malgo.InitContext(nil, malgo.ContextConfig{}, func(message string) {
-		// fmt.Printf("LOG <%v>\n", message)
-	})
+	profile_name := flag.String("profile", "default", "modulation profile, has to match the sender's")
+	input := flag.String("input", "malgo", "audio backend to capture from, one of "+audio.BackendsUsage()+", e.g. wav:capture.wav")
+	diag_path := flag.String("diag", "", "write per-symbol spectral diagnostics to this file (.csv or .json)")
+	frame_count := flag.Int("frames", 1, "frames to collect before writing received.txt, their bits are joined in order (for a sender in -jam-aware mode), with more than 1 frames that fail the checksum are skipped")
+	pcap_path := flag.String("pcap", "", "write every frame received to this pcapng file, for Wireshark with ../wireshark/acoustic.lua")
+	channel := flag.Int("channel", 0, "channel to listen on, 0 to -channels minus 1, everything outside it is filtered out")
+	channels := flag.Int("channels", 1, "split the profile's spectrum into this many channels so several links can share a room, has to match the sender's")
+	key := flag.String("key", "", "passphrase to encrypt and authenticate frames with, has to match the sender's, frames that don't authenticate with it are dropped")
+	key_file := flag.String("key-file", "", "file with the key, 32 bytes of it as they are or else a passphrase")
+	log_level := flag.String("log-level", "info", "lowest event level to log: debug, info, warn or error")
+	log_format := flag.String("log-format", "json", "event log format: json or text")
+	log_output := flag.String("log-output", "-", "where events go: - for stderr, stdout, or a file path")
+	sample_rate := flag.Int("sample-rate", 0, "rate the modem runs at, 0 keeps the profile's, doesn't have to match the sender's")
+	device_rate := flag.Int("device-rate", 0, "rate the audio device runs at, resampled from the modem's, 0 means the same")
+	devices := audio.AddDeviceFlags(flag.CommandLine, true, false)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
+
+	logger, log_closer, err := modem.OpenLogger(*log_level, *log_format, *log_output)
 	chk(err)
-	defer func() {
-		_ = ctx.Uninit()
-		ctx.Free()
-	}()
-
-	deviceConfig := malgo.DefaultDeviceConfig(malgo.Duplex)
-	deviceConfig.Capture.Format = malgo.FormatF32
-	deviceConfig.Capture.Channels = 1
-	deviceConfig.SampleRate = sampleRate
-	deviceConfig.Alsa.NoMMap = 1
-
-	data_width := int(malgo.SampleSizeInBytes(deviceConfig.Capture.Format))
-	samples_required := int(math.Ceil(preamble_duration.Seconds() * sampleRate))
-	samples_required = max(samples_required, int(math.Ceil(2 * mod_duration.Seconds() * sampleRate)))
-	rb := newRb(samples_required * 10)
-
-	chirp_rate := (preamble_final_freq - preamble_start_freq) / preamble_duration.Seconds()
-
-	frameCountAll := 0
-	received := BitString{}
-
-	packet_length := 0
-	// packet_rest := BitString{}
-	do_offset := 0
+	defer log_closer.Close()
 
+	p, err := modem.LookupProfile(*profile_name)
+	chk(err)
+	p = p.WithSampleRate(*sample_rate)
+	p, err = p.WithChannel(*channel, *channels)
+	chk(err)
+	chk(p.Validate())
+	crypt, err := link.OpenCrypt(*key, *key_file)
+	chk(err)
 
-	onRecvFrames := func(pSample2, pSample []byte, framecount uint32) {
-		if(framecount > uint32(rb.Length())) {
-			panic("ring buffer too small")
+	receiver := modem.NewReceiver(p)
+	receiver.Logger = logger
+	if *diag_path != "" {
+		receiver.Diag, err = modem.NewDiagWriter(*diag_path)
+		chk(err)
+		defer receiver.Diag.Close()
+	}
+	var capture *modem.PcapWriter
+	if *pcap_path != "" {
+		capture, err = modem.NewPcapWriter(*pcap_path, "receiver")
+		chk(err)
+		defer capture.Close()
+	}
+	reassembler := link.NewReassembler()
+	reassembler.OnExpire = func(src link.Addr, id uint16, pieces int) {
+		logger.Warn(link.EvLinkDropped, "reason", "fragment missing", "id", id, "pieces", pieces)
+	}
+	frames := []modem.Frame{}
+	receiver.OnFrame = func(frame modem.Frame) {
+		if capture != nil {
+			chk(capture.Write(p.ReceivedRecord(frame)))
 		}
-		if len(pSample) % data_width != 0 {
-			panic("weird input: sample bytes length not multiple of data width")
+		// a broken frame joined in with the rest would garble the file,
+		// leave it out and wait for the next one
+		if *frame_count > 1 && !frame.ChecksumOK {
+			logger.Warn(link.EvLinkDropped, "reason", "bad checksum", "bits", len(frame.Bits), "snr_db", frame.SNR)
+			return
 		}
-
-		frameCountAll += int(framecount)
-		for i := 0; i < len(pSample); i += data_width {
-			bits := binary.LittleEndian.Uint32(pSample[i:i+4])
-			f := math.Float32frombits(bits) 
-			rb.Write(float64(f))
+		// a message too long for one packet, or compressed or encrypted,
+		// comes in fragments of a link frame, everything else is the bits
+		// themselves, which nobody could have authenticated
+		f, err := link.FromBits(frame.Bits)
+		is_link := err == nil && f.Flags&(link.FlagFragment|link.FlagCompressed|link.FlagEncrypted) != 0
+		if crypt != nil && !is_link {
+			logger.Warn(link.EvLinkDropped, "reason", link.ErrPlaintext.Error(), "bits", len(frame.Bits), "snr_db", frame.SNR)
+			return
 		}
-		if is_idle {
-			slice_width := int(math.Ceil(slice_duration.Seconds() * sampleRate))
-			slice_inner_width := int(math.Ceil(slice_inner_duration.Seconds() * sampleRate))
-			// check whether we can start to work, the following conditions need to met: 
-			// 1. we have enough samples to accept a preamble
-			// 2. in the last slice the peak frequency is "around" 8000Hz
-			// 3. the peak frequency in the last slice_num slices follows the characteristic of the chirp signal
-			if frameCountAll >= samples_required {
-				variance := 0.0
-				freq_shift := 0.0
-				for i := 0; i < slice_num; i++ {
-					to_analyze := rb.CopyStrideRight(i * slice_width + slice_inner_width, slice_width - 2 * slice_inner_width)
-
-					energy := sig_to_energy_at_freq(to_analyze)
-					L := len(to_analyze)
-
-					max_energy_freq := sampleRate * float64(arg_max(energy)) / float64(L)
-
-					avg_freq := preamble_final_freq - (float64(i) + 0.5) * slice_duration.Seconds() * chirp_rate
-					if i == 0 && math.Abs(avg_freq - max_energy_freq) < slice_duration.Seconds() * chirp_rate {
-						freq_shift = max_energy_freq - avg_freq
-					}
-					// fmt.Printf("We expect frequency %f\n", avg_freq)
-					delta := (avg_freq - max_energy_freq + freq_shift) / avg_freq
-					variance += delta * delta 
-				}
-				fmt.Printf("Variance: %f\n", variance)
-				if variance < cutoff_variance_preamble {
-					fmt.Println("Preamble detected!")
-					fmt.Printf("Receiving: ")
-					is_idle = false
-					time_shift := freq_shift / chirp_rate
-					frameCountAll = int(time_shift) * sampleRate
-				}
+		if is_link {
+			whole, ok, err := reassembler.Add(f, link.FragmentTimeout(p, len(f.Payload)))
+			if err != nil {
+				logger.Warn(link.EvLinkDropped, "reason", err.Error(), "frame", f.String())
 			}
-			// we reset and start to count frames we have
-		} else {
-			sleep_frames := int(math.Ceil(sleep_duration.Seconds() * float64(sampleRate)))
-			if frameCountAll <= sleep_frames { return }
-			// we're in working mode
-			bits_read := len(received)
-			modulated_width := int(math.Ceil(mod_duration.Seconds() * sampleRate))
-			frameCountAllEffective := (frameCountAll - sleep_frames)
-			bits_expected := frameCountAllEffective / modulated_width
-			left_over := frameCountAllEffective % modulated_width
-			gap_width := int(math.Ceil(mod_duration_gap.Seconds() * sampleRate))
-			tmp := make([]float64, modulated_width * 3)
-			for ; bits_read < bits_expected; bits_read++ {
-				// leave slice_width empty so we're more likely get a good result from fourier transform
-				to_analyze := rb.CopyStrideRight(gap_width + left_over + (bits_expected - bits_read - 1) * modulated_width, modulated_width - 2 * gap_width)
-				L := len(to_analyze)
-				energy_cur := sig_to_energy_at_freq(to_analyze)
-				// energy[i] correponds to frequency Fs * i/L
-
-				sym := big.NewInt(0)
-				start_freq := mod_high_freq - mod_freq_range_width - gap_freq
-				// fmt.Printf("[")
-				for k := mod_freq_range_num - 1; k >= 0; k-- {
-					end_freq := start_freq + mod_freq_range_width
-					// Fs * i_start / L = start_freq 
-					i_start := int(start_freq * float64(L) / sampleRate)
-					i_end := int(end_freq * float64(L) / sampleRate)
-					// if k == 0 {
-					// 	for j, v := range(energy_cur[i_start:i_end]) {
-					// 		i := j + i_start
-					// 		fmt.Printf("(%.2f,%.2f) ", sampleRate * float64(i) / float64(L), v)
-					// 	}
-					// }
-					// fmt.Println("")
-					for i := i_start; i < i_end; i++ {
-						ratio := float64(i - i_start) / float64(i_end - i_start)
-						tmp[i] = energy_cur[i] - ((1 - ratio) * energy_cur[i_start] + ratio * energy_cur[i_end])
-					}
-					max_energy_freq := sampleRate * float64(arg_max(tmp[i_start:i_end]) + i_start) / float64(L)
-					// max_energy_freq = start_freq + part * 20
-					part := int(math.Round((max_energy_freq - (start_freq + gap_freq)) / mod_freq_step))
-					// fmt.Printf("In [%f, %f] we have max frequency of %f, interpreted as %d\n", start_freq, end_freq, max_energy_freq, part)
-					// fmt.Printf("%.2f:%d ", max_energy_freq, part)
-					fmt.Printf("[%f %f] -> %f %d\n", start_freq + gap_freq, end_freq + gap_freq, max_energy_freq, part)
-					sym.Mul(sym, sym_size)
-					sym.Add(sym, big.NewInt(int64(part)))
-					start_freq -= mod_freq_range_width
-				}	
-				// fmt.Printf("]\n")
-
-				// // let Fs * i/L = zero_freq, then i = zero_freq / Fs * L
-				// max_energy_freq := sampleRate * float64(arg_max(energy_cur)) / float64(L)
-				// // say max_energy_freq = ratio * modulate_low_freq + (1 - ratio) * modulate_high_freq
-				// // then ratio = (modulate_high_freq - max_energy_freq) / (modulate_high_freq - modulate_low_freq)
-				// ratio := (modulate_high_freq - max_energy_freq) / (modulate_high_freq - modulate_low_freq)
-				// // we know that ratio = i / sym_num
-				//
-				// sym := int(math.Round(ratio * sym_num))
-				received = append(received, sym)
-				fmt.Printf("%d ", sym)
-				// first bit of length must be 0 if we never sent data over length 10000
-				if len(received) == do_offset + 1 && !(sym.IsInt64() && sym.Int64() == 0) {
-					// magic
-					do_offset += 1
-					fmt.Printf("[discard] ")
-				} else if len(received) - do_offset <= len_length {
-					packet_length = (packet_length << bit_per_sym) | int(received[len(received)-1].Int64())
-					if len(received) - do_offset == len_length && packet_length == 0 {
-						do_offset += 1
-						fmt.Printf("[ignore leading 0]")
-					}
-				// } else if len(received) - do_offset <= len_length + len_hash {
-				// 	packet_hash = (packet_hash << bit_per_sym) | received[len(received)-1]
-				} else if len(received) - do_offset == len_length + packet_length + 1 {
-					// packet_rest = received[len_length + len_hash:]
-					finale(packet_length, do_offset, received)
+			if !ok {
+				logger.Info(link.EvLinkReceived, "fragment", f.String(), "snr_db", frame.SNR)
+				return
+			}
+			if crypt != nil {
+				if whole, err = crypt.Open(whole); err != nil {
+					logger.Warn(link.EvLinkDropped, "reason", err.Error(), "snr_db", frame.SNR)
+					return
 				}
+			} else if whole.Flags&link.FlagEncrypted != 0 {
+				logger.Warn(link.EvLinkDropped, "reason", "encrypted, run with -key or -key-file", "frame", whole.String())
+				return
 			}
+			raw, err := link.Decompress(whole)
+			if err != nil {
+				logger.Warn(link.EvLinkDropped, "reason", err.Error(), "frame", whole.String())
+				return
+			}
+			stats := link.CompressionStats{}
+			stats.Add(raw, whole)
+			logger.Info(link.EvLinkReceived, "frame", whole.String(), "bytes", len(raw.Payload), "compression_ratio", stats.Ratio())
+			if frame.Bits, ok = unpack_message(raw.Payload); !ok {
+				logger.Warn(link.EvLinkDropped, "reason", "bad message length", "frame", whole.String())
+				return
+			}
+		}
+		frames = append(frames, frame)
+		if len(frames) < *frame_count {
+			logger.Info(modem.EvFrameDelivered, "index", len(frames)-1, "bits", len(frame.Bits), "checksum_ok", frame.ChecksumOK, "snr_db", frame.SNR)
+			return
+		}
+		finale(frames, "received.txt")
+		logger.Info(modem.EvFrameDelivered, "index", len(frames)-1, "path", "received.txt", "bits", len(frame.Bits), "checksum_ok", frame.ChecksumOK, "snr_db", frame.SNR)
+		if receiver.Diag != nil {
+			chk(receiver.Diag.Close())
+		}
+		if capture != nil {
+			chk(capture.Close())
 		}
+		os.Exit(0)
 	}
 
-	fmt.Println("Waiting for sender to send data")
-	captureCallbacks := malgo.DeviceCallbacks{
-		Data: onRecvFrames,
-	}
-	device, err := malgo.InitDevice(ctx.Context, deviceConfig, captureCallbacks)
-	defer device.Uninit()
+	device, err := devices.Input(*input)
 	chk(err)
-
-	err = device.Start()
+	source, err := audio.OpenSource(*input, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: device})
 	chk(err)
+	defer source.Close()
+
+	fmt.Println("Waiting for sender to send data")
+	chk(source.Start(receiver.Write))
 
-	fmt.Println("Press Enter to exit...")
-	fmt.Scanln()                                   
+	// live devices run until Enter, files until they run out
+	done := make(chan struct{}, 2)
+	go func() {
+		source.Wait()
+		done <- struct{}{}
+	}()
+	go func() {
+		fmt.Println("Press Enter to exit...")
+		fmt.Scanln()
+		done <- struct{}{}
+	}()
+	<-done
 }
 
-func finale(packet_length int, do_offset int, received BitString){
-	modulo := int(received[do_offset+len_length].Int64())
-	packet_hash := received[do_offset+len_length+1:do_offset+len_length+1+1]
-	packet_data := received[do_offset+len_length+1+1:]
-	fmt.Printf("\nGot packet of length %d with modulo %d, hash %v, content %v", packet_length, modulo, packet_hash, packet_data)
-	fmt.Printf("Writing packet to disk named received.txt")
-	file, err := os.Create("received.txt")
+func finale(frames []modem.Frame, path string) {
+	file, err := os.Create(path)
 	chk(err)
 	defer file.Close()
 	writer := bufio.NewWriter(file)
 	defer writer.Flush()
-	length_bin := bit_per_sym * len(packet_data) - (bit_per_sym - modulo)
-	output := make([]byte, length_bin)
-	for id, v := range(packet_data) {
-		for i := 0; i < bit_per_sym; i++ {
-			cur_offset := id * bit_per_sym + (bit_per_sym - 1 - i)
-			if cur_offset >= len(output) {
-				continue
+	for _, frame := range frames {
+		for _, bit := range frame.Bits {
+			if bit == 0 {
+				writer.WriteString("0")
+			} else {
+				writer.WriteString("1")
 			}
-			output[cur_offset] = byte(v.Bit(i))
 		}
 	}
-	for _, bit := range(output) {
-		if bit == 0 {
-			writer.WriteString("0")
-		} else {
-			writer.WriteString("1")
-		}
-	}
-	os.Exit(0)
 }
 
-func chk(err error) {
-	if err != nil {
-		panic(err)
+// unpack_message undoes the sender's pack_message: the number of bits, then
+// the bits packed into bytes
+func unpack_message(payload []byte) ([]byte, bool) {
+	if len(payload) < 4 {
+		return nil, false
 	}
-}
-
-type RingBuffer struct {
-	head int
-	tail int
-	inner []float64
-}
-
-func newRb(size int) RingBuffer {
-	return RingBuffer{
-		head: 0,
-		tail: 1,
-		inner: make([]float64, size + 1),
+	n := int(binary.BigEndian.Uint32(payload))
+	if n > 8*(len(payload)-4) {
+		return nil, false
 	}
-}
-
-func (rb *RingBuffer) Length() int{
-	return int(len(rb.inner))
-}
-func (rb *RingBuffer) Write(f float64) {
-	rb.inner[rb.tail] = f
-	rb.tail = (rb.tail + 1) % len(rb.inner)
-	if rb.tail == rb.head {
-		rb.head = (rb.head + 1) % len(rb.inner)
+	bits := make([]byte, n)
+	for i := range bits {
+		bits[i] = payload[4+i/8] >> (7 - i%8) & 1
 	}
+	return bits, true
 }
 
-func (rb * RingBuffer) CopyStrideRight(rbegin int , count int) []float64 {
-	length := rb.tail - rb.head
-	end := len(rb.inner)
-	if rb.tail < rb.head {
-		length = rb.tail + (end - rb.head)
-	}
-	// fmt.Printf("We have %d data in rb, at most %d data allowed.\n", length, len(rb.inner))
-	if length < count + rbegin {
-		panic("RB doesn't have enough data")
-	}
-	r_edge := rb.tail - rbegin
-	if r_edge <= 0 {
-		r_edge += end
-	}
-	result := make([]float64, count)
-	if r_edge >= count {
-		copy(result, rb.inner[r_edge-count:r_edge])
-	} else {
-		copy(result[count-r_edge:count], rb.inner[0:r_edge])
-		copy(result[0:count-r_edge], rb.inner[end-(count-r_edge):end])
+func chk(err error) {
+	if err != nil {
+		panic(err)
 	}
-	return result
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"audio"
+	"link"
+	"modem"
+)
+
+// a message that doesn't fit in one packet, or is compressed or encrypted,
+// goes as the fragments of a link frame, which the receiver puts back together
+const sender_addr link.Addr = 1
+
+// heard after every fragment so the receiver's last symbol window fills up
+const fragment_tail = 50 * time.Millisecond
+
+// send_fragments sends the message as a link frame of data, deflated with
+// compress, sealed with crypt unless it's nil, split into fragments of at most
+// mtu bytes, or as few as the profile allows for 0
+func send_fragments(sink audio.AudioSink, p modem.Profile, logger *slog.Logger, capture *modem.PcapWriter, message modem.BitString, mtu int, compress bool, crypt *link.Crypt) {
+	if mtu == 0 {
+		mtu = link.MaxPayload(p)
+	}
+	raw := link.Frame{Dst: link.Broadcast, Src: sender_addr, Type: link.TypeData, Payload: pack_message(message)}
+	f := raw
+	if compress {
+		f = link.Compress(raw)
+	}
+	stats := link.CompressionStats{}
+	stats.Add(raw, f)
+	if crypt != nil {
+		f = crypt.Seal(f)
+	}
+	frames, err := link.Fragment(f, mtu, uint16(rand.Uint32()))
+	chk(err)
+	logger.Info(modem.EvMessageReady, "bits", len(message), "bytes", len(raw.Payload), "bytes_sent", len(f.Payload), "compression_ratio", stats.Ratio(), "encrypted", crypt != nil, "mtu", mtu, "fragments", len(frames))
+
+	tail, err := modem.Samples(modem.NewSilence(p, fragment_tail))
+	chk(err)
+	for i, frame := range frames {
+		bits, err := frame.Bits()
+		chk(err)
+		packet, err := p.BuildPacket(bits)
+		chk(err)
+		chk(sink.Write(append(p.Transmission(packet), tail...)))
+		chk(sink.Drain())
+		if capture != nil {
+			chk(capture.Write(p.SentRecord(packet)))
+		}
+		logger.Info(modem.EvFrameSent, "index", i, "bytes", len(frame.Payload), "symbols", len(packet))
+	}
+}
+
+// pack_message is the number of bits, 4 bytes, then the bits packed into
+// bytes, so the receiver knows how much of the last byte is padding
+func pack_message(message modem.BitString) []byte {
+	bits := make([]byte, len(message))
+	for i, v := range message {
+		bits[i] = byte(v.Int64())
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(message))), modem.PackBits(bits)...)
+}
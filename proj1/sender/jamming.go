@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"audio"
+	"modem"
+)
+
+// send_around_jammer learns the jammer's pattern, then splits the message into
+// frames that fit the shortest gap and sends each one as soon as a burst ends.
+// The receiver gets them in order, run it with -frames. Gaps too short for
+// even a frame of one symbol are an error, nothing would get through.
+func send_around_jammer(sink audio.AudioSink, tracker *modem.JamTracker, p modem.Profile, logger *slog.Logger, capture *modem.PcapWriter, message modem.BitString, latency time.Duration) error {
+	for !tracker.Learned() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	gaps, bursts := tracker.Pattern()
+	budget := tracker.MinGap() - latency
+	symbols := p.SymbolsFitting(budget)
+	if !tracker.Jammed() {
+		// nothing to dodge, one frame as usual
+		symbols = len(message)/p.BitsPerSymbol() + 1
+	}
+	if symbols == 0 {
+		return fmt.Errorf("the jammer's shortest gap, %v, has no room for a frame of profile %s (%v) after -latency %v",
+			tracker.MinGap(), p.Name, p.FrameAirtime(1), latency)
+	}
+	bits_per_frame := symbols * p.BitsPerSymbol()
+	frames := (len(message) + bits_per_frame - 1) / bits_per_frame
+	logger.Info(modem.EvJamPattern, "jammed", tracker.Jammed(), "gaps", gaps, "bursts", bursts, "min_gap", tracker.MinGap(), "bits_per_frame", bits_per_frame, "frames", frames)
+
+	for i := 0; i < frames; i++ {
+		chunk := message[i*bits_per_frame : min((i+1)*bits_per_frame, len(message))]
+		packet, err := p.BuildPacket(chunk)
+		chk(err)
+		signal := p.Transmission(packet)
+		airtime := p.FrameAirtime(len(packet) - p.LenLength - 2)
+		waited := time.Now()
+		for tracker.QuietLeft() < airtime+latency {
+			time.Sleep(time.Millisecond)
+		}
+		// we'd hear ourselves as a burst
+		tracker.Mute(true)
+		chk(sink.Write(signal))
+		chk(sink.Drain())
+		// Drain is back once the device has the last of it, it's still in
+		// the device's buffer and we'd hear that as a burst too
+		time.Sleep(audio.OutputLatency(sink))
+		tracker.Mute(false)
+		if capture != nil {
+			chk(capture.Write(p.SentRecord(packet)))
+		}
+		logger.Info(modem.EvFrameSent, "index", i, "bits", len(chunk), "symbols", len(packet), "airtime", airtime, "waited", time.Since(waited))
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+module sweep
+
+go 1.21.3
+
+require modem v0.0.0
+
+require github.com/mjibson/go-dsp v0.0.0-20180508042940-11479a337f12 // indirect
+
+replace modem => ../modem
@@ -0,0 +1,214 @@
+// Sweeps profile parameters across SNR and clock drift settings by running
+// sender -> simulated channel -> receiver in process, so profiles can be picked
+// from data instead of by trial and error in a noisy room.
+//
+//	sweep -durations 100ms,200ms,400ms -steps 60,100,200 -bands 10,25 -snr 20,10,0 -csv sweep.csv
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"modem"
+)
+
+type Result struct {
+	Profile   modem.Profile
+	SNR       float64
+	DriftPPM  float64
+	Trials    int
+	Delivered int
+	BitErrors int
+	Bits      int
+	Airtime   time.Duration
+}
+
+func (r Result) BER() float64 {
+	return float64(r.BitErrors) / float64(max(r.Bits, 1))
+}
+
+// raw bits per second of airtime, including preamble and header
+func (r Result) Throughput() float64 {
+	return float64(r.Bits) / r.Airtime.Seconds()
+}
+
+// bits that made it through correctly per second of airtime
+func (r Result) Goodput() float64 {
+	return float64(r.Bits-r.BitErrors) / r.Airtime.Seconds()
+}
+
+func main() {
+	base_name := flag.String("profile", "default", "profile the swept parameters are applied to")
+	durations := flag.String("durations", "", "comma separated symbol durations to try, empty keeps the profile's")
+	steps := flag.String("steps", "", "comma separated tone spacings in Hz to try")
+	bands := flag.String("bands", "", "comma separated band counts to try")
+	snrs := flag.String("snr", "30,20,10,0", "comma separated SNRs in dB")
+	drifts := flag.String("drift", "0,100", "comma separated sample clock drifts in ppm")
+	bits := flag.Int("bits", 600, "message length of every trial in bits")
+	trials := flag.Int("trials", 1, "trials per setting")
+	seed := flag.Int64("seed", 1, "random seed for messages and noise")
+	chunk := flag.Int("chunk", 512, "samples handed to the receiver per callback")
+	sample_rate := flag.Int("sample-rate", 0, "rate the modem runs at, 0 keeps the profile's")
+	csv_path := flag.String("csv", "", "also write the table to this CSV file")
+	flag.Parse()
+
+	base, err := modem.LookupProfile(*base_name)
+	chk(err)
+	base = base.WithSampleRate(*sample_rate)
+
+	duration_list, err := parse_list(*durations, time.ParseDuration)
+	chk(err)
+	step_list, err := parse_list(*steps, parse_float)
+	chk(err)
+	band_list, err := parse_list(*bands, strconv.Atoi)
+	chk(err)
+	snr_list, err := parse_list(*snrs, parse_float)
+	chk(err)
+	drift_list, err := parse_list(*drifts, parse_float)
+	chk(err)
+	duration_list = or_default(duration_list, base.SymbolDuration)
+	step_list = or_default(step_list, base.FreqStep)
+	band_list = or_default(band_list, base.Bands)
+
+	rng := rand.New(rand.NewSource(*seed))
+	results := []Result{}
+	for _, d := range duration_list {
+		for _, step := range step_list {
+			for _, b := range band_list {
+				p := base
+				p.SymbolDuration, p.FreqStep, p.Bands = d, step, b
+				p.Name = fmt.Sprintf("%s/%v/%gHz/%d", base.Name, d, step, b)
+				if err := p.Validate(); err != nil {
+					fmt.Fprintf(os.Stderr, "skipping %s: %v\n", p.Name, err)
+					continue
+				}
+				for _, snr := range snr_list {
+					for _, drift := range drift_list {
+						r := Result{Profile: p, SNR: snr, DriftPPM: drift}
+						for t := 0; t < *trials; t++ {
+							run_trial(&r, *bits, *chunk, rng)
+						}
+						results = append(results, r)
+						fmt.Fprintf(os.Stderr, "%s snr=%g drift=%g: ber=%.4f delivered=%d/%d\n", p.Name, snr, drift, r.BER(), r.Delivered, r.Trials)
+					}
+				}
+			}
+		}
+	}
+
+	header, rows := table(results)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	chk(w.Flush())
+
+	if *csv_path != "" {
+		file, err := os.Create(*csv_path)
+		chk(err)
+		defer file.Close()
+		cw := csv.NewWriter(file)
+		chk(cw.Write(header))
+		chk(cw.WriteAll(rows))
+	}
+}
+
+func run_trial(r *Result, bits int, chunk int, rng *rand.Rand) {
+	p := r.Profile
+	message := make(modem.BitString, bits)
+	for i := range message {
+		message[i] = big.NewInt(rng.Int63n(2))
+	}
+	packet, err := p.BuildPacket(message)
+	chk(err)
+	signal := p.Transmission(packet)
+	channel := modem.NewChannel(p.SampleRate, r.SNR, r.DriftPPM, rng.Int63())
+	captured := channel.Apply(signal)
+
+	var got *modem.Frame
+	receiver := modem.NewReceiver(p)
+	receiver.OnFrame = func(f modem.Frame) { got = &f }
+	for i := 0; i < len(captured) && got == nil; i += chunk {
+		receiver.Write(captured[i:min(i+chunk, len(captured))])
+	}
+
+	r.Trials++
+	r.Bits += bits
+	r.Airtime += time.Duration(float64(len(signal)) / float64(p.SampleRate) * float64(time.Second))
+	if got == nil {
+		r.BitErrors += bits
+		return
+	}
+	if got.ChecksumOK {
+		r.Delivered++
+	}
+	for i, v := range message {
+		if i >= len(got.Bits) || int64(got.Bits[i]) != v.Int64() {
+			r.BitErrors++
+		}
+	}
+}
+
+func table(results []Result) ([]string, [][]string) {
+	header := []string{"duration", "step_hz", "bands", "bits_per_sym", "snr_db", "drift_ppm", "trials", "delivered", "ber", "throughput_bps", "goodput_bps"}
+	rows := [][]string{}
+	for _, r := range results {
+		rows = append(rows, []string{
+			r.Profile.SymbolDuration.String(),
+			strconv.FormatFloat(r.Profile.FreqStep, 'g', -1, 64),
+			strconv.Itoa(r.Profile.Bands),
+			strconv.Itoa(r.Profile.BitsPerSymbol()),
+			strconv.FormatFloat(r.SNR, 'g', -1, 64),
+			strconv.FormatFloat(r.DriftPPM, 'g', -1, 64),
+			strconv.Itoa(r.Trials),
+			strconv.Itoa(r.Delivered),
+			strconv.FormatFloat(r.BER(), 'f', 5, 64),
+			strconv.FormatFloat(r.Throughput(), 'f', 1, 64),
+			strconv.FormatFloat(r.Goodput(), 'f', 1, 64),
+		})
+	}
+	return header, rows
+}
+
+func parse_float(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parse_list[T any](s string, parse func(string) (T, error)) ([]T, error) {
+	out := []T{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		v, err := parse(field)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func or_default[T any](list []T, v T) []T {
+	if len(list) == 0 {
+		return []T{v}
+	}
+	return list
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -3,57 +3,65 @@
 package main
 
 import (
-	"github.com/ebitengine/oto/v3"
-
+	"flag"
 	"fmt"
 	"math"
-)
+	"os"
 
-const sampleRate = 44100
-const data_byte_length = 4
+	"audio"
+)
 
 type DoubleSine struct {
-	phase float64
+	phase      float64
 	phaseDelta float64
 }
 
 func NewDoubleSine(sampleRate float64) *DoubleSine {
 	return &DoubleSine{
-		phase: 0,
+		phase:      0,
 		phaseDelta: 2 * math.Pi / sampleRate,
 	}
 }
 
-func (d *DoubleSine) Read(buf []byte) (int, error) {
-	for i := 0; i < len(buf); i += 4 {
-		f := float32(math.Sin(1000 * d.phase) + math.Sin(10000 * d.phase)) 
-		bs := math.Float32bits(f)
-		buf[i] = byte(bs)
-		buf[i+1] = byte(bs>>8)
-		buf[i+2] = byte(bs>>16)
-		buf[i+3] = byte(bs>>24)
-		d.phase = math.Mod(d.phase + d.phaseDelta, 2 * math.Pi)
+func (d *DoubleSine) Fill(buf []float32) {
+	for i := range buf {
+		buf[i] = float32(math.Sin(1000*d.phase) + math.Sin(10000*d.phase))
+		d.phase = math.Mod(d.phase+d.phaseDelta, 2*math.Pi)
 	}
-	return len(buf) / 4 * 4, nil
 }
 
 func main() {
-	opts := &oto.NewContextOptions{}
-
-	opts.SampleRate = 44100
-	opts.ChannelCount = 1
-
-	opts.Format = oto.FormatFloat32LE
+	output := flag.String("output", "malgo", "audio backend to play on, one of "+audio.BackendsUsage())
+	sampleRate := flag.Int("sample-rate", 44100, "rate the tones are generated and played at")
+	devices := audio.AddDeviceFlags(flag.CommandLine, false, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
 
-	c, ready, err := oto.NewContext(opts)
+	device, err := devices.Output(*output)
 	chk(err)
-	<-ready
+	sink, err := audio.OpenSink(*output, audio.Config{SampleRate: *sampleRate, Device: device})
+	chk(err)
+	defer sink.Close()
 
-	p := c.NewPlayer(NewDoubleSine(sampleRate))
-	p.Play()
+	stop := make(chan struct{})
+	go func() {
+		sine := NewDoubleSine(float64(*sampleRate))
+		buf := make([]float32, 1024)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sine.Fill(buf)
+			chk(sink.Write(buf))
+		}
+	}()
 	fmt.Println("Press 'Enter' to Exit")
 	fmt.Scanln()
-
+	close(stop)
 }
 
 func chk(err error) {
@@ -0,0 +1,163 @@
+// udp over the air: datagrams from this node through a gateway node to a UDP
+// service on the gateway's network, printing what comes back. The gateway has
+// to run ../node with -nat, or -peer runs it in this process, which with a
+// loopback for both ends checks the whole way without a sound card.
+//
+//	udp 192.168.1.10:7
+//	udp -gateway 3 -count 10 -message "what time is it" 10.0.0.1:37
+//	udp -input loopback:air -output loopback:air -peer 2 127.0.0.1:7
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"time"
+
+	"audio"
+	"ip"
+	"link"
+	"modem"
+)
+
+// the port we send from, the service answers to it through the gateway
+const local_port = 49152
+
+func main() {
+	profile_name := flag.String("profile", "fast", "modulation profile, has to match the gateway's")
+	addr := flag.Int("addr", 1, "our link address, our IP address is "+ip.Subnet.String()+" with it as the last byte")
+	output := flag.String("output", "malgo", "audio backend to play on, one of "+audio.BackendsUsage())
+	input := flag.String("input", "malgo", "audio backend to capture from")
+	gateway := flag.Int("gateway", 2, "link address of the node passing UDP on to its network")
+	count := flag.Int("count", 4, "datagrams to send, 0 keeps going until killed")
+	interval := flag.Duration("interval", time.Second, "pause between a reply, or giving up on it, and the next datagram")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long to wait for every reply")
+	message := flag.String("message", "hello over the air", "what every datagram says")
+	peer := flag.Bool("peer", false, "also run the gateway in this process, on the same audio backends")
+	key := flag.String("key", "", "passphrase to encrypt and authenticate frames with, has to match the gateway's, frames that don't authenticate with it are dropped")
+	key_file := flag.String("key-file", "", "file with the key, 32 bytes of it as they are or else a passphrase")
+	pcap_path := flag.String("pcap", "", "write every frame sent and received to this pcapng file")
+	sample_rate := flag.Int("sample-rate", 0, "rate the modem runs at, 0 keeps the profile's")
+	device_rate := flag.Int("device-rate", 0, "rate the audio devices run at, resampled from the modem's, 0 means the same")
+	log_level := flag.String("log-level", "warn", "lowest event level to log: debug, info, warn or error")
+	log_format := flag.String("log-format", "json", "event log format: json or text")
+	log_output := flag.String("log-output", "-", "where events go: - for stderr, stdout, or a file path")
+	devices := audio.AddDeviceFlags(flag.CommandLine, true, true)
+	flag.Parse()
+	if devices.Listed(os.Stdout) {
+		return
+	}
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: udp [flags] <ip address:port>")
+		os.Exit(2)
+	}
+	dst, err := netip.ParseAddrPort(flag.Arg(0))
+	chk(err)
+
+	logger, log_closer, err := modem.OpenLogger(*log_level, *log_format, *log_output)
+	chk(err)
+	defer log_closer.Close()
+
+	p, err := modem.LookupProfile(*profile_name)
+	chk(err)
+	p = p.WithSampleRate(*sample_rate)
+	chk(p.Validate())
+
+	output_device, err := devices.Output(*output)
+	chk(err)
+	sink, err := audio.OpenSink(*output, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: output_device})
+	chk(err)
+	defer sink.Close()
+	input_device, err := devices.Input(*input)
+	chk(err)
+	source, err := audio.OpenSource(*input, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: input_device})
+	chk(err)
+	defer source.Close()
+
+	node := link.NewNode(link.Addr(*addr), p, sink, source)
+	defer node.Close()
+	node.Logger = logger
+	node.Crypt, err = link.OpenCrypt(*key, *key_file)
+	chk(err)
+	if *pcap_path != "" {
+		node.Pcap, err = modem.NewPcapWriter(*pcap_path, "udp")
+		chk(err)
+		defer node.Pcap.Close()
+	}
+	stack := ip.NewStack(node)
+	stack.Gateway = link.Addr(*gateway)
+	chk(node.Start())
+
+	var nat *ip.Gateway
+	if *peer {
+		// the same backends give the same loopback, a sound card gets opened
+		// a second time
+		peer_sink, err := audio.OpenSink(*output, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: output_device})
+		chk(err)
+		defer peer_sink.Close()
+		peer_source, err := audio.OpenSource(*input, audio.Config{SampleRate: p.SampleRate, DeviceRate: *device_rate, Device: input_device})
+		chk(err)
+		defer peer_source.Close()
+		peer_node := link.NewNode(link.Addr(*gateway), p, peer_sink, peer_source)
+		defer peer_node.Close()
+		peer_node.Logger = logger
+		peer_node.Crypt, err = link.OpenCrypt(*key, *key_file)
+		chk(err)
+		nat = ip.NewGateway(ip.NewStack(peer_node))
+		defer nat.Close()
+		chk(peer_node.Start())
+	}
+
+	replies := make(chan ip.UDP, 16)
+	stack.HandleUDP(local_port, func(p ip.Packet, u ip.UDP) {
+		if p.Src != dst.Addr() || u.SrcPort != dst.Port() {
+			return
+		}
+		select {
+		case replies <- u:
+		default:
+		}
+	})
+
+	fmt.Printf("UDP to %v from %v:%d through node %d over profile %s\n", dst, stack.Addr, local_port, *gateway, p.Name)
+	sent, received := 0, 0
+	for seq := 0; *count == 0 || seq < *count; seq++ {
+		if seq > 0 {
+			time.Sleep(*interval)
+		}
+		// a reply that came too late isn't this one's
+		for len(replies) > 0 {
+			<-replies
+		}
+		sent++
+		if err := stack.SendUDP(local_port, dst, []byte(*message)); err != nil {
+			fmt.Printf("datagram %d: %v\n", seq, err)
+			continue
+		}
+		start := time.Now()
+		select {
+		case u := <-replies:
+			received++
+			fmt.Printf("%d bytes from %v: %q time=%v\n", len(u.Payload), dst, u.Payload, time.Since(start).Round(time.Millisecond))
+		case <-time.After(*timeout):
+			fmt.Printf("no reply to datagram %d within %v\n", seq, *timeout)
+		}
+	}
+	fmt.Printf("--- %v ---\n%d datagrams sent, %d replies\n", dst, sent, received)
+	if nat != nil {
+		for _, m := range nat.Mappings() {
+			fmt.Printf("gateway maps %v to %v, idle for %v\n", m.Inside, m.Outside, m.Idle.Round(time.Millisecond))
+		}
+	}
+	if received == 0 {
+		os.Exit(1)
+	}
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,3 @@
+module waterfall
+
+go 1.21.1
@@ -0,0 +1,166 @@
+// Renders the receiver's per-symbol diagnostics (receiver -diag) as a waterfall PNG.
+// Each row is one symbol window, each column one candidate tone, bands are laid
+// out left to right. Brightness is the tone energy normalized within its band,
+// the chosen tone is drawn green, or red when its margin over the runner-up is
+// below the fraction -weak of the band's peak energy.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type DiagRecord struct {
+	Symbol   int       `json:"symbol"`
+	Band     int       `json:"band"`
+	LowFreq  float64   `json:"low_freq"`
+	Chosen   int       `json:"chosen"`
+	RunnerUp int       `json:"runner_up"`
+	Margin   float64   `json:"margin"`
+	Energy   []float64 `json:"energy"`
+}
+
+func main() {
+	in := flag.String("in", "diag.csv", "diagnostics file written by the receiver (.csv or .json)")
+	out := flag.String("out", "waterfall.png", "output PNG")
+	cell_flag := flag.Int("cell", 4, "pixel size of a single tone cell")
+	weak := flag.Float64("weak", 0.1, "a chosen tone whose margin over the runner-up is below this fraction of the band's peak energy is drawn red")
+	flag.Parse()
+	cell := *cell_flag
+
+	records, err := read_records(*in)
+	chk(err)
+	if len(records) == 0 {
+		fmt.Println("No records found")
+		os.Exit(1)
+	}
+
+	symbols, bands, states := 0, 0, 0
+	for _, r := range records {
+		symbols = max(symbols, r.Symbol+1)
+		bands = max(bands, r.Band+1)
+		states = max(states, len(r.Energy))
+	}
+
+	// one dark column between bands so they're easy to tell apart
+	band_width := states + 1
+	img := image.NewRGBA(image.Rect(0, 0, bands*band_width*cell, symbols*cell))
+	for _, r := range records {
+		peak := 0.0
+		for _, v := range r.Energy {
+			peak = max(peak, v)
+		}
+		for j, v := range r.Energy {
+			level := 0.0
+			if peak > 0 {
+				level = max(v, 0) / peak
+			}
+			c := color.RGBA{uint8(255 * level), uint8(255 * level), uint8(255 * level), 255}
+			if j == r.Chosen {
+				if peak > 0 && r.Margin < *weak*peak {
+					c = color.RGBA{255, 0, 0, 255}
+				} else {
+					c = color.RGBA{0, uint8(128 + 127*level), 0, 255}
+				}
+			}
+			x := r.Band*band_width + j
+			fill(img, x*cell, r.Symbol*cell, cell, c)
+		}
+	}
+
+	file, err := os.Create(*out)
+	chk(err)
+	defer file.Close()
+	chk(png.Encode(file, img))
+	fmt.Printf("Rendered %d symbols x %d bands x %d tones into %s\n", symbols, bands, states, *out)
+}
+
+func fill(img *image.RGBA, x0, y0, size int, c color.RGBA) {
+	for y := y0; y < y0+size; y++ {
+		for x := x0; x < x0+size; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func read_records(path string) ([]DiagRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", ".jsonl":
+		return read_json(file)
+	default:
+		return read_csv(file)
+	}
+}
+
+func read_json(r io.Reader) ([]DiagRecord, error) {
+	out := []DiagRecord{}
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var rec DiagRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rec)
+	}
+}
+
+// columns: symbol, band, low_freq, chosen, runner_up, margin, e0, e1, ...
+func read_csv(r io.Reader) ([]DiagRecord, error) {
+	rows, err := csv.NewReader(bufio.NewReader(r)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	out := []DiagRecord{}
+	for line, row := range rows {
+		if line == 0 {
+			continue
+		}
+		if len(row) < 6 {
+			return nil, fmt.Errorf("line %d: expected at least 6 columns, got %d", line+1, len(row))
+		}
+		nums := make([]float64, len(row))
+		for i, v := range row {
+			nums[i], err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line+1, err)
+			}
+		}
+		out = append(out, DiagRecord{
+			Symbol:   int(nums[0]),
+			Band:     int(nums[1]),
+			LowFreq:  nums[2],
+			Chosen:   int(nums[3]),
+			RunnerUp: int(nums[4]),
+			Margin:   nums[5],
+			Energy:   nums[6:],
+		})
+	}
+	return out, nil
+}
+
+func chk(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,164 @@
+-- Wireshark dissector for the captures the sender, receiver and loopback write
+-- with -pcap, see ../modem/pcapng.go for the record layout. Copy it into the
+-- personal plugins folder (Help > About Wireshark > Folders), or run
+--
+--	wireshark -X lua_script:acoustic.lua capture.pcapng
+
+local acoustic = Proto("acoustic", "Acoustic modem frame")
+local acoustic_link = Proto("acoustic_link", "Acoustic link frame")
+
+local flag_names = {
+	[0] = "sent",
+	[1] = "received",
+}
+
+local f = acoustic.fields
+f.version = ProtoField.uint8("acoustic.version", "Version")
+f.flags = ProtoField.uint8("acoustic.flags", "Flags", base.HEX)
+f.received = ProtoField.uint8("acoustic.flags.received", "Direction", base.DEC, flag_names, 0x01)
+f.checksum_ok = ProtoField.bool("acoustic.flags.checksum_ok", "Checksum ok", 8, nil, 0x02)
+f.snr_known = ProtoField.bool("acoustic.flags.snr_known", "SNR known", 8, nil, 0x04)
+f.snr = ProtoField.float("acoustic.snr", "SNR (dB)")
+f.length = ProtoField.uint32("acoustic.length", "Length (symbols)")
+f.modulo = ProtoField.uint8("acoustic.modulo", "Modulo")
+f.bits_per_symbol = ProtoField.uint8("acoustic.bits_per_symbol", "Bits per symbol")
+f.hash_length = ProtoField.uint16("acoustic.hash_length", "Hash length")
+f.bit_count = ProtoField.uint32("acoustic.bit_count", "Bits")
+f.hash = ProtoField.bytes("acoustic.hash", "Hash")
+f.data = ProtoField.bytes("acoustic.data", "Data")
+
+local l = acoustic_link.fields
+l.version = ProtoField.uint8("acoustic_link.version", "Version")
+l.flags = ProtoField.uint8("acoustic_link.flags", "Flags", base.HEX)
+l.dst = ProtoField.uint8("acoustic_link.dst", "Destination")
+l.src = ProtoField.uint8("acoustic_link.src", "Source")
+l.type = ProtoField.uint16("acoustic_link.type", "Type", base.HEX)
+l.length = ProtoField.uint16("acoustic_link.length", "Length")
+l.crc = ProtoField.uint32("acoustic_link.crc", "CRC-32", base.HEX)
+l.fragment = ProtoField.bool("acoustic_link.flags.fragment", "Fragment", 8, nil, 0x01)
+l.more_fragments = ProtoField.bool("acoustic_link.flags.more_fragments", "More fragments", 8, nil, 0x02)
+l.compressed = ProtoField.bool("acoustic_link.flags.compressed", "Compressed", 8, nil, 0x04)
+l.encrypted = ProtoField.bool("acoustic_link.flags.encrypted", "Encrypted", 8, nil, 0x08)
+l.routed = ProtoField.bool("acoustic_link.flags.routed", "Routed", 8, nil, 0x10)
+l.seq = ProtoField.uint64("acoustic_link.seq", "Sequence number")
+l.fragment_id = ProtoField.uint16("acoustic_link.fragment.id", "Fragment ID", base.HEX)
+l.fragment_offset = ProtoField.uint16("acoustic_link.fragment.offset", "Fragment offset")
+l.origin = ProtoField.uint8("acoustic_link.route.origin", "Origin")
+l.target = ProtoField.uint8("acoustic_link.route.target", "Target")
+l.ttl = ProtoField.uint8("acoustic_link.route.ttl", "TTL")
+l.ack_wanted = ProtoField.bool("acoustic_link.route.ack_wanted", "Ack wanted", 8, nil, 0x01)
+l.route_seq = ProtoField.uint16("acoustic_link.route.seq", "Route sequence number")
+
+local ethertype = DissectorTable.get("ethertype")
+
+-- see ../link/frame.go, payloads of a known EtherType go on to their dissector
+local function dissect_link(buf, pinfo, tree)
+	if buf:len() < 12 or buf(0, 1):uint() ~= 1 then
+		return false
+	end
+	local length = buf(6, 2):uint()
+	if 8 + length + 4 ~= buf:len() then
+		return false
+	end
+	local t = tree:add(acoustic_link, buf())
+	t:add(l.version, buf(0, 1))
+	local flags = buf(1, 1):uint()
+	local ft = t:add(l.flags, buf(1, 1))
+	ft:add(l.fragment, buf(1, 1))
+	ft:add(l.more_fragments, buf(1, 1))
+	ft:add(l.compressed, buf(1, 1))
+	ft:add(l.encrypted, buf(1, 1))
+	ft:add(l.routed, buf(1, 1))
+	t:add(l.dst, buf(2, 1))
+	t:add(l.src, buf(3, 1))
+	t:add(l.type, buf(4, 2))
+	t:add(l.length, buf(6, 2))
+	t:add(l.crc, buf(8 + length, 4))
+	pinfo.cols.src = tostring(buf(3, 1):uint())
+	pinfo.cols.dst = tostring(buf(2, 1):uint())
+	-- see ../link/fragment.go, a piece of a payload is no use to the next
+	-- dissector
+	if bit.band(flags, 0x01) ~= 0 then
+		if length >= 4 then
+			t:add(l.fragment_id, buf(8, 2))
+			t:add(l.fragment_offset, buf(10, 2))
+		end
+		return true
+	end
+	-- nor is a sealed one, see ../link/crypt.go, or a deflated one, see
+	-- ../link/compress.go
+	if bit.band(flags, 0x08) ~= 0 then
+		if length >= 8 then
+			t:add(l.seq, buf(8, 8))
+		end
+		return true
+	end
+	if bit.band(flags, 0x04) ~= 0 then
+		return true
+	end
+	-- see ../link/route.go, the route header comes before the data
+	local start = 8
+	if bit.band(flags, 0x10) ~= 0 then
+		if length < 6 then
+			return true
+		end
+		t:add(l.origin, buf(8, 1))
+		t:add(l.target, buf(9, 1))
+		t:add(l.ttl, buf(10, 1))
+		t:add(l.ack_wanted, buf(11, 1))
+		t:add(l.route_seq, buf(12, 2))
+		start = 14
+		length = length - 6
+	end
+	if length > 0 then
+		ethertype:try(buf(4, 2):uint(), buf(start, length):tvb(), pinfo, tree)
+	end
+	return true
+end
+
+function acoustic.dissector(buf, pinfo, tree)
+	if buf:len() < 16 then
+		return 0
+	end
+	pinfo.cols.protocol = "ACOUSTIC"
+	local t = tree:add(acoustic, buf())
+	t:add(f.version, buf(0, 1))
+	local flags = buf(1, 1):uint()
+	local ft = t:add(f.flags, buf(1, 1))
+	ft:add(f.received, buf(1, 1))
+	ft:add(f.checksum_ok, buf(1, 1))
+	ft:add(f.snr_known, buf(1, 1))
+	local snr = buf(2, 2):int() / 100
+	if bit.band(flags, 0x04) ~= 0 then
+		t:add(f.snr, buf(2, 2), snr)
+	end
+	t:add(f.length, buf(4, 4))
+	t:add(f.modulo, buf(8, 1))
+	t:add(f.bits_per_symbol, buf(9, 1))
+	t:add(f.hash_length, buf(10, 2))
+	t:add(f.bit_count, buf(12, 4))
+	local hash_length = buf(10, 2):uint()
+	local bit_count = buf(12, 4):uint()
+	if hash_length > 0 then
+		t:add(f.hash, buf(16, hash_length))
+	end
+	local data_length = math.floor((bit_count + 7) / 8)
+	if data_length > 0 then
+		t:add(f.data, buf(16 + hash_length, data_length))
+	end
+
+	local info = flag_names[bit.band(flags, 0x01)] .. " " .. bit_count .. " bits"
+	if bit.band(flags, 0x02) == 0 then
+		info = info .. ", bad checksum"
+	end
+	if bit.band(flags, 0x04) ~= 0 then
+		info = info .. string.format(", snr %.1f dB", snr)
+	end
+	pinfo.cols.info = info
+	if data_length > 0 and bit_count % 8 == 0 then
+		dissect_link(buf(16 + hash_length, data_length):tvb(), pinfo, tree)
+	end
+	return buf:len()
+end
+
+DissectorTable.get("wtap_encap"):add(wtap.USER0, acoustic)